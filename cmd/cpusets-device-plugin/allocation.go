@@ -0,0 +1,216 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/checkpoint"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/topology"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+const (
+	// CDIVersion is the version of the Container Device Interface specification the generated spec files conform to
+	CDIVersion = "0.5.0"
+	// CDIAnnotationPrefix is the prefix of the container annotations runtimes resolve CDI device references from
+	CDIAnnotationPrefix = "cdi.k8s.io/"
+)
+
+var (
+	// allocationInfoDir is the host directory the per-allocation JSON files are written to, mounting them is disabled when empty
+	// The directory must be mounted at the same path into the device plugin container
+	allocationInfoDir string
+	// allocationInfoMountDir is the directory the allocation files are mounted to in the containers, as <pool name>.json
+	allocationInfoMountDir = "/etc/cpusets"
+	// cdiSpecDir is the directory CDI spec files are written to, returning CDI device references is disabled when empty
+	cdiSpecDir string
+	// allocationGCGracePeriod protects fresh allocation files which are not yet recorded in the kubelet checkpoint from garbage collection
+	allocationGCGracePeriod = 5 * time.Minute
+)
+
+// cdiSpec is the subset of the CDI specification used to describe one allocation
+type cdiSpec struct {
+	Version string      `json:"cdiVersion"`
+	Kind    string      `json:"kind"`
+	Devices []cdiDevice `json:"devices"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	Env    []string   `json:"env,omitempty"`
+	Mounts []cdiMount `json:"mounts,omitempty"`
+}
+
+type cdiMount struct {
+	HostPath      string   `json:"hostPath"`
+	ContainerPath string   `json:"containerPath"`
+	Options       []string `json:"options,omitempty"`
+}
+
+func cdiKind() string {
+	return resourceBaseName + "/cpuset"
+}
+
+func cdiSpecFilePrefix() string {
+	return strings.ReplaceAll(cdiKind(), "/", "-") + "-"
+}
+
+// allocationID deterministically names the allocation of the given devices from the pool
+func (cdm *cpuDeviceManager) allocationID(deviceIDs []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(sortedCopy(deviceIDs), ",")))
+	return cdm.poolName + "-" + hex.EncodeToString(sum[:])[:12]
+}
+
+func (cdm *cpuDeviceManager) allocationInfo(cpus cpuset.CPUSet) types.AllocationInfo {
+	info := types.AllocationInfo{
+		Pool:     cdm.poolName,
+		PoolType: cdm.poolType,
+		CPUs:     cpus.String(),
+		CPUList:  cpus.ToSlice(),
+	}
+	numaNodes := cpuset.NewBuilder()
+	for _, cpuID := range info.CPUList {
+		if numaNode, exists := cdm.nodeTopology[cpuID]; exists {
+			numaNodes.Add(numaNode)
+		}
+		if siblings := topology.GetHTSiblings(cpuID, cdm.htTopology); !siblings.IsEmpty() {
+			if info.HTSiblings == nil {
+				info.HTSiblings = make(map[int]string)
+			}
+			info.HTSiblings[cpuID] = siblings.String()
+		}
+	}
+	info.NUMANodes = numaNodes.Result().ToSlice()
+	return info
+}
+
+// decorateAllocation adds the optional allocation file mount, and CDI device references to the response of one container
+// Failures are logged only, the environment variables remain the baseline way of consuming an allocation
+func (cdm *cpuDeviceManager) decorateAllocation(containerResp *pluginapi.ContainerAllocateResponse, deviceIDs []string, cpus cpuset.CPUSet) {
+	if allocationInfoDir == "" && cdiSpecDir == "" {
+		return
+	}
+	id := cdm.allocationID(deviceIDs)
+	var mount *pluginapi.Mount
+	if allocationInfoDir != "" {
+		hostPath := filepath.Join(allocationInfoDir, id+".json")
+		if err := writeJSONFile(hostPath, cdm.allocationInfo(cpus)); err != nil {
+			mainLogger.Error("Cannot write allocation file", logger.Any("file", hostPath), logger.Error(err))
+		} else {
+			mount = &pluginapi.Mount{
+				ContainerPath: filepath.Join(allocationInfoMountDir, cdm.poolName+".json"),
+				HostPath:      hostPath,
+				ReadOnly:      true,
+			}
+			containerResp.Mounts = append(containerResp.Mounts, mount)
+		}
+	}
+	if cdiSpecDir != "" {
+		device := cdiDevice{Name: id}
+		for name, value := range containerResp.Envs {
+			device.ContainerEdits.Env = append(device.ContainerEdits.Env, name+"="+value)
+		}
+		sort.Strings(device.ContainerEdits.Env)
+		if mount != nil {
+			device.ContainerEdits.Mounts = []cdiMount{{HostPath: mount.HostPath, ContainerPath: mount.ContainerPath, Options: []string{"ro", "bind"}}}
+		}
+		specFile := filepath.Join(cdiSpecDir, cdiSpecFilePrefix()+id+".json")
+		spec := cdiSpec{Version: CDIVersion, Kind: cdiKind(), Devices: []cdiDevice{device}}
+		if err := writeJSONFile(specFile, spec); err != nil {
+			mainLogger.Error("Cannot write CDI spec file", logger.Any("file", specFile), logger.Error(err))
+		} else {
+			if containerResp.Annotations == nil {
+				containerResp.Annotations = make(map[string]string)
+			}
+			containerResp.Annotations[CDIAnnotationPrefix+"cpusets_"+cdm.poolName] = cdiKind() + "=" + id
+			containerResp.Annotations[resourceBaseName+"/cpuset."+cdm.poolName] = cpus.String()
+		}
+	}
+	cdm.collectAllocationGarbage()
+}
+
+// collectAllocationGarbage removes the files of the pool's allocations which are not in use by any container anymore
+func (cdm *cpuDeviceManager) collectAllocationGarbage() {
+	cp, err := checkpoint.ReadFile(checkpoint.KubeletCheckpointFile)
+	if err != nil {
+		return
+	}
+	inUse := make(map[string]bool)
+	for _, entry := range cp.Data.PodDeviceEntries {
+		if entry.ResourceName == cdm.resourceName() {
+			inUse[cdm.allocationID(entry.DeviceIDs)] = true
+		}
+	}
+	removeUnusedAllocationFiles(allocationInfoDir, "", cdm.poolName, inUse)
+	removeUnusedAllocationFiles(cdiSpecDir, cdiSpecFilePrefix(), cdm.poolName, inUse)
+}
+
+// removeUnusedAllocationFiles deletes the <filePrefix><allocation ID>.json files of the pool which are not in use, and are older than the grace period
+func removeUnusedAllocationFiles(dir, filePrefix, poolName string, inUse map[string]bool) {
+	if dir == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(dir, filePrefix+poolName+"-*.json"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		id := strings.TrimPrefix(strings.TrimSuffix(filepath.Base(f), ".json"), filePrefix)
+		//The glob also matches the files of pools whose name starts with the name of this pool
+		if _, err := hex.DecodeString(strings.TrimPrefix(id, poolName+"-")); err != nil || len(id) != len(poolName)+13 || inUse[id] {
+			continue
+		}
+		stat, err := os.Stat(f)
+		if err != nil || time.Since(stat.ModTime()) < allocationGCGracePeriod {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			mainLogger.Warn("Cannot remove unused allocation file", logger.Any("file", f), logger.Error(err))
+		}
+	}
+}
+
+func writeJSONFile(fileName string, content interface{}) error {
+	buf, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	//Write and rename, so a container never sees a partially written file
+	tmpFile := fileName + ".tmp"
+	if err := os.WriteFile(tmpFile, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, fileName)
+}
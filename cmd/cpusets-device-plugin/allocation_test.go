@@ -0,0 +1,112 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/checkpoint"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+func TestAllocateWithAllocationFileAndCDI(t *testing.T) {
+	assert := assert.New(t)
+	allocationInfoDir = t.TempDir()
+	cdiSpecDir = t.TempDir()
+	defer func() { allocationInfoDir, cdiSpecDir = "", "" }()
+
+	cdm := &cpuDeviceManager{
+		poolName:     "exclusive-pool1",
+		poolType:     types.ExclusivePoolID,
+		pool:         types.Pool{CPUset: cpuset.NewCPUSet(2, 3, 6, 7), HTPolicy: types.MultiThreadHTPolicy},
+		nodeTopology: map[int]int{2: 0, 3: 0, 6: 1, 7: 1},
+		htTopology:   map[int]string{2: "6", 3: "7"},
+	}
+	request := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"2"}}}}
+	resp, err := cdm.Allocate(context.Background(), request)
+	assert.Nil(err)
+	containerResp := resp.ContainerResponses[0]
+	assert.Equal("2,6", containerResp.Envs["EXCLUSIVE_CPUS"])
+
+	id := cdm.allocationID([]string{"2"})
+	assert.Len(containerResp.Mounts, 1)
+	assert.Equal("/etc/cpusets/exclusive-pool1.json", containerResp.Mounts[0].ContainerPath)
+	assert.Equal(filepath.Join(allocationInfoDir, id+".json"), containerResp.Mounts[0].HostPath)
+	assert.True(containerResp.Mounts[0].ReadOnly)
+
+	info, err := types.ReadAllocationInfo(containerResp.Mounts[0].HostPath)
+	assert.Nil(err)
+	assert.Equal(types.AllocationInfo{
+		Pool:       "exclusive-pool1",
+		PoolType:   types.ExclusivePoolID,
+		CPUs:       "2,6",
+		CPUList:    []int{2, 6},
+		NUMANodes:  []int{0, 1},
+		HTSiblings: map[int]string{2: "6", 6: "2"},
+	}, info)
+
+	assert.Equal("cmss.cn/cpuset="+id, containerResp.Annotations["cdi.k8s.io/cpusets_exclusive-pool1"])
+	assert.Equal("2,6", containerResp.Annotations["cmss.cn/cpuset.exclusive-pool1"])
+	buf, err := os.ReadFile(filepath.Join(cdiSpecDir, "cmss.cn-cpuset-"+id+".json"))
+	assert.Nil(err)
+	var spec cdiSpec
+	assert.Nil(json.Unmarshal(buf, &spec))
+	assert.Equal("cmss.cn/cpuset", spec.Kind)
+	assert.Equal(id, spec.Devices[0].Name)
+	assert.Equal([]string{"EXCLUSIVE_CPUS=2,6"}, spec.Devices[0].ContainerEdits.Env)
+	assert.Equal(containerResp.Mounts[0].HostPath, spec.Devices[0].ContainerEdits.Mounts[0].HostPath)
+}
+
+func TestAllocationGarbageCollection(t *testing.T) {
+	assert := assert.New(t)
+	allocationInfoDir = t.TempDir()
+	origCheckpoint, origGrace := checkpoint.KubeletCheckpointFile, allocationGCGracePeriod
+	checkpoint.KubeletCheckpointFile = filepath.Join(t.TempDir(), "kubelet_internal_checkpoint")
+	defer func() {
+		allocationInfoDir = ""
+		checkpoint.KubeletCheckpointFile, allocationGCGracePeriod = origCheckpoint, origGrace
+	}()
+
+	cdm := &cpuDeviceManager{poolName: "exclusive", poolType: types.ExclusivePoolID}
+	other := &cpuDeviceManager{poolName: "exclusive-pool1", poolType: types.ExclusivePoolID}
+	inUse := filepath.Join(allocationInfoDir, cdm.allocationID([]string{"1"})+".json")
+	unused := filepath.Join(allocationInfoDir, cdm.allocationID([]string{"2"})+".json")
+	otherPool := filepath.Join(allocationInfoDir, other.allocationID([]string{"3"})+".json")
+	for _, f := range []string{inUse, unused, otherPool} {
+		assert.Nil(writeJSONFile(f, types.AllocationInfo{}))
+	}
+	cp := `{"Data":{"PodDeviceEntries":[{"PodUID":"uid","ContainerName":"c","ResourceName":"cmss.cn/exclusive","DeviceIDs":["1"]}]}}`
+	assert.Nil(os.WriteFile(checkpoint.KubeletCheckpointFile, []byte(cp), 0644))
+
+	cdm.collectAllocationGarbage()
+	assert.FileExists(unused, "files younger than the grace period are kept")
+
+	allocationGCGracePeriod = time.Duration(0)
+	cdm.collectAllocationGarbage()
+	assert.FileExists(inUse)
+	assert.NoFileExists(unused)
+	assert.FileExists(otherPool)
+}
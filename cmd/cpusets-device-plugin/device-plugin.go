@@ -20,20 +20,20 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/kubeservice-stack/common/pkg/logger"
 	"github.com/kubeservice-stack/cpusets-controller/pkg/client"
 	"github.com/kubeservice-stack/cpusets-controller/pkg/config"
-	"github.com/kubeservice-stack/cpusets-controller/third_party/forked/nokia/CPU-Pooler/pkg/checkpoint"
-	"github.com/kubeservice-stack/cpusets-controller/third_party/forked/nokia/CPU-Pooler/pkg/types"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/topology"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
 	"golang.org/x/net/context"
 	grpc "google.golang.org/grpc"
 	"k8s.io/client-go/kubernetes"
@@ -43,33 +43,40 @@ import (
 
 var (
 	resourceBaseName = "cmss.cn"
-	cdms             []*cpuDeviceManager
+	devicePluginPath = pluginapi.DevicePluginPath
+	kubeletSocket    = pluginapi.KubeletSocket
+	poolConfig       types.PoolConfig
+	cpusetRoot       string
+	healthAddress    string
 	mainLogger       = logger.GetLogger("cmd/cpusets-device-plugin", "main")
 )
 
 type cpuDeviceManager struct {
-	pool           types.Pool
-	socketFile     string
-	grpcServer     *grpc.Server
-	sharedPoolCPUs string
-	poolType       string
-	nodeTopology   map[int]int
-	htTopology     map[int]string
+	pool         types.Pool
+	poolName     string
+	socketFile   string
+	grpcServer   *grpc.Server
+	poolType     string
+	nodeTopology map[int]int
+	htTopology   map[int]string
 }
 
-//TODO: PoC if cpuset setting could be implemented in this hook? cpuset cgroup of the container should already exist at this point (kinda)
-//The DeviceIDs could be used to determine which container has them, once we have a container name parsed out from the allocation backend we could manipulate its cpuset before it is even started
-//Long shot, but if it works both cpusetter and process starter would become unnecessary
-func (cdm *cpuDeviceManager) PreStartContainer(ctx context.Context, psRqt *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	return &pluginapi.PreStartContainerResponse{}, nil
+func (cdm *cpuDeviceManager) endpoint() string {
+	return filepath.Join(devicePluginPath, cdm.socketFile)
 }
 
 func (cdm *cpuDeviceManager) Start() error {
-	pluginEndpoint := filepath.Join(pluginapi.DevicePluginPath, cdm.socketFile)
+	pluginEndpoint := cdm.endpoint()
 	mainLogger.Info("Starting CPU Device Plugin server", logger.Any("endpoint", pluginEndpoint))
+	//A socket left behind by a previous instance would make Listen fail
+	if err := cdm.cleanup(); err != nil {
+		mainLogger.Error("Error. Cannot remove stale CPU Device Plugin socket", logger.Error(err))
+		return err
+	}
 	lis, err := net.Listen("unix", pluginEndpoint)
 	if err != nil {
 		mainLogger.Error("Error. Starting CPU Device Plugin server failed", logger.Error(err))
+		return err
 	}
 	cdm.grpcServer = grpc.NewServer()
 
@@ -95,7 +102,7 @@ func (cdm *cpuDeviceManager) Start() error {
 }
 
 func (cdm *cpuDeviceManager) cleanup() error {
-	pluginEndpoint := filepath.Join(pluginapi.DevicePluginPath, cdm.socketFile)
+	pluginEndpoint := cdm.endpoint()
 	if err := os.Remove(pluginEndpoint); err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -116,22 +123,7 @@ func (cdm *cpuDeviceManager) ListAndWatch(e *pluginapi.Empty, stream pluginapi.D
 	var updateNeeded = true
 	for {
 		if updateNeeded {
-			resp := new(pluginapi.ListAndWatchResponse)
-			if cdm.poolType == "shared" {
-				nbrOfCPUs := cdm.pool.CPUset.Size()
-				for i := 0; i < nbrOfCPUs*1000; i++ {
-					cpuID := strconv.Itoa(i)
-					resp.Devices = append(resp.Devices, &pluginapi.Device{ID: cpuID, Health: pluginapi.Healthy})
-				}
-			} else {
-				for _, cpuID := range cdm.pool.CPUset.ToSlice() {
-					exclusiveCore := pluginapi.Device{ID: strconv.Itoa(cpuID), Health: pluginapi.Healthy}
-					if numaNode, exists := cdm.nodeTopology[cpuID]; exists {
-						exclusiveCore.Topology = &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: int64(numaNode)}}}
-					}
-					resp.Devices = append(resp.Devices, &exclusiveCore)
-				}
-			}
+			resp := &pluginapi.ListAndWatchResponse{Devices: cdm.devices()}
 			if err := stream.Send(resp); err != nil {
 				mainLogger.Error("Error. Cannot update device states", logger.Error(err))
 				return err
@@ -141,8 +133,48 @@ func (cdm *cpuDeviceManager) ListAndWatch(e *pluginapi.Empty, stream pluginapi.D
 		//TODO: When is update needed ?
 		time.Sleep(5 * time.Second)
 	}
-	return nil
+}
+
+// devices returns the devices advertised for the pool
+// Shared pools advertise a thousand devices per CPU, one per millicore. Exclusive pools advertise one device per logical CPU,
+// or one device per physical core in physicalCore mode, identified by the primary thread of the core
+func (cdm *cpuDeviceManager) devices() []*pluginapi.Device {
+	var devices []*pluginapi.Device
+	if cdm.poolType == types.SharedPoolID {
+		nbrOfCPUs := cdm.pool.CPUset.Size()
+		for i := 0; i < nbrOfCPUs*1000; i++ {
+			devices = append(devices, &pluginapi.Device{ID: strconv.Itoa(i), Health: pluginapi.Healthy})
+		}
+		return devices
+	}
+	for _, cpuID := range cdm.pool.CPUset.ToSlice() {
+		if cdm.pool.HTPolicy == types.PhysicalCoreHTPolicy && !cdm.isAdvertisedCore(cpuID) {
+			continue
+		}
+		exclusiveCore := pluginapi.Device{ID: strconv.Itoa(cpuID), Health: pluginapi.Healthy}
+		if numaNode, exists := cdm.nodeTopology[cpuID]; exists {
+			exclusiveCore.Topology = &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: int64(numaNode)}}}
+		}
+		devices = append(devices, &exclusiveCore)
+	}
+	return devices
+}
 
+// isAdvertisedCore tells if the CPU is the primary thread of a physical core whose threads all belong to the pool
+func (cdm *cpuDeviceManager) isAdvertisedCore(cpuID int) bool {
+	siblings := topology.GetHTSiblings(cpuID, cdm.htTopology)
+	if siblings.IsEmpty() {
+		return true
+	}
+	if _, primary := cdm.htTopology[cpuID]; !primary {
+		return false
+	}
+	if !siblings.IsSubsetOf(cdm.pool.CPUset) {
+		mainLogger.Warn("Physical core is not advertised, because not all of its threads belong to the pool",
+			logger.Any("pool", cdm.poolName), logger.Any("core", cpuID), logger.Any("siblings", siblings.String()))
+		return false
+	}
+	return true
 }
 
 func (cdm *cpuDeviceManager) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
@@ -154,11 +186,13 @@ func (cdm *cpuDeviceManager) Allocate(ctx context.Context, rqt *pluginapi.Alloca
 			tempSet, _ := cpuset.Parse(id)
 			cpusAllocated = cpusAllocated.Union(tempSet)
 		}
-		if cdm.pool.HTPolicy == types.MultiThreadHTPolicy {
+		if cdm.pool.AllocatesHTSiblings() {
 			cpusAllocated = topology.AddHTSiblingsToCPUSet(cpusAllocated, cdm.htTopology)
 		}
+		//the webhook allows one shared pool per container, so SHARED_CPUS is not overwritten by another pool
 		if cdm.poolType == "shared" {
-			envmap["SHARED_CPUS"] = cdm.sharedPoolCPUs
+			cpusAllocated = cdm.pool.CPUset
+			envmap["SHARED_CPUS"] = cpusAllocated.String()
 		} else {
 			envmap["EXCLUSIVE_CPUS"] = cpusAllocated.String()
 		}
@@ -167,6 +201,7 @@ func (cdm *cpuDeviceManager) Allocate(ctx context.Context, rqt *pluginapi.Alloca
 			strconv.Itoa(cpusAllocated.Size()))
 
 		containerResp.Envs = envmap
+		cdm.decorateAllocation(containerResp, container.DevicesIDs, cpusAllocated)
 		resp.ContainerResponses = append(resp.ContainerResponses, containerResp)
 	}
 	return resp, nil
@@ -174,14 +209,16 @@ func (cdm *cpuDeviceManager) Allocate(ctx context.Context, rqt *pluginapi.Alloca
 
 func (cdm *cpuDeviceManager) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	dpOptions := pluginapi.DevicePluginOptions{
-		PreStartRequired:                false,
+		PreStartRequired:                cpusetRoot != "",
 		GetPreferredAllocationAvailable: false,
 	}
 	return &dpOptions, nil
 }
 
 func (cdm *cpuDeviceManager) Register(kubeletEndpoint, resourceName string) error {
-	conn, err := grpc.Dial(kubeletEndpoint, grpc.WithInsecure(),
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, kubeletEndpoint, grpc.WithInsecure(), grpc.WithBlock(), grpc.FailOnNonTempDialError(true),
 		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
 			return net.DialTimeout("unix", addr, timeout)
 		}))
@@ -198,7 +235,7 @@ func (cdm *cpuDeviceManager) Register(kubeletEndpoint, resourceName string) erro
 		ResourceName: resourceName,
 	}
 
-	if _, err = client.Register(context.Background(), request); err != nil {
+	if _, err = client.Register(ctx, request); err != nil {
 		mainLogger.Error("CPU Device Plugin cannot register to Kubelet service", logger.Error(err))
 		return err
 	}
@@ -209,64 +246,71 @@ func (cdm *cpuDeviceManager) GetPreferredAllocation(context.Context, *pluginapi.
 	return &pluginapi.PreferredAllocationResponse{}, nil
 }
 
-func newCPUDeviceManager(poolName string, pool types.Pool, sharedCPUs string) *cpuDeviceManager {
+func newCPUDeviceManager(poolName string, pool types.Pool) *cpuDeviceManager {
 	mainLogger.Info("Starting plugin for pool: " + poolName)
 	return &cpuDeviceManager{
-		pool:           pool,
-		socketFile:     fmt.Sprintf("cpudp_%s.sock", poolName),
-		sharedPoolCPUs: sharedCPUs,
-		poolType:       types.DeterminePoolType(poolName),
-		nodeTopology:   topology.GetNodeTopology(),
-		htTopology:     topology.GetHTTopology(),
+		pool:         pool,
+		poolName:     poolName,
+		socketFile:   fmt.Sprintf("cpudp_%s.sock", poolName),
+		poolType:     types.DeterminePoolType(poolName),
+		nodeTopology: topology.GetNodeTopology(),
+		htTopology:   topology.GetHTTopology(),
 	}
 }
 
-func validatePools(poolConf types.PoolConfig) (string, error) {
-	var sharedCPUs string
-	var err error
-	for poolName, pool := range poolConf.Pools {
-		poolType := types.DeterminePoolType(poolName)
-		if poolType == types.SharedPoolID {
-			if sharedCPUs != "" {
-				err = fmt.Errorf("Only one shared pool allowed")
+// validatePools makes sure that no shared pool overlaps with an exclusive pool of the node
+// Any number of named shared pools is allowed, each of them is advertised as its own resource
+func validatePools(poolConf types.PoolConfig) error {
+	for sharedName, sharedPool := range poolConf.Pools {
+		if types.DeterminePoolType(sharedName) != types.SharedPoolID {
+			continue
+		}
+		for exclusiveName, exclusivePool := range poolConf.Pools {
+			if types.DeterminePoolType(exclusiveName) != types.ExclusivePoolID {
+				continue
+			}
+			if overlap := sharedPool.CPUset.Intersection(exclusivePool.CPUset); !overlap.IsEmpty() {
+				err := fmt.Errorf("shared pool %s overlaps with exclusive pool %s on CPUs %s", sharedName, exclusiveName, overlap.String())
 				mainLogger.Error("Pool config error", logger.Any("poolConf", poolConf), logger.Error(err))
-				break
+				return err
 			}
-			sharedCPUs = pool.CPUset.String()
 		}
 	}
-	return sharedCPUs, err
+	return nil
+}
+
+// validateThreadsPerCore makes sure that the pools allocating the HT siblings give as many CPUs per device as the cores of the node have threads
+// The webhook checks the CPUs of the cpus annotations against the threadsPerCore of the pool configs, not against the nodes
+func validateThreadsPerCore(poolConf types.PoolConfig, htTopology map[int]string) error {
+	for poolName, pool := range poolConf.Pools {
+		if types.DeterminePoolType(poolName) != types.ExclusivePoolID || !pool.AllocatesHTSiblings() {
+			continue
+		}
+		if threads := topology.GetThreadsPerCore(pool.CPUset, htTopology); pool.CPUsPerDevice() != threads {
+			err := fmt.Errorf("pool %s gives %d CPUs per device, but the cores of its CPUs have %d threads, threadsPerCore must be %d",
+				poolName, pool.CPUsPerDevice(), threads, threads)
+			mainLogger.Error("Pool config error", logger.Any("poolConf", poolConf), logger.Error(err))
+			return err
+		}
+	}
+	return nil
 }
 
-func createCDMs(poolConf types.PoolConfig, sharedCPUs string) error {
-	var err error
+func createCDMs(poolConf types.PoolConfig) []*cpuDeviceManager {
+	var cdms []*cpuDeviceManager
 	for poolName, pool := range poolConf.Pools {
 		poolType := types.DeterminePoolType(poolName)
 		//Deault or unrecognizable pools need not be made available to Device Manager as schedulable devices
 		if poolType == types.DefaultPoolID {
 			continue
 		}
-		cdm := newCPUDeviceManager(poolName, pool, sharedCPUs)
-		cdms = append(cdms, cdm)
-		if err := cdm.Start(); err != nil {
-			mainLogger.Error("cpuDeviceManager.Start() failed", logger.Error(err))
-			break
-		}
-		resourceName := resourceBaseName + "/" + poolName
-		err := cdm.Register(path.Join(pluginapi.DevicePluginPath, "kubelet.sock"), resourceName)
-		if err != nil {
-			// Stop server
-			cdm.grpcServer.Stop()
-			mainLogger.Error("Register error", logger.Error(err))
-			break
-		}
-		mainLogger.Info("CPU device plugin registered with the Kubelet")
+		cdms = append(cdms, newCPUDeviceManager(poolName, pool))
 	}
-	return err
+	return cdms
 }
 
-func createPluginsForPools(c kubernetes.Interface) error {
-	files, err := filepath.Glob(filepath.Join(pluginapi.DevicePluginPath, config.FileMatch))
+func createPluginsForPools(c kubernetes.Interface) ([]*cpuDeviceManager, error) {
+	files, err := filepath.Glob(filepath.Join(devicePluginPath, "cpudp_*.sock"))
 	if err != nil {
 		mainLogger.Error("filepath glob error!", logger.Error(err))
 	}
@@ -278,63 +322,72 @@ func createPluginsForPools(c kubernetes.Interface) error {
 	poolConf, err := types.DeterminePoolConfig(c, config.FileMatch, config.NodeName)
 	if err != nil {
 		mainLogger.Error("types.DeterminePoolConfig error!", logger.Error(err))
+		return nil, err
 	}
 	mainLogger.Info("Pool configuration", logger.Any("poolconf", poolConf))
+	poolConfig = poolConf
 
-	var sharedCPUs string
-	sharedCPUs, err = validatePools(poolConf)
-	if err != nil {
-		return err
+	if err = validatePools(poolConf); err != nil {
+		return nil, err
 	}
-
-	if err := createCDMs(poolConf, sharedCPUs); err != nil {
-		for _, cdm := range cdms {
-			cdm.Stop()
-		}
+	if err = validateThreadsPerCore(poolConf, topology.GetHTTopology()); err != nil {
+		return nil, err
 	}
-	return err
+	return createCDMs(poolConf), nil
 }
 
 func main() {
+	flag.StringVar(&cpusetRoot, "cpusetroot", "", "The root of the cgroupfs where Kubernetes creates the cpusets for the Pods, e.g. /sys/fs/cgroup/cpuset/kubepods on cgroup v1, "+
+		"or /sys/fs/cgroup/kubepods.slice on cgroup v2. Optional parameter, when given the cpuset of containers is pre-applied in the PreStartContainer hook.")
+	flag.Func("container-bundle-dirs", "Comma separated directories the container runtime keeps the OCI bundles of the containers in, "+
+		"used to recognize the cgroup of the container in the PreStartContainer hook (default "+strings.Join(containerBundleDirs, ",")+")", func(value string) error {
+		containerBundleDirs = strings.Split(value, ",")
+		return nil
+	})
+	flag.StringVar(&healthAddress, "health-address", "", "Address of the HTTP server exposing the registration state of the pools on /healthz. "+
+		"Optional parameter, the server is not started when empty.")
+	flag.StringVar(&allocationInfoDir, "allocation-info-dir", "", "Host directory the per-allocation JSON files are written to, it must be mounted to the same path into the plugin. "+
+		"Optional parameter, when given the allocation file is mounted into the containers under --allocation-info-mount-dir as <pool name>.json.")
+	flag.StringVar(&allocationInfoMountDir, "allocation-info-mount-dir", allocationInfoMountDir, "Directory the allocation files are mounted to in the containers.")
+	flag.StringVar(&cdiSpecDir, "cdi-spec-dir", "", "Directory the CDI spec files of the allocations are written to, e.g. /var/run/cdi. "+
+		"Optional parameter, when given CDI device references are returned in the container annotations.")
 	flag.Parse()
-	watcher, _ := fsnotify.NewWatcher()
-	watcher.Add(path.Join(pluginapi.DevicePluginPath, "kubelet.sock"))
-	defer watcher.Close()
 
 	// respond to syscalls for termination
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-	_ = client.KubeClient()
-
-	if err := createPluginsForPools(client.Clientset); err != nil {
+	if err := client.KubeClient(); err != nil {
+		mainLogger.Error("Failed to create K8s client", logger.Error(err))
+		os.Exit(1)
+	}
+	cdms, err := createPluginsForPools(client.Clientset)
+	if err != nil {
 		mainLogger.Error("Failed to start device plugin", logger.Error(err))
+		os.Exit(1)
 	}
 
-	/* Monitor file changes for kubelet socket file and termination signals */
-	for {
-		select {
-		case sig := <-sigCh:
-			switch sig {
-			case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT:
-				mainLogger.Info("Received signal, shutting down.", logger.Any("signal", sig))
-				for _, cdm := range cdms {
-					cdm.Stop()
-				}
-				return
-			}
-			mainLogger.Info("Received signal!", logger.Any("signal", sig))
-
-		case event := <-watcher.Events:
-			mainLogger.Info("Kubelet change event in pluginpath ", logger.Any("event", event))
-
-			for _, cdm := range cdms {
-				cdm.Stop()
-			}
-			cdms = nil
-			if err := createPluginsForPools(client.Clientset); err != nil {
-				panic("Failed to restart device plugin")
+	rm := newRegistrationManager(cdms, devicePluginPath, kubeletSocket)
+	if healthAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/healthz", rm.serveHealthz)
+			if err := http.ListenAndServe(healthAddress, mux); err != nil {
+				mainLogger.Error("Health server stopped", logger.Error(err))
 			}
+		}()
+	}
+	stopCh := make(chan struct{})
+	go rm.Run(stopCh)
+
+	for sig := range sigCh {
+		switch sig {
+		case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT:
+			mainLogger.Info("Received signal, shutting down.", logger.Any("signal", sig))
+			close(stopCh)
+			rm.Wait()
+			return
 		}
+		mainLogger.Info("Received signal!", logger.Any("signal", sig))
 	}
 }
@@ -0,0 +1,103 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+func TestValidatePoolsMultipleSharedPools(t *testing.T) {
+	assert := assert.New(t)
+	poolConf := types.PoolConfig{Pools: map[string]types.Pool{
+		"shared-control":  {CPUset: cpuset.NewCPUSet(1)},
+		"shared-batch":    {CPUset: cpuset.NewCPUSet(2, 3)},
+		"exclusive-pool1": {CPUset: cpuset.NewCPUSet(4, 5)},
+		"default":         {CPUset: cpuset.NewCPUSet(0)},
+	}}
+	assert.Nil(validatePools(poolConf))
+
+	poolConf.Pools["shared-overlap"] = types.Pool{CPUset: cpuset.NewCPUSet(5, 6)}
+	assert.NotNil(validatePools(poolConf))
+}
+
+func TestValidateThreadsPerCore(t *testing.T) {
+	assert := assert.New(t)
+	//Cores 2 and 3 have threads 2,6 and 3,7
+	htTopology := map[int]string{2: "6", 3: "7"}
+	poolConf := types.PoolConfig{Pools: map[string]types.Pool{
+		"exclusive-cores":  {CPUset: cpuset.NewCPUSet(2, 3, 6, 7), HTPolicy: types.PhysicalCoreHTPolicy},
+		"exclusive-single": {CPUset: cpuset.NewCPUSet(2, 3)},
+		"shared-pool":      {CPUset: cpuset.NewCPUSet(1)},
+	}}
+	assert.Nil(validateThreadsPerCore(poolConf, htTopology))
+
+	poolConf.Pools["exclusive-cores"] = types.Pool{CPUset: cpuset.NewCPUSet(2, 3, 6, 7), HTPolicy: types.MultiThreadHTPolicy, ThreadsPerCore: 4}
+	assert.EqualError(validateThreadsPerCore(poolConf, htTopology),
+		"pool exclusive-cores gives 4 CPUs per device, but the cores of its CPUs have 2 threads, threadsPerCore must be 2")
+
+	//without HT the default of two threads per core does not hold
+	poolConf.Pools["exclusive-cores"] = types.Pool{CPUset: cpuset.NewCPUSet(2, 3, 6, 7), HTPolicy: types.PhysicalCoreHTPolicy}
+	assert.NotNil(validateThreadsPerCore(poolConf, map[int]string{}))
+	poolConf.Pools["exclusive-cores"] = types.Pool{CPUset: cpuset.NewCPUSet(2, 3, 6, 7), HTPolicy: types.PhysicalCoreHTPolicy, ThreadsPerCore: 1}
+	assert.Nil(validateThreadsPerCore(poolConf, map[int]string{}))
+}
+
+func TestAllocateSharedPoolCPUs(t *testing.T) {
+	assert := assert.New(t)
+	control := &cpuDeviceManager{poolName: "shared-control", poolType: types.SharedPoolID, pool: types.Pool{CPUset: cpuset.NewCPUSet(1)}}
+	batch := &cpuDeviceManager{poolName: "shared-batch", poolType: types.SharedPoolID, pool: types.Pool{CPUset: cpuset.NewCPUSet(2, 3)}}
+	request := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"10", "11"}}}}
+
+	resp, err := control.Allocate(context.Background(), request)
+	assert.Nil(err)
+	assert.Equal("1", resp.ContainerResponses[0].Envs["SHARED_CPUS"])
+
+	resp, err = batch.Allocate(context.Background(), request)
+	assert.Nil(err)
+	assert.Equal("2-3", resp.ContainerResponses[0].Envs["SHARED_CPUS"])
+}
+
+func TestPhysicalCorePoolDevices(t *testing.T) {
+	assert := assert.New(t)
+	//Cores 2 and 3 have threads 2,6 and 3,7; thread 7 is not part of the pool
+	cdm := &cpuDeviceManager{
+		poolName:     "exclusive-cores",
+		poolType:     types.ExclusivePoolID,
+		pool:         types.Pool{CPUset: cpuset.NewCPUSet(2, 3, 6), HTPolicy: types.PhysicalCoreHTPolicy},
+		nodeTopology: map[int]int{2: 0, 3: 0, 6: 0, 7: 0},
+		htTopology:   map[int]string{2: "6", 3: "7"},
+	}
+	devices := cdm.devices()
+	assert.Len(devices, 1)
+	assert.Equal("2", devices[0].ID)
+	assert.Equal(int64(0), devices[0].Topology.Nodes[0].ID)
+
+	request := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"2"}}}}
+	resp, err := cdm.Allocate(context.Background(), request)
+	assert.Nil(err)
+	assert.Equal("2,6", resp.ContainerResponses[0].Envs["EXCLUSIVE_CPUS"])
+
+	cdm.pool.HTPolicy = types.SingleThreadHTPolicy
+	assert.Len(cdm.devices(), 3)
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/checkpoint"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/topology"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+var (
+	//preStartTimeout controls how long we wait for the cgroup of a container to appear after PreStartContainer was invoked
+	preStartTimeout = 10 * time.Second
+	//preStartPollInterval controls how often the Pod cgroup is checked when it cannot be watched, it is rechecked ten times less often next to its events
+	preStartPollInterval = 20 * time.Millisecond
+	//containerBundleDirs are the directories the container runtimes keep the OCI bundles of the containers in, by container ID
+	containerBundleDirs = []string{"/run/containerd/io.containerd.runtime.v2.task/k8s.io", "/run/containers/storage/overlay-containers"}
+
+	errNoCheckpointEntry = errors.New("no kubelet checkpoint entry matches the devices of the PreStartContainer request")
+)
+
+// OCI annotations the container runtimes set on the containers they create for Kubernetes, containerd first and CRI-O second
+var (
+	podUIDAnnotations        = []string{"io.kubernetes.cri.sandbox-uid", "io.kubernetes.pod.uid"}
+	containerNameAnnotations = []string{"io.kubernetes.cri.container-name", "io.kubernetes.container.name"}
+)
+
+// PreStartContainer is invoked by the kubelet right before the container using our devices is created
+// The DeviceIDs are mapped back to the Pod and container owning them via the kubelet checkpoint file.
+// The kubelet creates the container only after the hook returned, so its cgroup cannot be written here: it is watched for in the background,
+// and recognized by the Pod UID and container name annotations of its OCI bundle, so sandboxes and other containers of the Pod are never written.
+// The cpuset is written as soon as the runtime creates the cgroup, which normally precedes the start of the container, but cannot be guaranteed;
+// the cpusets-controller remains responsible for eventually setting the cpuset.
+// An error is returned when the container cannot be identified, so the kubelet retries the container instead of starting it unpinned
+func (cdm *cpuDeviceManager) PreStartContainer(ctx context.Context, psRqt *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	resp := &pluginapi.PreStartContainerResponse{}
+	if cpusetRoot == "" {
+		return resp, nil
+	}
+	cp, err := checkpoint.ReadFile(checkpoint.KubeletCheckpointFile)
+	if err != nil {
+		mainLogger.Error("Cannot read kubelet checkpoint file, cpuset is not pre-applied", logger.Error(err))
+		return nil, fmt.Errorf("cannot read kubelet checkpoint file: %w", err)
+	}
+	entry, err := findCheckpointEntry(cp, cdm.resourceName(), psRqt.DevicesIDs)
+	if err != nil {
+		mainLogger.Error("Cannot map devices to container, cpuset is not pre-applied", logger.Any("devices", psRqt.DevicesIDs), logger.Error(err))
+		return nil, err
+	}
+	cpus := cdm.containerCpuset(cp, entry.PodUID, entry.ContainerName)
+	if cpus.IsEmpty() {
+		return resp, nil
+	}
+	podCgroup := findPodCgroup(cpusetRoot, entry.PodUID)
+	if podCgroup == "" {
+		mainLogger.Error("Pod cgroup does not exist, cpuset is not pre-applied", logger.Any("podUID", entry.PodUID), logger.Any("container", entry.ContainerName))
+		return nil, fmt.Errorf("cgroup of pod %s does not exist under %s", entry.PodUID, cpusetRoot)
+	}
+	go applyCpusetToNewContainerCgroup(podCgroup, listChildCgroups(podCgroup), cpus, entry.PodUID, entry.ContainerName)
+	return resp, nil
+}
+
+func (cdm *cpuDeviceManager) resourceName() string {
+	return resourceBaseName + "/" + cdm.poolName
+}
+
+// findCheckpointEntry returns the checkpoint entry of the given resource holding exactly the requested DeviceIDs
+func findCheckpointEntry(cp checkpoint.File, resourceName string, deviceIDs []string) (checkpoint.PodDevicesEntry, error) {
+	wanted := sortedCopy(deviceIDs)
+	for _, entry := range cp.Data.PodDeviceEntries {
+		if entry.ResourceName != resourceName || len(entry.DeviceIDs) != len(wanted) {
+			continue
+		}
+		if strings.Join(sortedCopy(entry.DeviceIDs), ",") == strings.Join(wanted, ",") {
+			return entry, nil
+		}
+	}
+	return checkpoint.PodDevicesEntry{}, errNoCheckpointEntry
+}
+
+func sortedCopy(list []string) []string {
+	sorted := append([]string(nil), list...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// containerCpuset calculates the cpuset of a container from all the pool resources allocated to it, the same way the cpusets-controller does
+// Containers using more than one pool get the same set from all involved plugins, whichever is invoked last
+func (cdm *cpuDeviceManager) containerCpuset(cp checkpoint.File, podUID, containerName string) cpuset.CPUSet {
+	cpus := cpuset.NewCPUSet()
+	for _, entry := range cp.Data.PodDeviceEntries {
+		if entry.PodUID != podUID || entry.ContainerName != containerName || !strings.HasPrefix(entry.ResourceName, resourceBaseName+"/") {
+			continue
+		}
+		poolName := strings.TrimPrefix(entry.ResourceName, resourceBaseName+"/")
+		pool, exists := poolConfig.Pools[poolName]
+		if !exists {
+			continue
+		}
+		switch types.DeterminePoolType(poolName) {
+		case types.SharedPoolID:
+			cpus = cpus.Union(pool.CPUset)
+		case types.ExclusivePoolID:
+			builder := cpuset.NewBuilder()
+			for _, id := range entry.DeviceIDs {
+				if cpuID, err := strconv.Atoi(id); err == nil {
+					builder.Add(cpuID)
+				}
+			}
+			exclusiveCPUs := builder.Result()
+			if pool.AllocatesHTSiblings() {
+				exclusiveCPUs = topology.AddHTSiblingsToCPUSet(exclusiveCPUs, cdm.htTopology)
+			}
+			cpus = cpus.Union(exclusiveCPUs)
+		}
+	}
+	return cpus
+}
+
+// findPodCgroup returns the cpuset cgroup directory of a Pod. Both the cgroupfs ("pod<UID>") and the systemd ("pod<UID_with_underscores>.slice") drivers are supported
+func findPodCgroup(root, podUID string) string {
+	var podCgroup string
+	names := []string{"pod" + podUID, "pod" + strings.ReplaceAll(podUID, "-", "_")}
+	filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil || !f.IsDir() {
+			return nil
+		}
+		if podCgroup != "" {
+			return filepath.SkipDir
+		}
+		for _, name := range names {
+			if strings.Contains(f.Name(), name) {
+				podCgroup = path
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return podCgroup
+}
+
+func listChildCgroups(parent string) map[string]bool {
+	children := make(map[string]bool)
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		return children
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			children[entry.Name()] = true
+		}
+	}
+	return children
+}
+
+// containerIDFromCgroup returns the ID of the container a cgroup belongs to, given the name of the cgroup directory
+// The cgroupfs driver names the directory after the ID, the systemd driver adds the prefix of the runtime and the .scope suffix
+// Empty string is returned for the cgroups of the runtime monitors
+func containerIDFromCgroup(name string) string {
+	if strings.Contains(name, "conmon") {
+		return ""
+	}
+	name = strings.TrimSuffix(name, ".scope")
+	for _, prefix := range []string{"cri-containerd-", "crio-", "docker-"} {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	return name
+}
+
+// containerAnnotations reads the OCI annotations of a container from its bundle in one of the bundle directories
+func containerAnnotations(bundleDirs []string, containerID string) (map[string]string, error) {
+	var lastErr error = os.ErrNotExist
+	for _, dir := range bundleDirs {
+		for _, configFile := range []string{filepath.Join(dir, containerID, "config.json"), filepath.Join(dir, containerID, "userdata", "config.json")} {
+			content, err := os.ReadFile(configFile)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					lastErr = err
+				}
+				continue
+			}
+			var spec struct {
+				Annotations map[string]string `json:"annotations"`
+			}
+			if err = json.Unmarshal(content, &spec); err != nil {
+				return nil, fmt.Errorf("invalid OCI bundle config %s: %w", configFile, err)
+			}
+			return spec.Annotations, nil
+		}
+	}
+	return nil, lastErr
+}
+
+func firstAnnotation(annotations map[string]string, keys []string) string {
+	for _, key := range keys {
+		if value, exists := annotations[key]; exists {
+			return value
+		}
+	}
+	return ""
+}
+
+// findContainerCgroup returns the cgroup directory of the container among the children of the Pod cgroup not present in the snapshot
+// Empty string is returned when the runtime did not create it yet
+func findContainerCgroup(podCgroup string, snapshot map[string]bool, bundleDirs []string, podUID, containerName string) string {
+	for child := range listChildCgroups(podCgroup) {
+		if snapshot[child] {
+			continue
+		}
+		containerID := containerIDFromCgroup(child)
+		if containerID == "" {
+			continue
+		}
+		annotations, err := containerAnnotations(bundleDirs, containerID)
+		if err != nil {
+			continue
+		}
+		if firstAnnotation(annotations, podUIDAnnotations) == podUID && firstAnnotation(annotations, containerNameAnnotations) == containerName {
+			return filepath.Join(podCgroup, child)
+		}
+	}
+	return ""
+}
+
+// containerCpusetFile returns the cpuset file of a container cgroup, which has the same name on cgroup v1 and v2
+// On cgroup v2 the file only exists when the cpuset controller is enabled for the children of the Pod cgroup
+func containerCpusetFile(containerCgroup string) (string, error) {
+	cpusetFile := filepath.Join(containerCgroup, "cpuset.cpus")
+	if _, err := os.Stat(cpusetFile); err != nil {
+		if _, v2 := os.Stat(filepath.Join(containerCgroup, "cgroup.controllers")); v2 == nil {
+			return "", fmt.Errorf("cpuset controller is not enabled in cgroup v2 hierarchy of %s: %w", containerCgroup, err)
+		}
+		return "", err
+	}
+	return cpusetFile, nil
+}
+
+// applyCpusetToNewContainerCgroup waits for the cgroup of the container to appear under the Pod's cgroup, and writes the cpuset into it
+// New cgroups are noticed from the events of the Pod cgroup, which is polled more often when it cannot be watched
+func applyCpusetToNewContainerCgroup(podCgroup string, snapshot map[string]bool, cpus cpuset.CPUSet, podUID, containerName string) {
+	var events <-chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		if err = watcher.Add(podCgroup); err == nil {
+			events = watcher.Events
+		}
+	}
+	if err != nil {
+		mainLogger.Warn("Cannot watch Pod cgroup, polling it", logger.Any("podCgroup", podCgroup), logger.Error(err))
+	}
+	interval := preStartPollInterval
+	if events != nil {
+		interval *= 10
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(preStartTimeout)
+	defer deadline.Stop()
+	for {
+		if containerCgroup := findContainerCgroup(podCgroup, snapshot, containerBundleDirs, podUID, containerName); containerCgroup != "" {
+			cpusetFile, err := containerCpusetFile(containerCgroup)
+			if err == nil {
+				err = os.WriteFile(cpusetFile, []byte(cpus.String()), 0644)
+			}
+			if err != nil {
+				mainLogger.Warn("Cannot pre-apply cpuset of container", logger.Any("container", containerName), logger.Any("cgroup", containerCgroup), logger.Error(err))
+				return
+			}
+			mainLogger.Info("cpuset pre-applied", logger.Any("container", containerName), logger.Any("cpuset", cpus.String()), logger.Any("file", cpusetFile))
+			return
+		}
+		select {
+		case <-events:
+		case <-ticker.C:
+		case <-deadline.C:
+			mainLogger.Warn("Container cgroup did not appear in time, cpuset is not pre-applied", logger.Any("container", containerName), logger.Any("podCgroup", podCgroup))
+			return
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/checkpoint"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+func testCheckpoint() checkpoint.File {
+	var cp checkpoint.File
+	cp.Data.PodDeviceEntries = []checkpoint.PodDevicesEntry{
+		{PodUID: "uid-1", ContainerName: "c1", ResourceName: "cmss.cn/exclusive-pool1", DeviceIDs: []string{"5", "4"}},
+		{PodUID: "uid-1", ContainerName: "c1", ResourceName: "cmss.cn/shared-pool1", DeviceIDs: []string{"1", "2"}},
+		{PodUID: "uid-2", ContainerName: "c2", ResourceName: "cmss.cn/exclusive-pool1", DeviceIDs: []string{"6"}},
+		{PodUID: "uid-3", ContainerName: "c3", ResourceName: "other.io/gpu", DeviceIDs: []string{"4", "5"}},
+	}
+	return cp
+}
+
+func TestFindCheckpointEntry(t *testing.T) {
+	assert := assert.New(t)
+	entry, err := findCheckpointEntry(testCheckpoint(), "cmss.cn/exclusive-pool1", []string{"4", "5"})
+	assert.Nil(err)
+	assert.Equal("uid-1", entry.PodUID)
+	assert.Equal("c1", entry.ContainerName)
+
+	_, err = findCheckpointEntry(testCheckpoint(), "cmss.cn/exclusive-pool1", []string{"4"})
+	assert.Equal(errNoCheckpointEntry, err)
+}
+
+func TestContainerCpuset(t *testing.T) {
+	assert := assert.New(t)
+	poolConfig = types.PoolConfig{Pools: map[string]types.Pool{
+		"exclusive-pool1": {CPUset: cpuset.NewCPUSet(4, 5, 6), HTPolicy: types.SingleThreadHTPolicy},
+		"shared-pool1":    {CPUset: cpuset.NewCPUSet(1, 2)},
+	}}
+	defer func() { poolConfig = types.PoolConfig{} }()
+	cdm := &cpuDeviceManager{poolName: "exclusive-pool1"}
+
+	assert.Equal("1-2,4-5", cdm.containerCpuset(testCheckpoint(), "uid-1", "c1").String())
+	assert.Equal("6", cdm.containerCpuset(testCheckpoint(), "uid-2", "c2").String())
+	assert.True(cdm.containerCpuset(testCheckpoint(), "uid-3", "c3").IsEmpty())
+}
+
+func TestContainerIDFromCgroup(t *testing.T) {
+	assert.Equal(t, "abc123", containerIDFromCgroup("abc123"))
+	assert.Equal(t, "abc123", containerIDFromCgroup("cri-containerd-abc123.scope"))
+	assert.Equal(t, "abc123", containerIDFromCgroup("crio-abc123.scope"))
+	assert.Equal(t, "abc123", containerIDFromCgroup("docker-abc123.scope"))
+	assert.Equal(t, "", containerIDFromCgroup("crio-conmon-abc123.scope"))
+}
+
+// writeBundle writes the OCI bundle config of a container with the annotations the runtime would set
+func writeBundle(t *testing.T, bundleDir, containerID string, annotations map[string]string) {
+	content, err := json.Marshal(map[string]interface{}{"ociVersion": "1.0.2", "annotations": annotations})
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(filepath.Join(bundleDir, containerID), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(bundleDir, containerID, "config.json"), content, 0644))
+}
+
+func TestFindContainerCgroup(t *testing.T) {
+	assert := assert.New(t)
+	root, bundleDir := t.TempDir(), t.TempDir()
+	podCgroup := filepath.Join(root, "kubepods.slice", "kubepods-pod1234_abcd.slice")
+	for _, child := range []string{"cri-containerd-sandbox.scope", "cri-containerd-other.scope", "cri-containerd-app.scope", "cri-containerd-old.scope"} {
+		assert.Nil(os.MkdirAll(filepath.Join(podCgroup, child), 0755))
+	}
+	writeBundle(t, bundleDir, "sandbox", map[string]string{"io.kubernetes.cri.sandbox-uid": "1234-abcd", "io.kubernetes.cri.container-type": "sandbox"})
+	writeBundle(t, bundleDir, "other", map[string]string{"io.kubernetes.cri.sandbox-uid": "1234-abcd", "io.kubernetes.cri.container-name": "sidecar"})
+	writeBundle(t, bundleDir, "app", map[string]string{"io.kubernetes.cri.sandbox-uid": "1234-abcd", "io.kubernetes.cri.container-name": "app"})
+	writeBundle(t, bundleDir, "old", map[string]string{"io.kubernetes.cri.sandbox-uid": "1234-abcd", "io.kubernetes.cri.container-name": "app"})
+	snapshot := map[string]bool{"cri-containerd-old.scope": true}
+
+	assert.Equal(podCgroup, findPodCgroup(root, "1234-abcd"))
+	assert.Equal(filepath.Join(podCgroup, "cri-containerd-app.scope"), findContainerCgroup(podCgroup, snapshot, []string{bundleDir}, "1234-abcd", "app"))
+	assert.Equal("", findContainerCgroup(podCgroup, snapshot, []string{bundleDir}, "1234-abcd", "missing"))
+	assert.Equal("", findContainerCgroup(podCgroup, snapshot, []string{bundleDir}, "other-pod", "app"))
+
+	//CRI-O keeps the config in the userdata directory of the bundle, with its own annotations
+	crioDir := t.TempDir()
+	assert.Nil(os.MkdirAll(filepath.Join(crioDir, "crio-app", "userdata"), 0755))
+	assert.Nil(os.WriteFile(filepath.Join(crioDir, "crio-app", "userdata", "config.json"),
+		[]byte(`{"annotations": {"io.kubernetes.pod.uid": "5678", "io.kubernetes.container.name": "app"}}`), 0644))
+	assert.Nil(os.MkdirAll(filepath.Join(root, "pod5678", "crio-crio-app.scope"), 0755))
+	assert.Nil(os.MkdirAll(filepath.Join(root, "pod5678", "crio-conmon-crio-app.scope"), 0755))
+	assert.Equal(filepath.Join(root, "pod5678", "crio-crio-app.scope"),
+		findContainerCgroup(filepath.Join(root, "pod5678"), nil, []string{bundleDir, crioDir}, "5678", "app"))
+}
+
+func TestPreApplyCpusetToNewContainerCgroup(t *testing.T) {
+	assert := assert.New(t)
+	root, bundleDir := t.TempDir(), t.TempDir()
+	origDirs := containerBundleDirs
+	containerBundleDirs = []string{bundleDir}
+	defer func() { containerBundleDirs = origDirs }()
+	podCgroup := filepath.Join(root, "kubepods", "burstable", "pod1234-abcd")
+	assert.Nil(os.MkdirAll(filepath.Join(podCgroup, "sandbox"), 0755))
+	writeBundle(t, bundleDir, "sandbox", map[string]string{"io.kubernetes.cri.sandbox-uid": "1234-abcd"})
+	writeBundle(t, bundleDir, "sidecar", map[string]string{"io.kubernetes.cri.sandbox-uid": "1234-abcd", "io.kubernetes.cri.container-name": "c2"})
+	writeBundle(t, bundleDir, "container", map[string]string{"io.kubernetes.cri.sandbox-uid": "1234-abcd", "io.kubernetes.cri.container-name": "c1"})
+
+	snapshot := listChildCgroups(podCgroup)
+	done := make(chan struct{})
+	go func() {
+		applyCpusetToNewContainerCgroup(podCgroup, snapshot, cpuset.NewCPUSet(2, 3), "1234-abcd", "c1")
+		close(done)
+	}()
+	time.Sleep(3 * preStartPollInterval)
+	//another container of the pod appearing at the same time is not written
+	for _, child := range []string{"sidecar", "container"} {
+		assert.Nil(os.MkdirAll(filepath.Join(podCgroup, child), 0755))
+		assert.Nil(os.WriteFile(filepath.Join(podCgroup, child, "cpuset.cpus"), []byte("0-7"), 0644))
+	}
+	<-done
+
+	content, err := os.ReadFile(filepath.Join(podCgroup, "container", "cpuset.cpus"))
+	assert.Nil(err)
+	assert.Equal("2-3", string(content))
+	content, err = os.ReadFile(filepath.Join(podCgroup, "sidecar", "cpuset.cpus"))
+	assert.Nil(err)
+	assert.Equal("0-7", string(content))
+	_, err = os.Stat(filepath.Join(podCgroup, "sandbox", "cpuset.cpus"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestContainerCpusetFile(t *testing.T) {
+	assert := assert.New(t)
+	cgroup := t.TempDir()
+	_, err := containerCpusetFile(cgroup)
+	assert.True(os.IsNotExist(err))
+	assert.Nil(os.WriteFile(filepath.Join(cgroup, "cgroup.controllers"), []byte("cpu memory\n"), 0644))
+	_, err = containerCpusetFile(cgroup)
+	assert.ErrorContains(err, "cpuset controller is not enabled in cgroup v2 hierarchy")
+	assert.Nil(os.WriteFile(filepath.Join(cgroup, "cpuset.cpus"), nil, 0644))
+	cpusetFile, err := containerCpusetFile(cgroup)
+	assert.Nil(err)
+	assert.Equal(filepath.Join(cgroup, "cpuset.cpus"), cpusetFile)
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kubeservice-stack/common/pkg/logger"
+)
+
+const (
+	// InitialRegistrationBackoff is the wait time after the first failed registration attempt of a pool
+	InitialRegistrationBackoff = 500 * time.Millisecond
+	// MaxRegistrationBackoff caps the exponentially growing wait time between two registration attempts
+	MaxRegistrationBackoff = 30 * time.Second
+	// ResyncInterval controls how often the plugin sockets and the kubelet socket are checked, independently of file system events
+	ResyncInterval = 10 * time.Second
+)
+
+// registrationState is the registration status of one pool, as exposed on the health endpoint
+type registrationState struct {
+	Registered     bool      `json:"registered"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"lastError,omitempty"`
+	LastRegistered time.Time `json:"lastRegistered,omitempty"`
+}
+
+type poolRegistration struct {
+	cdm *cpuDeviceManager
+	// lock serializes the server restarts and registration attempts of the pool
+	lock sync.Mutex
+	// generation and state are guarded by the lock of the registrationManager
+	generation int
+	state      registrationState
+}
+
+// registrationManager keeps the plugin server of every pool running and registered to the kubelet.
+// Kubelet restarts are detected from the re-creation of the kubelet socket, and from the deletion of the plugin sockets,
+// which the kubelet wipes when it starts. Every failed attempt is retried with exponential backoff.
+type registrationManager struct {
+	pools          []*poolRegistration
+	pluginDir      string
+	kubeletSocket  string
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	resyncInterval time.Duration
+
+	lock        sync.Mutex
+	kubeletInfo os.FileInfo
+	stopCh      <-chan struct{}
+	retries     sync.WaitGroup
+	done        chan struct{}
+}
+
+func newRegistrationManager(cdms []*cpuDeviceManager, pluginDir, kubeletSocket string) *registrationManager {
+	rm := &registrationManager{
+		pluginDir:      pluginDir,
+		kubeletSocket:  kubeletSocket,
+		initialBackoff: InitialRegistrationBackoff,
+		maxBackoff:     MaxRegistrationBackoff,
+		resyncInterval: ResyncInterval,
+		done:           make(chan struct{}),
+	}
+	for _, cdm := range cdms {
+		rm.pools = append(rm.pools, &poolRegistration{cdm: cdm})
+	}
+	return rm
+}
+
+// Run starts the plugin servers, registers them, and keeps them registered until stopCh is closed.
+// All plugin servers are stopped before Run returns.
+func (rm *registrationManager) Run(stopCh <-chan struct{}) {
+	defer close(rm.done)
+	rm.stopCh = stopCh
+	rm.kubeletInfo, _ = os.Stat(rm.kubeletSocket)
+
+	var events chan fsnotify.Event
+	var watchErrors chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(rm.pluginDir)
+	}
+	if err != nil {
+		mainLogger.Error("Cannot watch the device plugin directory, relying on periodic resync only", logger.Any("dir", rm.pluginDir), logger.Error(err))
+	} else {
+		defer watcher.Close()
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+
+	for _, pr := range rm.pools {
+		rm.ensureRegistered(pr, true)
+	}
+	resync := time.NewTicker(rm.resyncInterval)
+	defer resync.Stop()
+	for {
+		select {
+		case <-stopCh:
+			rm.retries.Wait()
+			for _, pr := range rm.pools {
+				pr.lock.Lock()
+				pr.cdm.Stop()
+				pr.lock.Unlock()
+			}
+			return
+		case event := <-events:
+			rm.handleEvent(event)
+		case err := <-watchErrors:
+			mainLogger.Warn("Device plugin directory watch error", logger.Error(err))
+		case <-resync.C:
+			rm.resync()
+		}
+	}
+}
+
+// Wait blocks until Run returned
+func (rm *registrationManager) Wait() {
+	<-rm.done
+}
+
+func (rm *registrationManager) handleEvent(event fsnotify.Event) {
+	if event.Name == rm.kubeletSocket {
+		if event.Op&fsnotify.Create != 0 {
+			mainLogger.Info("Kubelet socket re-created, re-registering all pools", logger.Any("event", event))
+			rm.kubeletRestarted()
+		}
+		return
+	}
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+		return
+	}
+	for _, pr := range rm.pools {
+		if event.Name != pr.cdm.endpoint() {
+			continue
+		}
+		//Restarting the server removes the socket too: events arriving during an attempt are handled by the attempt itself
+		if !pr.lock.TryLock() {
+			return
+		}
+		deleted := !fileExists(event.Name)
+		pr.lock.Unlock()
+		if deleted {
+			mainLogger.Info("Plugin socket deleted, restarting pool", logger.Any("pool", pr.cdm.poolName), logger.Any("event", event))
+			rm.ensureRegistered(pr, true)
+		}
+	}
+}
+
+// kubeletRestarted re-registers every pool, and restarts the servers whose socket was wiped by the kubelet
+func (rm *registrationManager) kubeletRestarted() {
+	rm.lock.Lock()
+	rm.kubeletInfo, _ = os.Stat(rm.kubeletSocket)
+	rm.lock.Unlock()
+	for _, pr := range rm.pools {
+		rm.ensureRegistered(pr, !fileExists(pr.cdm.endpoint()))
+	}
+}
+
+// resync covers file system events which were missed, or which could not be watched at all
+func (rm *registrationManager) resync() {
+	info, err := os.Stat(rm.kubeletSocket)
+	rm.lock.Lock()
+	kubeletChanged := err == nil && (rm.kubeletInfo == nil || !os.SameFile(rm.kubeletInfo, info))
+	rm.lock.Unlock()
+	if kubeletChanged {
+		mainLogger.Info("Kubelet socket changed since the last check, re-registering all pools")
+		rm.kubeletRestarted()
+		return
+	}
+	for _, pr := range rm.pools {
+		rm.lock.Lock()
+		registered := pr.state.Registered
+		rm.lock.Unlock()
+		//Pools which are not registered already have a retry loop in flight
+		if registered && !fileExists(pr.cdm.endpoint()) {
+			rm.ensureRegistered(pr, true)
+		}
+	}
+}
+
+// ensureRegistered starts a new retry loop for the pool, superseding the one possibly in flight
+func (rm *registrationManager) ensureRegistered(pr *poolRegistration, restartServer bool) {
+	rm.lock.Lock()
+	pr.generation++
+	generation := pr.generation
+	pr.state.Registered = false
+	rm.lock.Unlock()
+
+	rm.retries.Add(1)
+	go func() {
+		defer rm.retries.Done()
+		backoff := rm.initialBackoff
+		for {
+			done, err := rm.attempt(pr, generation, &restartServer)
+			if done {
+				return
+			}
+			mainLogger.Warn("Pool registration failed, retrying", logger.Any("pool", pr.cdm.poolName), logger.Any("backoff", backoff.String()), logger.Error(err))
+			select {
+			case <-rm.stopCh:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > rm.maxBackoff {
+				backoff = rm.maxBackoff
+			}
+		}
+	}()
+}
+
+// attempt (re)starts the server of the pool if needed, and registers it to the kubelet
+// Returns true when the retry loop of the given generation can stop
+func (rm *registrationManager) attempt(pr *poolRegistration, generation int, restartServer *bool) (bool, error) {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	if !rm.isCurrent(pr, generation) {
+		return true, nil
+	}
+	if *restartServer || pr.cdm.grpcServer == nil {
+		pr.cdm.Stop()
+		if err := pr.cdm.Start(); err != nil {
+			rm.recordAttempt(pr, generation, err)
+			return false, err
+		}
+		*restartServer = false
+	}
+	err := pr.cdm.Register(rm.kubeletSocket, pr.cdm.resourceName())
+	rm.recordAttempt(pr, generation, err)
+	if err == nil {
+		mainLogger.Info("CPU device plugin registered with the Kubelet", logger.Any("pool", pr.cdm.poolName))
+	}
+	return err == nil, err
+}
+
+func (rm *registrationManager) isCurrent(pr *poolRegistration, generation int) bool {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	return pr.generation == generation
+}
+
+func (rm *registrationManager) recordAttempt(pr *poolRegistration, generation int, err error) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	if pr.generation != generation {
+		return
+	}
+	pr.state.Attempts++
+	if err != nil {
+		pr.state.Registered = false
+		pr.state.LastError = err.Error()
+		return
+	}
+	pr.state.Registered = true
+	pr.state.LastError = ""
+	pr.state.LastRegistered = time.Now()
+}
+
+// States returns the registration state of every pool
+func (rm *registrationManager) States() map[string]registrationState {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	states := make(map[string]registrationState, len(rm.pools))
+	for _, pr := range rm.pools {
+		states[pr.cdm.poolName] = pr.state
+	}
+	return states
+}
+
+// Healthy tells if every pool is registered to the kubelet
+func (rm *registrationManager) Healthy() bool {
+	for _, state := range rm.States() {
+		if !state.Registered {
+			return false
+		}
+	}
+	return true
+}
+
+func (rm *registrationManager) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	states := rm.States()
+	w.Header().Set("Content-Type", "application/json")
+	if !rm.Healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(states); err != nil {
+		mainLogger.Error("response write error", logger.Error(err))
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+// fakeKubelet implements the kubelet side of the device plugin Registration service
+type fakeKubelet struct {
+	server   *grpc.Server
+	requests chan *pluginapi.RegisterRequest
+}
+
+func (f *fakeKubelet) Register(ctx context.Context, r *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	f.requests <- r
+	return &pluginapi.Empty{}, nil
+}
+
+type RegistrationTestSuit struct {
+	suite.Suite
+	pluginDir     string
+	kubeletSocket string
+	origPluginDir string
+	kubelet       *fakeKubelet
+	rm            *registrationManager
+	stopCh        chan struct{}
+}
+
+func (s *RegistrationTestSuit) SetupTest() {
+	var err error
+	//Unix socket paths are limited in length, t.TempDir() can be too long
+	s.pluginDir, err = os.MkdirTemp("", "cpudp")
+	s.Nil(err)
+	s.kubeletSocket = filepath.Join(s.pluginDir, "kubelet.sock")
+	s.origPluginDir = devicePluginPath
+	devicePluginPath = s.pluginDir
+
+	cdm := &cpuDeviceManager{
+		poolName:   "exclusive-pool1",
+		socketFile: "cpudp_exclusive-pool1.sock",
+		poolType:   types.ExclusivePoolID,
+		pool:       types.Pool{CPUset: cpuset.NewCPUSet(1)},
+	}
+	s.rm = newRegistrationManager([]*cpuDeviceManager{cdm}, s.pluginDir, s.kubeletSocket)
+	s.rm.initialBackoff = 10 * time.Millisecond
+	s.rm.maxBackoff = 50 * time.Millisecond
+	s.rm.resyncInterval = 100 * time.Millisecond
+	s.stopCh = make(chan struct{})
+}
+
+func (s *RegistrationTestSuit) TearDownTest() {
+	close(s.stopCh)
+	s.rm.Wait()
+	s.stopKubelet()
+	devicePluginPath = s.origPluginDir
+	os.RemoveAll(s.pluginDir)
+}
+
+func (s *RegistrationTestSuit) startKubelet() {
+	lis, err := net.Listen("unix", s.kubeletSocket)
+	s.Require().Nil(err)
+	s.kubelet = &fakeKubelet{server: grpc.NewServer(), requests: make(chan *pluginapi.RegisterRequest, 10)}
+	pluginapi.RegisterRegistrationServer(s.kubelet.server, s.kubelet)
+	go s.kubelet.server.Serve(lis)
+}
+
+func (s *RegistrationTestSuit) stopKubelet() {
+	if s.kubelet != nil {
+		s.kubelet.server.Stop()
+		os.Remove(s.kubeletSocket)
+		s.kubelet = nil
+	}
+}
+
+func (s *RegistrationTestSuit) expectRegistration() {
+	select {
+	case r := <-s.kubelet.requests:
+		s.Equal("cmss.cn/exclusive-pool1", r.ResourceName)
+		s.Equal("cpudp_exclusive-pool1.sock", r.Endpoint)
+		s.Equal(pluginapi.Version, r.Version)
+	case <-time.After(5 * time.Second):
+		s.FailNow("plugin did not register to the kubelet")
+	}
+	s.Eventually(s.rm.Healthy, 2*time.Second, 10*time.Millisecond)
+	s.FileExists(filepath.Join(s.pluginDir, "cpudp_exclusive-pool1.sock"))
+}
+
+func (s *RegistrationTestSuit) TestRegistersWhenKubeletComesUpLate() {
+	go s.rm.Run(s.stopCh)
+	s.Eventually(func() bool { return s.rm.States()["exclusive-pool1"].Attempts > 1 }, 5*time.Second, 10*time.Millisecond)
+	s.False(s.rm.Healthy())
+	s.NotEmpty(s.rm.States()["exclusive-pool1"].LastError)
+
+	s.startKubelet()
+	s.expectRegistration()
+}
+
+func (s *RegistrationTestSuit) TestReRegistersAfterKubeletRestart() {
+	s.startKubelet()
+	go s.rm.Run(s.stopCh)
+	s.expectRegistration()
+
+	//A restarting kubelet wipes the plugin sockets, then re-creates its own socket
+	s.stopKubelet()
+	s.Nil(os.Remove(filepath.Join(s.pluginDir, "cpudp_exclusive-pool1.sock")))
+	s.startKubelet()
+	s.expectRegistration()
+}
+
+func (s *RegistrationTestSuit) TestReRegistersAfterPluginSocketDeleted() {
+	s.startKubelet()
+	go s.rm.Run(s.stopCh)
+	s.expectRegistration()
+
+	s.Nil(os.Remove(filepath.Join(s.pluginDir, "cpudp_exclusive-pool1.sock")))
+	s.expectRegistration()
+}
+
+func (s *RegistrationTestSuit) TestHealthz() {
+	go s.rm.Run(s.stopCh)
+	recorder := httptest.NewRecorder()
+	s.rm.serveHealthz(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	s.Equal(http.StatusServiceUnavailable, recorder.Code)
+
+	s.startKubelet()
+	s.expectRegistration()
+	recorder = httptest.NewRecorder()
+	s.rm.serveHealthz(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	s.Equal(http.StatusOK, recorder.Code)
+	s.Contains(recorder.Body.String(), `"exclusive-pool1":{"registered":true`)
+}
+
+func TestRegistrationTestSuite(t *testing.T) {
+	suite.Run(t, new(RegistrationTestSuit))
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+)
+
+// podInfoAnnotationsFile is where the downward API volume mounted by the webhook exposes the annotations of the pod
+const podInfoAnnotationsFile = "/etc/podinfo/annotations"
+
+// annotationPublicKey is the base64 ed25519 public key the cpus annotations are verified with, set at build time with
+// -ldflags "-X main.annotationPublicKey=<key>"
+// It is never taken from the pod or from files next to the binary: the author of the pod could give a key of their own along with the annotation
+var annotationPublicKey string
+
+func annotationNameFromConfig() string {
+	return resourceBaseName + "/cpus"
+}
+
+// cpusSignatureAnnotationName is the annotation holding the signature the webhook gave the cpus annotation
+func cpusSignatureAnnotationName() string {
+	return annotationNameFromConfig() + "-signature"
+}
+
+// parsePodAnnotations parses the annotations file of the downward API
+// Every line holds one annotation as key="value", the value quoted like a Go string
+func parsePodAnnotations(r io.Reader) (map[string]string, error) {
+	annotations := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		key, quoted, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid annotation line %q", line)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of annotation %s: %w", key, err)
+		}
+		annotations[key] = value
+	}
+	return annotations, scanner.Err()
+}
+
+// readPodAnnotations reads the annotations of the pod from the downward API file
+func readPodAnnotations(fileName string) (map[string]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parsePodAnnotations(file)
+}
+
+// containerProcesses returns the processes the cpus annotation defines for the container, nil when it defines none
+// When the process starter has a public key, the annotation has to carry the signature the webhook made in the namespace of the pod,
+// so unsigned annotations and processes added to the annotation after admission are never started
+// Without public key the annotation is refused when the webhook signs the annotations, or when it is signed: it cannot be verified
+func containerProcesses(annotations map[string]string, containerName, publicKey, namespace string, signatureRequired bool) ([]types.Process, error) {
+	value, exists := annotations[annotationNameFromConfig()]
+	if !exists {
+		return nil, nil
+	}
+	signature, signed := annotations[cpusSignatureAnnotationName()]
+	if publicKey == "" && (signatureRequired || signed) {
+		return nil, types.ErrNoAnnotationPublicKey
+	}
+	if publicKey != "" {
+		if err := types.VerifyCPUAnnotation(publicKey, namespace, value, signature); err != nil {
+			return nil, err
+		}
+	}
+	cpuAnnotation := types.NewCPUAnnotation()
+	if err := cpuAnnotation.Decode([]byte(value)); err != nil {
+		return nil, err
+	}
+	return cpuAnnotation[containerName].Processes, nil
+}
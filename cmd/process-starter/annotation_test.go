@@ -0,0 +1,132 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+)
+
+const testAnnotation = `[{"container": "app", "processes": [
+	{"process": "/bin/first", "args": ["-c", "say \"hi\""], "cpus": 1, "pool": "exclusive-pool1"},
+	{"process": "/bin/second", "cpus": 100, "pool": "shared-pool1"}]},
+	{"container": "sidecar", "processes": [{"process": "/bin/sidecar", "cpus": 1, "pool": "exclusive-pool1"}]}]`
+
+// annotationsFile formats the annotations the way the kubelet writes them into a downward API volume
+func annotationsFile(annotations map[string]string) string {
+	var lines []string
+	for key, value := range annotations {
+		lines = append(lines, fmt.Sprintf("%s=%s", key, strconv.Quote(value)))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestParsePodAnnotations(t *testing.T) {
+	assert := assert.New(t)
+	expected := map[string]string{
+		"cmss.cn/cpus":           testAnnotation,
+		"nokia.k8s.io/cpus":      "[]",
+		"kubernetes.io/config":   "multi\nline",
+		"cmss.cn/cpus-signature": "c2ln",
+	}
+	fileName := filepath.Join(t.TempDir(), "annotations")
+	assert.Nil(os.WriteFile(fileName, []byte(annotationsFile(expected)), 0644))
+	annotations, err := readPodAnnotations(fileName)
+	assert.Nil(err)
+	assert.Equal(expected, annotations)
+
+	_, err = parsePodAnnotations(strings.NewReader("cmss.cn/cpus=[not quoted]\n"))
+	assert.NotNil(err)
+	_, err = parsePodAnnotations(strings.NewReader("no separator\n"))
+	assert.NotNil(err)
+	_, err = readPodAnnotations(filepath.Join(t.TempDir(), "missing"))
+	assert.NotNil(err)
+}
+
+func TestContainerProcesses(t *testing.T) {
+	assert := assert.New(t)
+	annotations := map[string]string{"cmss.cn/cpus": testAnnotation, "nokia.k8s.io/cpus": `[{"container": "other"}]`}
+	processes, err := containerProcesses(annotations, "app", "", "", false)
+	assert.Nil(err)
+	assert.Len(processes, 2)
+	assert.Equal("/bin/first", processes[0].ProcName)
+	assert.Equal([]string{"-c", `say "hi"`}, processes[0].Args)
+	assert.Equal("shared-pool1", processes[1].PoolName)
+
+	processes, err = containerProcesses(annotations, "unknown", "", "", false)
+	assert.Nil(err)
+	assert.Nil(processes)
+	processes, err = containerProcesses(map[string]string{}, "app", "", "", false)
+	assert.Nil(err)
+	assert.Nil(processes)
+
+	_, err = containerProcesses(map[string]string{"cmss.cn/cpus": `[{"container": "app"}]`}, "app", "", "", false)
+	assert.ErrorIs(err, types.ErrNoProcesses)
+}
+
+func TestContainerProcessesVerifiesSignature(t *testing.T) {
+	assert := assert.New(t)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(err)
+	publicKey := types.EncodePublicKey(public)
+	annotations := map[string]string{
+		"cmss.cn/cpus":           testAnnotation,
+		"cmss.cn/cpus-signature": types.SignCPUAnnotation(private, "telco", testAnnotation),
+	}
+	processes, err := containerProcesses(annotations, "app", publicKey, "telco", false)
+	assert.Nil(err)
+	assert.Len(processes, 2)
+
+	_, err = containerProcesses(annotations, "app", publicKey, "other", false)
+	assert.Equal(types.ErrInvalidAnnotationSignature, err)
+	annotations["cmss.cn/cpus"] = strings.Replace(testAnnotation, "/bin/second", "/bin/evil", 1)
+	_, err = containerProcesses(annotations, "app", publicKey, "telco", false)
+	assert.Equal(types.ErrInvalidAnnotationSignature, err)
+	delete(annotations, "cmss.cn/cpus-signature")
+	_, err = containerProcesses(annotations, "app", publicKey, "telco", false)
+	assert.Equal(types.ErrNoAnnotationSignature, err)
+}
+
+func TestContainerProcessesFailsClosedWithoutPublicKey(t *testing.T) {
+	assert := assert.New(t)
+	annotations := map[string]string{"cmss.cn/cpus": testAnnotation}
+	processes, err := containerProcesses(annotations, "app", "", "telco", false)
+	assert.Nil(err)
+	assert.Len(processes, 2)
+
+	//the webhook signs the annotations, but the process starter cannot verify them
+	_, err = containerProcesses(annotations, "app", "", "telco", true)
+	assert.Equal(types.ErrNoAnnotationPublicKey, err)
+	annotations["cmss.cn/cpus-signature"] = "c2lnbmF0dXJl"
+	_, err = containerProcesses(annotations, "app", "", "telco", false)
+	assert.Equal(types.ErrNoAnnotationPublicKey, err)
+
+	//without annotation there is nothing to verify
+	processes, err = containerProcesses(map[string]string{}, "app", "", "telco", true)
+	assert.Nil(err)
+	assert.Nil(processes)
+}
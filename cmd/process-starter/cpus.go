@@ -0,0 +1,101 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"golang.org/x/sys/unix"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+// allocatedCPUs returns the exclusive and shared CPUs the device plugin allocated to the container, as given in its environment
+func allocatedCPUs(getenv func(string) string) (exclusive, shared cpuset.CPUSet, err error) {
+	pools := getenv("CPU_POOLS")
+	if strings.Contains(pools, types.ExclusivePoolID) {
+		if exclusive, err = cpuset.Parse(getenv("EXCLUSIVE_CPUS")); err != nil {
+			return exclusive, shared, fmt.Errorf("cannot parse EXCLUSIVE_CPUS: %w", err)
+		}
+		if exclusive.IsEmpty() {
+			return exclusive, shared, errors.New("EXCLUSIVE_CPUS is empty, but the container uses an exclusive pool")
+		}
+	}
+	if strings.Contains(pools, types.SharedPoolID) {
+		if shared, err = cpuset.Parse(getenv("SHARED_CPUS")); err != nil {
+			return exclusive, shared, fmt.Errorf("cannot parse SHARED_CPUS: %w", err)
+		}
+		if shared.IsEmpty() {
+			return exclusive, shared, errors.New("SHARED_CPUS is empty, but the container uses a shared pool")
+		}
+	}
+	return exclusive, shared, nil
+}
+
+// assignCPUs returns the CPUs every process is pinned to
+// Processes of an exclusive pool get CPUs of their own from the exclusive CPUs of the container,
+// the ones picked by their cpuIndices, or else the next ones in ascending order not picked by any process
+// Processes of other pools share all the shared CPUs, and keep the cpuset of the container when there are none
+func assignCPUs(processes []types.Process, exclusiveCPUs, sharedCPUs []int) ([][]int, error) {
+	picked := make(map[int]bool)
+	for _, process := range processes {
+		for _, index := range process.CPUIndices {
+			if index >= len(exclusiveCPUs) {
+				return nil, fmt.Errorf("process %s picks CPU %d, but the container has only %d exclusive CPUs", process.ProcName, index, len(exclusiveCPUs))
+			}
+			picked[index] = true
+		}
+	}
+	assigned := make([][]int, len(processes))
+	next := 0
+	for i, process := range processes {
+		if types.DeterminePoolType(process.PoolName) != types.ExclusivePoolID {
+			if len(sharedCPUs) > 0 {
+				assigned[i] = sharedCPUs
+			}
+			continue
+		}
+		if len(process.CPUIndices) > 0 {
+			for _, index := range process.CPUIndices {
+				assigned[i] = append(assigned[i], exclusiveCPUs[index])
+			}
+			continue
+		}
+		for len(assigned[i]) < process.CPUs {
+			for next < len(exclusiveCPUs) && picked[next] {
+				next++
+			}
+			if next == len(exclusiveCPUs) {
+				return nil, fmt.Errorf("not enough exclusive CPUs for process %s, %d are allocated to the container", process.ProcName, len(exclusiveCPUs))
+			}
+			assigned[i] = append(assigned[i], exclusiveCPUs[next])
+			next++
+		}
+	}
+	return assigned, nil
+}
+
+// setAffinity pins the calling thread, and so the processes it starts, to the CPUs
+func setAffinity(cpus []int) error {
+	set := new(unix.CPUSet)
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, set)
+}
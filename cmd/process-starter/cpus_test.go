@@ -0,0 +1,95 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+)
+
+func TestAllocatedCPUs(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		exclusive string
+		shared    string
+		err       bool
+	}{
+		{"exclusive and shared", map[string]string{"CPU_POOLS": "exclusive&shared", "EXCLUSIVE_CPUS": "4-5", "SHARED_CPUS": "1"}, "4-5", "1", false},
+		{"exclusive", map[string]string{"CPU_POOLS": "exclusive", "EXCLUSIVE_CPUS": "2,6", "SHARED_CPUS": "1"}, "2,6", "", false},
+		{"shared", map[string]string{"CPU_POOLS": "shared", "SHARED_CPUS": "0-1"}, "", "0-1", false},
+		{"default", map[string]string{"CPU_POOLS": "default"}, "", "", false},
+		{"missing exclusive CPUs", map[string]string{"CPU_POOLS": "exclusive"}, "", "", true},
+		{"invalid shared CPUs", map[string]string{"CPU_POOLS": "shared", "SHARED_CPUS": "x"}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exclusive, shared, err := allocatedCPUs(func(name string) string { return tt.env[name] })
+			if tt.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.exclusive, exclusive.String())
+			assert.Equal(t, tt.shared, shared.String())
+		})
+	}
+}
+
+func TestAssignCPUs(t *testing.T) {
+	assert := assert.New(t)
+	exclusiveCPUs, sharedCPUs := []int{2, 3, 4, 5}, []int{0, 1}
+	processes := []types.Process{
+		{ProcName: "a", CPUs: 2, PoolName: "exclusive-pool1"},
+		{ProcName: "b", CPUs: 100, PoolName: "shared-pool1"},
+		{ProcName: "c", CPUs: 1, PoolName: "exclusive-pool1"},
+		{ProcName: "d", CPUs: 100, PoolName: "default"},
+	}
+	assigned, err := assignCPUs(processes, exclusiveCPUs, sharedCPUs)
+	assert.Nil(err)
+	assert.Equal([][]int{{2, 3}, {0, 1}, {4}, {0, 1}}, assigned)
+
+	assigned, err = assignCPUs(processes[:1], exclusiveCPUs, nil)
+	assert.Nil(err)
+	assert.Equal([][]int{{2, 3}}, assigned)
+	assigned, err = assignCPUs(processes[3:], nil, nil)
+	assert.Nil(err)
+	assert.Equal([][]int{nil}, assigned)
+
+	_, err = assignCPUs(append(processes, types.Process{ProcName: "e", CPUs: 2, PoolName: "exclusive-pool1"}), exclusiveCPUs, sharedCPUs)
+	assert.EqualError(err, "not enough exclusive CPUs for process e, 4 are allocated to the container")
+}
+
+func TestAssignCPUsWithIndices(t *testing.T) {
+	assert := assert.New(t)
+	exclusiveCPUs := []int{2, 3, 4, 5}
+	processes := []types.Process{
+		{ProcName: "a", CPUs: 2, PoolName: "exclusive-pool1"},
+		{ProcName: "b", CPUs: 1, PoolName: "exclusive-pool1", CPUIndices: []int{0}},
+		{ProcName: "c", CPUs: 1, PoolName: "exclusive-pool1", CPUIndices: []int{3}},
+	}
+	assigned, err := assignCPUs(processes, exclusiveCPUs, nil)
+	assert.Nil(err)
+	assert.Equal([][]int{{3, 4}, {2}, {5}}, assigned)
+
+	processes[2].CPUIndices = []int{4}
+	_, err = assignCPUs(processes, exclusiveCPUs, nil)
+	assert.EqualError(err, "process c picks CPU 4, but the container has only 4 exclusive CPUs")
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	resourceBaseName = "cmss.cn"
+	mainLogger       = logger.GetLogger("cmd/process-starter", "main")
+	// version is the version of the process starter, set at build time with -ldflags "-X main.version=<version>"
+	version = "latest"
+)
+
+// The process starter is the entrypoint the webhook gives the pinned containers
+// It waits until the controller applied the cpuset of the container, then starts the processes of the cpus annotation pinned to their CPUs,
+// or the original command of the container, given as its arguments, when the annotation defines no processes for the container
+// It stays the parent of the processes and supervises them until the container stops
+func main() {
+	// affinities are set on the thread starting the processes, so the goroutine has to stay on it
+	runtime.LockOSThread()
+
+	containerName := os.Getenv("CONTAINER_NAME")
+	mainLogger.Info("Process starter started", logger.Any("version", version), logger.Any("container", containerName))
+	if containerName == "" {
+		mainLogger.Error("CONTAINER_NAME environment variable not found")
+		os.Exit(1)
+	}
+	annotations, err := readPodAnnotations(podInfoAnnotationsFile)
+	if err != nil {
+		mainLogger.Error("Cannot read the pod annotations", logger.Any("file", podInfoAnnotationsFile), logger.Error(err))
+		os.Exit(1)
+	}
+	signatureRequired := os.Getenv(types.AnnotationSignatureRequiredEnv) == "true"
+	processes, err := containerProcesses(annotations, containerName, annotationPublicKey, os.Getenv(types.PodNamespaceEnv), signatureRequired)
+	if err != nil {
+		mainLogger.Error("Cannot read the cpus annotation", logger.Any("container", containerName), logger.Error(err))
+		os.Exit(1)
+	}
+	exclusiveCPUs, sharedCPUs, err := allocatedCPUs(os.Getenv)
+	if err != nil {
+		mainLogger.Error("Cannot read the allocated CPUs", logger.Error(err))
+		os.Exit(1)
+	}
+	containerCPUs := exclusiveCPUs.Union(sharedCPUs)
+	if err = waitForCPUSetReadiness(os.Getenv, containerCPUs); err != nil {
+		mainLogger.Error("Cpuset of the container is not applied", logger.Error(err))
+		os.Exit(1)
+	}
+
+	var cpus [][]int
+	if len(processes) == 0 {
+		if len(os.Args) < 2 {
+			mainLogger.Error("No processes in the cpus annotation, and no command given")
+			os.Exit(1)
+		}
+		mainLogger.Info("No processes in the cpus annotation, starting the command of the container", logger.Any("command", os.Args[1:]))
+		processes = []types.Process{{ProcName: os.Args[1], Args: os.Args[2:]}}
+		cpus = [][]int{nil}
+	} else if cpus, err = assignCPUs(processes, exclusiveCPUs.ToSlice(), sharedCPUs.ToSlice()); err != nil {
+		mainLogger.Error("Cannot assign the CPUs of the processes", logger.Error(err))
+		os.Exit(1)
+	}
+	for i := range cpus {
+		if cpus[i] == nil {
+			cpus[i] = containerCPUs.ToSlice()
+		}
+	}
+
+	// orphans of the processes are reparented to the process starter even when it is not the first process of the pod, so it can reap them
+	if err = unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		mainLogger.Warn("Cannot become the subreaper of the processes", logger.Error(err))
+	}
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, syscall.SIGCHLD, syscall.SIGTERM, syscall.SIGINT)
+	os.Exit(newSupervisor(processes, cpus).run(signals))
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unsafe"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// schedPolicies maps the scheduling policies of the annotation to the ones of the kernel
+var schedPolicies = map[string]int{
+	types.SchedPolicyOther: 0,
+	types.SchedPolicyFIFO:  1,
+	types.SchedPolicyRR:    2,
+	types.SchedPolicyBatch: 3,
+	types.SchedPolicyIdle:  5,
+}
+
+// processEnv returns the environment of the process, the one of the container with the variables of the process on top
+func processEnv(environ []string, env []types.EnvVar) []string {
+	if len(env) == 0 {
+		return environ
+	}
+	overridden := make(map[string]bool)
+	for _, e := range env {
+		overridden[e.Name] = true
+	}
+	merged := make([]string, 0, len(environ)+len(env))
+	for _, e := range environ {
+		name, _, _ := strings.Cut(e, "=")
+		if !overridden[name] {
+			merged = append(merged, e)
+		}
+	}
+	for _, e := range env {
+		merged = append(merged, e.Name+"="+e.Value)
+	}
+	return merged
+}
+
+// threadScheduling is the scheduling policy, the priority and the nice value of a thread
+type threadScheduling struct {
+	policy   int
+	priority int32
+	nice     int
+}
+
+// getThreadScheduling returns the scheduling of the calling thread
+func getThreadScheduling() (threadScheduling, error) {
+	policy, _, errno := unix.RawSyscall(unix.SYS_SCHED_GETSCHEDULER, 0, 0, 0)
+	if errno != 0 {
+		return threadScheduling{}, errno
+	}
+	param := struct{ priority int32 }{}
+	if _, _, errno = unix.RawSyscall(unix.SYS_SCHED_GETPARAM, 0, uintptr(unsafe.Pointer(&param)), 0); errno != 0 {
+		return threadScheduling{}, errno
+	}
+	//the kernel returns 20 - nice to keep the value positive
+	prio, err := unix.Getpriority(unix.PRIO_PROCESS, 0)
+	if err != nil {
+		return threadScheduling{}, err
+	}
+	return threadScheduling{policy: int(policy), priority: param.priority, nice: 20 - prio}, nil
+}
+
+// setThreadScheduling applies the scheduling to the calling thread
+func setThreadScheduling(scheduling threadScheduling) error {
+	param := struct{ priority int32 }{priority: scheduling.priority}
+	if _, _, errno := unix.RawSyscall(unix.SYS_SCHED_SETSCHEDULER, 0, uintptr(scheduling.policy), uintptr(unsafe.Pointer(&param))); errno != 0 {
+		return errno
+	}
+	return unix.Setpriority(unix.PRIO_PROCESS, 0, scheduling.nice)
+}
+
+// setScheduling applies the scheduling policy and the nice value of the process to the calling thread, the process inherits them when it is started from there
+func setScheduling(process types.Process) error {
+	if process.SchedPolicy != "" {
+		param := struct{ priority int32 }{priority: int32(process.SchedPriority)}
+		_, _, errno := unix.RawSyscall(unix.SYS_SCHED_SETSCHEDULER, 0, uintptr(schedPolicies[process.SchedPolicy]), uintptr(unsafe.Pointer(&param)))
+		if errno != 0 {
+			return fmt.Errorf("cannot set %s scheduling policy of process %s: %w", process.SchedPolicy, process.ProcName, errno)
+		}
+	}
+	if process.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, process.Nice); err != nil {
+			return fmt.Errorf("cannot set nice value of process %s: %w", process.ProcName, err)
+		}
+	}
+	return nil
+}
+
+// startProcess starts the process in the background, pinned to the CPUs, and returns its pid
+// The affinity and the scheduling are set on the locked thread of the process starter before the process is forked from it,
+// so every thread of the process has them from the start. The scheduling of the thread is restored afterwards,
+// the process is killed when that fails, as the next processes and the supervisor would run with it
+// The process is waited for by the supervisor, so its handle is released
+func startProcess(process types.Process, cpus []int) (int, error) {
+	if len(cpus) > 0 {
+		if err := setAffinity(cpus); err != nil {
+			return 0, fmt.Errorf("cannot set affinity of process %s: %w", process.ProcName, err)
+		}
+	}
+	scheduled := process.SchedPolicy != "" || process.Nice != 0
+	var saved threadScheduling
+	if scheduled {
+		var err error
+		if saved, err = getThreadScheduling(); err != nil {
+			return 0, fmt.Errorf("cannot read the scheduling of the process starter: %w", err)
+		}
+		if err = setScheduling(process); err != nil {
+			_ = setThreadScheduling(saved)
+			return 0, err
+		}
+	}
+	cmd := exec.Command(process.ProcName, process.Args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = processEnv(os.Environ(), process.Env)
+	cmd.Dir = process.WorkingDir
+	startErr := cmd.Start()
+	if scheduled {
+		if err := setThreadScheduling(saved); err != nil {
+			if startErr == nil {
+				_ = cmd.Process.Kill()
+			}
+			return 0, fmt.Errorf("cannot restore the scheduling of the process starter after starting process %s: %w", process.ProcName, err)
+		}
+	}
+	if startErr != nil {
+		return 0, startErr
+	}
+	pid := cmd.Process.Pid
+	_ = cmd.Process.Release()
+	return pid, nil
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+)
+
+func TestProcessEnv(t *testing.T) {
+	environ := []string{"PATH=/bin", "CONTAINER_NAME=app", "EMPTY="}
+	assert.Equal(t, environ, processEnv(environ, nil))
+	assert.Equal(t, []string{"PATH=/bin", "EMPTY=", "CONTAINER_NAME=worker", "LEVEL=a=b"},
+		processEnv(environ, []types.EnvVar{{Name: "CONTAINER_NAME", Value: "worker"}, {Name: "LEVEL", Value: "a=b"}}))
+}
+
+func TestStartProcessSetsSchedulingBeforeStart(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("restoring the nice value of the thread needs CAP_SYS_NICE")
+	}
+	assert := assert.New(t)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	saved, err := getThreadScheduling()
+	assert.Nil(err)
+
+	pid, err := startProcess(types.Process{ProcName: "/bin/sleep", Args: []string{"0.2"}, Nice: saved.nice + 5}, nil)
+	assert.Nil(err)
+	nice, err := unix.Getpriority(unix.PRIO_PROCESS, pid)
+	assert.Nil(err)
+	assert.Equal(saved.nice+5, 20-nice)
+	var status unix.WaitStatus
+	_, err = unix.Wait4(pid, &status, 0, nil)
+	assert.Nil(err)
+
+	//the process starter gets its own scheduling back
+	restored, err := getThreadScheduling()
+	assert.Nil(err)
+	assert.Equal(saved, restored)
+}
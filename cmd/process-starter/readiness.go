@@ -0,0 +1,184 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+const (
+	// cgroupRoot is where the cgroups of the container are mounted
+	cgroupRoot = "/sys/fs/cgroup"
+	// cgroupV1CPUSetFile is the cpuset of the container the controller writes on cgroup v1
+	cgroupV1CPUSetFile = "cpuset/cpuset.cpus"
+	// cgroupV2CPUSetFile is the cpuset the container actually gets on cgroup v2
+	cgroupV2CPUSetFile = "cpuset.cpus.effective"
+	// cpuSetWaitTimeoutEnv overrides how long the process starter waits for the controller, as a duration like 1m
+	cpuSetWaitTimeoutEnv     = "CPUSET_WAIT_TIMEOUT"
+	defaultCPUSetWaitTimeout = 30 * time.Second
+	// cpuSetReadinessEnv selects what tells the process starter that the cpuset is applied:
+	// the cgroup cpuset matching the allocated CPUs, or the annotation the controller sets on the pod once it applied the cpusets of all containers
+	cpuSetReadinessEnv        = "CPUSET_READINESS"
+	cpuSetReadinessCgroup     = "cgroup"
+	cpuSetReadinessAnnotation = "annotation"
+	// watchRecheckInterval is how often the file is read next to its events, as some cgroup files change without notifying
+	// pollInterval is how often it is read when it cannot be watched
+	watchRecheckInterval = time.Second
+	pollInterval         = 100 * time.Millisecond
+)
+
+var (
+	errCPUSetNotApplied    = errors.New("cgroup cpuset of the container does not match the allocated CPUs")
+	errCPUSetNotConfigured = errors.New("controller did not annotate the pod as configured")
+	errWaitTimeout         = errors.New("timed out")
+)
+
+// cpusetsConfiguredAnnotationName is the annotation the controller sets on the pod once it applied the cpusets of its containers
+func cpusetsConfiguredAnnotationName() string {
+	return resourceBaseName + "/cpusets-configured"
+}
+
+// cgroupCPUSetFile returns the file holding the cpuset of the container under the cgroup root, for the cgroup version mounted there
+func cgroupCPUSetFile(root string) string {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		return filepath.Join(root, cgroupV2CPUSetFile)
+	}
+	return filepath.Join(root, cgroupV1CPUSetFile)
+}
+
+// cpuSetWaitTimeout returns how long to wait for the cpuset, as given in the environment
+func cpuSetWaitTimeout(getenv func(string) string) (time.Duration, error) {
+	value := getenv(cpuSetWaitTimeoutEnv)
+	if value == "" {
+		return defaultCPUSetWaitTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, a positive duration is expected", cpuSetWaitTimeoutEnv, value)
+	}
+	return timeout, nil
+}
+
+// waitForFile calls ready whenever the file changes, until it returns true, an error, or the timeout expires
+// The directory of the file is watched, so files replaced by renames, like the ones of the downward API, are followed too
+// The file is polled when it cannot be watched
+func waitForFile(fileName string, timeout time.Duration, ready func() (bool, error)) error {
+	if done, err := ready(); err != nil || done {
+		return err
+	}
+	var (
+		events   <-chan fsnotify.Event
+		errs     <-chan error
+		interval = pollInterval
+	)
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		err = watcher.Add(filepath.Dir(fileName))
+	}
+	if err == nil {
+		events, errs, interval = watcher.Events, watcher.Errors, watchRecheckInterval
+	} else {
+		mainLogger.Warn("Cannot watch file, polling it", logger.Any("file", fileName), logger.Error(err))
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-events:
+		case err := <-errs:
+			mainLogger.Warn("Error watching file", logger.Any("file", fileName), logger.Error(err))
+		case <-ticker.C:
+		case <-deadline.C:
+			return errWaitTimeout
+		}
+		if done, err := ready(); err != nil || done {
+			return err
+		}
+	}
+}
+
+// waitForCPUSet waits until the controller applied the expected CPUs to the cgroup cpuset of the container
+// Affinities set before would be overwritten by the cpuset
+func waitForCPUSet(fileName string, expected cpuset.CPUSet, timeout time.Duration) error {
+	if expected.IsEmpty() {
+		return nil
+	}
+	var current cpuset.CPUSet
+	err := waitForFile(fileName, timeout, func() (bool, error) {
+		buf, err := os.ReadFile(fileName)
+		if err != nil {
+			return false, err
+		}
+		current, err = cpuset.Parse(strings.TrimSpace(string(buf)))
+		if err != nil {
+			return false, fmt.Errorf("cannot parse cgroup cpuset %q: %w", string(buf), err)
+		}
+		return current.Equals(expected), nil
+	})
+	if err == errWaitTimeout {
+		mainLogger.Error("Cgroup cpuset does not match the allocated CPUs", logger.Any("cpuset", current.String()), logger.Any("expected", expected.String()))
+		return errCPUSetNotApplied
+	}
+	return err
+}
+
+// waitForConfiguredAnnotation waits until the controller annotated the pod as configured in the downward API file
+// The annotation is set once for the pod, so a restarted container does not wait for the controller to apply its cpuset again
+func waitForConfiguredAnnotation(fileName string, timeout time.Duration) error {
+	err := waitForFile(fileName, timeout, func() (bool, error) {
+		annotations, err := readPodAnnotations(fileName)
+		if err != nil {
+			return false, err
+		}
+		return annotations[cpusetsConfiguredAnnotationName()] == "true", nil
+	})
+	if err == errWaitTimeout {
+		return errCPUSetNotConfigured
+	}
+	return err
+}
+
+// waitForCPUSetReadiness waits until the cpuset of the container is applied, the way the environment selects
+func waitForCPUSetReadiness(getenv func(string) string, expected cpuset.CPUSet) error {
+	timeout, err := cpuSetWaitTimeout(getenv)
+	if err != nil {
+		return err
+	}
+	switch readiness := getenv(cpuSetReadinessEnv); readiness {
+	case "", cpuSetReadinessCgroup:
+		return waitForCPUSet(cgroupCPUSetFile(cgroupRoot), expected, timeout)
+	case cpuSetReadinessAnnotation:
+		if expected.IsEmpty() {
+			return nil
+		}
+		return waitForConfiguredAnnotation(podInfoAnnotationsFile, timeout)
+	default:
+		return fmt.Errorf("invalid %s %q, %s or %s is expected", cpuSetReadinessEnv, readiness, cpuSetReadinessCgroup, cpuSetReadinessAnnotation)
+	}
+}
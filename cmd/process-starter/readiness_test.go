@@ -0,0 +1,113 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/kubernetes/pkg/kubelet/cm/cpuset"
+)
+
+func TestCgroupCPUSetFile(t *testing.T) {
+	root := t.TempDir()
+	assert.Equal(t, filepath.Join(root, "cpuset/cpuset.cpus"), cgroupCPUSetFile(root))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpuset cpu\n"), 0644))
+	assert.Equal(t, filepath.Join(root, "cpuset.cpus.effective"), cgroupCPUSetFile(root))
+}
+
+func TestCPUSetWaitTimeout(t *testing.T) {
+	env := map[string]string{}
+	getenv := func(name string) string { return env[name] }
+	timeout, err := cpuSetWaitTimeout(getenv)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultCPUSetWaitTimeout, timeout)
+
+	env[cpuSetWaitTimeoutEnv] = "2m"
+	timeout, err = cpuSetWaitTimeout(getenv)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Minute, timeout)
+
+	for _, value := range []string{"30", "-1s", "0s"} {
+		env[cpuSetWaitTimeoutEnv] = value
+		_, err = cpuSetWaitTimeout(getenv)
+		assert.EqualError(t, err, `invalid CPUSET_WAIT_TIMEOUT "`+value+`", a positive duration is expected`)
+	}
+}
+
+func TestWaitForCPUSet(t *testing.T) {
+	assert := assert.New(t)
+	fileName := filepath.Join(t.TempDir(), "cpuset.cpus")
+	assert.Nil(os.WriteFile(fileName, []byte("0-7\n"), 0644))
+	expected := cpuset.NewCPUSet(1, 4, 5)
+	assert.Equal(errCPUSetNotApplied, waitForCPUSet(fileName, expected, 10*time.Millisecond))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = os.WriteFile(fileName, []byte("1,4-5\n"), 0644)
+	}()
+	//the change is noticed from its event, well before the recheck interval
+	start := time.Now()
+	assert.Nil(waitForCPUSet(fileName, expected, 5*time.Second))
+	assert.Less(time.Since(start), watchRecheckInterval)
+
+	assert.Nil(waitForCPUSet(filepath.Join(t.TempDir(), "missing"), cpuset.NewCPUSet(), time.Millisecond))
+	assert.NotNil(waitForCPUSet(filepath.Join(t.TempDir(), "missing"), expected, time.Millisecond))
+}
+
+func TestWaitForCPUSetPollsUnwatchableFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "cpuset.cpus")
+	assert.Nil(t, os.WriteFile(fileName, []byte("0-7\n"), 0644))
+	calls := 0
+	//the directory of the file is gone, so it cannot be watched, but it is still read
+	err := waitForFile(filepath.Join(t.TempDir(), "missing", "file"), 5*time.Second, func() (bool, error) {
+		calls++
+		return calls == 3, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestWaitForConfiguredAnnotation(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "annotations")
+	assert.Nil(os.WriteFile(fileName, []byte("cmss.cn/cpus=\"[]\"\n"), 0644))
+	assert.Equal(errCPUSetNotConfigured, waitForConfiguredAnnotation(fileName, 10*time.Millisecond))
+
+	//the downward API replaces the file by a rename
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		tmpName := filepath.Join(dir, "..tmp")
+		_ = os.WriteFile(tmpName, []byte("cmss.cn/cpus=\"[]\"\ncmss.cn/cpusets-configured=\"true\"\n"), 0644)
+		_ = os.Rename(tmpName, fileName)
+	}()
+	assert.Nil(waitForConfiguredAnnotation(fileName, 5*time.Second))
+}
+
+func TestWaitForCPUSetReadinessSource(t *testing.T) {
+	getenv := func(name string) string { return map[string]string{cpuSetReadinessEnv: "kubelet"}[name] }
+	assert.EqualError(t, waitForCPUSetReadiness(getenv, cpuset.NewCPUSet(1)), `invalid CPUSET_READINESS "kubelet", cgroup or annotation is expected`)
+
+	//nothing is waited for without allocated CPUs
+	getenv = func(name string) string { return map[string]string{cpuSetReadinessEnv: "annotation"}[name] }
+	assert.Nil(t, waitForCPUSetReadiness(getenv, cpuset.NewCPUSet()))
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// restartDelay is how long a process waits to be restarted, doubled on every restart in a row up to maxRestartDelay
+	restartDelay    = time.Second
+	maxRestartDelay = 30 * time.Second
+	// shutdownTimeout is how long the processes have to exit after the termination signal before they are killed
+	shutdownTimeout = 10 * time.Second
+)
+
+// supervisedProcess is a process of the container, and its state in the supervisor
+type supervisedProcess struct {
+	process   types.Process
+	cpus      []int
+	pid       int
+	running   bool
+	restarts  int
+	startedAt time.Time
+}
+
+// supervisor starts the processes of the container and stays their parent, like an init process
+// It forwards the termination signals, reaps every exited child including the orphans it inherits, and restarts the processes by their restart policy
+// A process exiting without being restarted is critical, unless its OnFailure policy is satisfied: the other ones are stopped,
+// and the container exits with its exit code
+type supervisor struct {
+	processes []*supervisedProcess
+	start     func(types.Process, []int) (int, error)
+
+	restartDelay    time.Duration
+	maxRestartDelay time.Duration
+	shutdownTimeout time.Duration
+
+	restartCh       chan *supervisedProcess
+	pendingRestarts int
+	killCh          <-chan time.Time
+	stopping        bool
+	exitCode        int
+	exitCodeSet     bool
+}
+
+func newSupervisor(processes []types.Process, cpus [][]int) *supervisor {
+	s := &supervisor{
+		start:           startProcess,
+		restartDelay:    restartDelay,
+		maxRestartDelay: maxRestartDelay,
+		shutdownTimeout: shutdownTimeout,
+		restartCh:       make(chan *supervisedProcess, len(processes)),
+	}
+	for i, process := range processes {
+		s.processes = append(s.processes, &supervisedProcess{process: process, cpus: cpus[i]})
+	}
+	return s
+}
+
+// restartNeeded tells if the restart policy restarts a process which exited with the code
+func restartNeeded(restartPolicy string, exitCode int) bool {
+	switch restartPolicy {
+	case types.RestartPolicyAlways:
+		return true
+	case types.RestartPolicyOnFailure:
+		return exitCode != 0
+	}
+	return false
+}
+
+// exitStatusCode returns the exit code of a process, or 128 plus the signal which killed it, the way shells report it
+func exitStatusCode(status unix.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// run starts the processes and supervises them until none is left, then returns the exit code of the container
+// signals has to deliver SIGCHLD next to the termination signals to forward
+func (s *supervisor) run(signals <-chan os.Signal) int {
+	for _, p := range s.processes {
+		if err := s.startProcess(p); err != nil {
+			mainLogger.Error("Cannot start process", logger.Any("process", p.process.ProcName), logger.Error(err))
+			s.setExitCode(1)
+			s.stop(syscall.SIGTERM)
+			break
+		}
+	}
+	for s.active() {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGCHLD {
+				s.reap()
+				continue
+			}
+			mainLogger.Info("Forwarding signal to the processes", logger.Any("signal", sig.String()))
+			s.stop(sig.(syscall.Signal))
+		case p := <-s.restartCh:
+			s.pendingRestarts--
+			if s.stopping {
+				continue
+			}
+			if err := s.startProcess(p); err != nil {
+				mainLogger.Error("Cannot restart process", logger.Any("process", p.process.ProcName), logger.Error(err))
+				s.setExitCode(1)
+				s.stop(syscall.SIGTERM)
+			}
+		case <-s.killCh:
+			mainLogger.Warn("Processes did not exit in time, killing them", logger.Any("timeout", s.shutdownTimeout.String()))
+			s.killCh = nil
+			s.signalAll(syscall.SIGKILL)
+		}
+	}
+	return s.exitCode
+}
+
+func (s *supervisor) startProcess(p *supervisedProcess) error {
+	pid, err := s.start(p.process, p.cpus)
+	if err != nil {
+		return err
+	}
+	p.pid, p.running, p.startedAt = pid, true, time.Now()
+	mainLogger.Info("Process started", logger.Any("process", p.process.ProcName), logger.Any("args", p.process.Args),
+		logger.Any("pid", pid), logger.Any("cpus", p.cpus), logger.Any("restarts", p.restarts))
+	return nil
+}
+
+// active tells if a process still runs, or waits to be restarted
+func (s *supervisor) active() bool {
+	for _, p := range s.processes {
+		if p.running {
+			return true
+		}
+	}
+	return !s.stopping && s.pendingRestarts > 0
+}
+
+// reap collects every exited child: the supervised processes, and the orphans the supervisor inherited
+func (s *supervisor) reap() {
+	for {
+		var status unix.WaitStatus
+		pid, err := unix.Wait4(-1, &status, unix.WNOHANG, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return
+		}
+		if p := s.byPid(pid); p != nil {
+			p.running = false
+			code := exitStatusCode(status)
+			mainLogger.Info("Process exited", logger.Any("process", p.process.ProcName), logger.Any("pid", pid), logger.Any("code", code))
+			s.exited(p, code)
+		}
+	}
+}
+
+// exited restarts the process by its restart policy, or stops the container when the process is critical
+func (s *supervisor) exited(p *supervisedProcess, code int) {
+	if s.stopping {
+		if code != 0 {
+			s.setExitCode(code)
+		}
+		return
+	}
+	if restartNeeded(p.process.RestartPolicy, code) {
+		if time.Since(p.startedAt) > s.maxRestartDelay {
+			p.restarts = 0
+		}
+		delay := s.maxRestartDelay
+		if p.restarts < 16 && s.restartDelay<<p.restarts < s.maxRestartDelay {
+			delay = s.restartDelay << p.restarts
+		}
+		p.restarts++
+		s.pendingRestarts++
+		time.AfterFunc(delay, func() { s.restartCh <- p })
+		mainLogger.Info("Restarting process", logger.Any("process", p.process.ProcName), logger.Any("delay", delay.String()))
+		return
+	}
+	if p.process.RestartPolicy == types.RestartPolicyOnFailure {
+		return
+	}
+	mainLogger.Warn("Critical process exited, stopping the container", logger.Any("process", p.process.ProcName), logger.Any("code", code))
+	s.setExitCode(code)
+	s.stop(syscall.SIGTERM)
+}
+
+func (s *supervisor) byPid(pid int) *supervisedProcess {
+	for _, p := range s.processes {
+		if p.running && p.pid == pid {
+			return p
+		}
+	}
+	return nil
+}
+
+// setExitCode keeps the first exit code the container is stopped with
+func (s *supervisor) setExitCode(code int) {
+	if !s.exitCodeSet {
+		s.exitCode, s.exitCodeSet = code, true
+	}
+}
+
+// stop forwards the signal to the processes, and kills them when they do not exit in time
+func (s *supervisor) stop(sig syscall.Signal) {
+	if !s.stopping {
+		s.stopping = true
+		s.killCh = time.After(s.shutdownTimeout)
+	}
+	s.signalAll(sig)
+}
+
+func (s *supervisor) signalAll(sig syscall.Signal) {
+	for _, p := range s.processes {
+		if !p.running {
+			continue
+		}
+		if err := unix.Kill(p.pid, sig); err != nil && err != unix.ESRCH {
+			mainLogger.Warn("Cannot signal process", logger.Any("process", p.process.ProcName), logger.Any("pid", p.pid), logger.Error(err))
+		}
+	}
+}
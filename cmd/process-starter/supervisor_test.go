@@ -0,0 +1,126 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+func shellProcess(script, restartPolicy string) types.Process {
+	return types.Process{ProcName: "/bin/sh", Args: []string{"-c", script}, RestartPolicy: restartPolicy}
+}
+
+// runSupervisor supervises the processes with short delays, the returned channel forwards signals to it
+func runSupervisor(t *testing.T, processes ...types.Process) (*supervisor, chan os.Signal, <-chan int) {
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, syscall.SIGCHLD)
+	t.Cleanup(func() { signal.Stop(signals) })
+	s := newSupervisor(processes, make([][]int, len(processes)))
+	s.restartDelay = 10 * time.Millisecond
+	s.maxRestartDelay = 50 * time.Millisecond
+	s.shutdownTimeout = 500 * time.Millisecond
+	exitCode := make(chan int, 1)
+	go func() { exitCode <- s.run(signals) }()
+	return s, signals, exitCode
+}
+
+func waitExitCode(t *testing.T, exitCode <-chan int) int {
+	select {
+	case code := <-exitCode:
+		return code
+	case <-time.After(10 * time.Second):
+		t.Fatal("supervisor did not exit")
+	}
+	return -1
+}
+
+func TestRestartNeeded(t *testing.T) {
+	assert.False(t, restartNeeded("", 1))
+	assert.False(t, restartNeeded(types.RestartPolicyNever, 1))
+	assert.False(t, restartNeeded(types.RestartPolicyOnFailure, 0))
+	assert.True(t, restartNeeded(types.RestartPolicyOnFailure, 2))
+	assert.True(t, restartNeeded(types.RestartPolicyAlways, 0))
+}
+
+func TestExitStatusCode(t *testing.T) {
+	assert.Equal(t, 3, exitStatusCode(unix.WaitStatus(3<<8)))
+	assert.Equal(t, 128+int(syscall.SIGKILL), exitStatusCode(unix.WaitStatus(syscall.SIGKILL)))
+}
+
+func TestSupervisorStopsOnCriticalExit(t *testing.T) {
+	s, _, exitCode := runSupervisor(t, shellProcess("exec sleep 10", ""), shellProcess("exit 3", types.RestartPolicyNever))
+	assert.Equal(t, 3, waitExitCode(t, exitCode))
+	for _, p := range s.processes {
+		assert.False(t, p.running)
+	}
+}
+
+func TestSupervisorRestartsOnFailure(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "failed")
+	s, _, exitCode := runSupervisor(t, shellProcess("[ -f "+marker+" ] && exit 0; touch "+marker+"; exit 1", types.RestartPolicyOnFailure))
+	//the process succeeding at its restart is not critical, the container is done when nothing is left
+	assert.Equal(t, 0, waitExitCode(t, exitCode))
+	assert.Equal(t, 1, s.processes[0].restarts)
+}
+
+func TestSupervisorRestartsAlways(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "runs")
+	assert.Nil(t, os.WriteFile(counter, nil, 0644))
+	s, _, exitCode := runSupervisor(t,
+		shellProcess("echo run >> "+counter+"; exit 0", types.RestartPolicyAlways),
+		shellProcess("while [ $(wc -l < "+counter+") -lt 3 ]; do sleep 0.01; done; exit 5", ""),
+	)
+	assert.Equal(t, 5, waitExitCode(t, exitCode))
+	assert.GreaterOrEqual(t, s.processes[0].restarts, 2)
+}
+
+func TestSupervisorForwardsSignals(t *testing.T) {
+	_, signals, exitCode := runSupervisor(t,
+		shellProcess("trap 'exit 0' TERM; while :; do sleep 0.01; done", ""),
+		shellProcess("trap 'exit 0' TERM; while :; do sleep 0.01; done", types.RestartPolicyAlways),
+	)
+	time.Sleep(200 * time.Millisecond)
+	signals <- syscall.SIGTERM
+	assert.Equal(t, 0, waitExitCode(t, exitCode))
+
+	_, signals, exitCode = runSupervisor(t, shellProcess("exec sleep 10", ""))
+	signals <- syscall.SIGINT
+	assert.Equal(t, 128+int(syscall.SIGINT), waitExitCode(t, exitCode))
+}
+
+func TestSupervisorKillsAfterShutdownTimeout(t *testing.T) {
+	_, signals, exitCode := runSupervisor(t, shellProcess("trap '' TERM; exec sleep 10", ""))
+	time.Sleep(200 * time.Millisecond)
+	signals <- syscall.SIGTERM
+	assert.Equal(t, 128+int(syscall.SIGKILL), waitExitCode(t, exitCode))
+}
+
+func TestSupervisorFailedStart(t *testing.T) {
+	s, _, exitCode := runSupervisor(t, shellProcess("exec sleep 10", ""), types.Process{ProcName: "/nonexistent/process"})
+	assert.Equal(t, 1, waitExitCode(t, exitCode))
+	assert.False(t, s.processes[0].running)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+func init() {
+	utilruntime.Must(corev1.AddToScheme(scheme))
+	utilruntime.Must(appsv1.AddToScheme(scheme))
+	utilruntime.Must(batchv1.AddToScheme(scheme))
+	utilruntime.Must(admissionv1.AddToScheme(scheme))
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+}
+
+// decodeAdmissionReview decodes an AdmissionReview of either the admission.k8s.io/v1 or the v1beta1 API
+// The request is returned in v1 form, and the returned function wraps the response into a review of the version the request arrived in
+func decodeAdmissionReview(body []byte) (*admissionv1.AdmissionRequest, func(*admissionv1.AdmissionResponse) runtime.Object, error) {
+	obj, gvk, err := codecs.UniversalDeserializer().Decode(body, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch review := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		if review.Request == nil {
+			return nil, nil, fmt.Errorf("%s contains no request", gvk)
+		}
+		return review.Request, func(resp *admissionv1.AdmissionResponse) runtime.Object {
+			return &admissionv1.AdmissionReview{TypeMeta: review.TypeMeta, Response: resp}
+		}, nil
+	case *v1beta1.AdmissionReview:
+		if review.Request == nil {
+			return nil, nil, fmt.Errorf("%s contains no request", gvk)
+		}
+		return convertV1beta1Request(review.Request), func(resp *admissionv1.AdmissionResponse) runtime.Object {
+			return &v1beta1.AdmissionReview{TypeMeta: review.TypeMeta, Response: convertToV1beta1Response(resp)}
+		}, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported admission review kind %s", gvk)
+}
+
+func convertV1beta1Request(r *v1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	return &admissionv1.AdmissionRequest{
+		UID:                r.UID,
+		Kind:               r.Kind,
+		Resource:           r.Resource,
+		SubResource:        r.SubResource,
+		RequestKind:        r.RequestKind,
+		RequestResource:    r.RequestResource,
+		RequestSubResource: r.RequestSubResource,
+		Name:               r.Name,
+		Namespace:          r.Namespace,
+		Operation:          admissionv1.Operation(r.Operation),
+		UserInfo:           r.UserInfo,
+		Object:             r.Object,
+		OldObject:          r.OldObject,
+		DryRun:             r.DryRun,
+		Options:            r.Options,
+	}
+}
+
+func convertToV1beta1Response(r *admissionv1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	resp := &v1beta1.AdmissionResponse{
+		UID:              r.UID,
+		Allowed:          r.Allowed,
+		Result:           r.Result,
+		Patch:            r.Patch,
+		AuditAnnotations: r.AuditAnnotations,
+		Warnings:         r.Warnings,
+	}
+	if r.PatchType != nil {
+		pt := v1beta1.PatchType(*r.PatchType)
+		resp.PatchType = &pt
+	}
+	return resp
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// WarningNoPoolNode is the reason of the warning given when no pool config defines all the pools of the pod
+const WarningNoPoolNode = "NoPoolNode"
+
+// poolNodeAffinity enables restricting the pods to the nodes whose pool config defines all of their pools
+var poolNodeAffinity bool
+
+// requestedPoolNames returns the sorted names of the pools requested by any container
+func requestedPoolNames(poolRequests poolRequestMap) []string {
+	names := make(map[string]bool)
+	for _, requests := range poolRequests {
+		for poolName := range requests.pools {
+			names[poolName] = true
+		}
+	}
+	poolNames := make([]string, 0, len(names))
+	for poolName := range names {
+		poolNames = append(poolNames, poolName)
+	}
+	sort.Strings(poolNames)
+	return poolNames
+}
+
+// nodeSelectorTerm turns the nodeSelector of a pool config into a term requiring every label of it
+func nodeSelectorTerm(nodeSelector map[string]string) corev1.NodeSelectorTerm {
+	keys := make([]string, 0, len(nodeSelector))
+	for key := range nodeSelector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	term := corev1.NodeSelectorTerm{}
+	for _, key := range keys {
+		term.MatchExpressions = append(term.MatchExpressions, corev1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{nodeSelector[key]},
+		})
+	}
+	return term
+}
+
+// poolNodeSelectorTerms returns one term for every pool config defining all the pools
+// nil terms and true are returned when a pool config selecting every node defines them, so no affinity is needed
+func poolNodeSelectorTerms(poolConfs []types.PoolConfig, poolNames []string) ([]corev1.NodeSelectorTerm, bool) {
+	var terms []corev1.NodeSelectorTerm
+	for _, poolConf := range poolConfs {
+		definesAll := true
+		for _, poolName := range poolNames {
+			if _, exists := poolConf.Pools[poolName]; !exists {
+				definesAll = false
+				break
+			}
+		}
+		if !definesAll {
+			continue
+		}
+		if len(poolConf.NodeSelector) == 0 {
+			return nil, true
+		}
+		term := nodeSelectorTerm(poolConf.NodeSelector)
+		if !containsTerm(terms, term) {
+			terms = append(terms, term)
+		}
+	}
+	return terms, len(terms) > 0
+}
+
+func containsTerm(terms []corev1.NodeSelectorTerm, term corev1.NodeSelectorTerm) bool {
+	for _, t := range terms {
+		if equality.Semantic.DeepEqual(t, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// impliesTerm tells if a node matching the term always matches the other one, because it has all of its expressions
+func impliesTerm(term, other corev1.NodeSelectorTerm) bool {
+	for _, requirement := range other.MatchExpressions {
+		found := false
+		for _, existing := range term.MatchExpressions {
+			if equality.Semantic.DeepEqual(existing, requirement) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeNodeSelectorTerms returns the terms a node has to match to match both the existing and the pool terms
+// Terms are ORed and the expressions of a term are ANDed, so every existing term is combined with every pool term
+// Existing terms which already imply a pool term are kept as they are, so merging again changes nothing
+func mergeNodeSelectorTerms(existing, poolTerms []corev1.NodeSelectorTerm) []corev1.NodeSelectorTerm {
+	if len(existing) == 0 {
+		return poolTerms
+	}
+	var merged []corev1.NodeSelectorTerm
+	for _, term := range existing {
+		implied := false
+		for _, poolTerm := range poolTerms {
+			if impliesTerm(term, poolTerm) {
+				implied = true
+				break
+			}
+		}
+		if implied {
+			if !containsTerm(merged, term) {
+				merged = append(merged, term)
+			}
+			continue
+		}
+		for _, poolTerm := range poolTerms {
+			combined := *term.DeepCopy()
+			combined.MatchExpressions = append(combined.MatchExpressions, poolTerm.MatchExpressions...)
+			if !containsTerm(merged, combined) {
+				merged = append(merged, combined)
+			}
+		}
+	}
+	return merged
+}
+
+// setPoolNodeAffinity requires the pod to be scheduled to a node whose pool config defines all the pools it requests
+// The required node affinity of the pod is narrowed down, the preferred terms and the other affinities are kept
+// A warning is returned when no pool config defines all the pools, the pod is left alone then
+func setPoolNodeAffinity(pod *corev1.Pod, poolRequests poolRequestMap) *admissionWarning {
+	poolNames := requestedPoolNames(poolRequests)
+	if len(poolNames) == 0 {
+		return nil
+	}
+	poolConfs, err := catalog.poolConfigs()
+	if err != nil {
+		mainLogger.Warn("Pool configs could not be read, node affinity is not set", logger.Any("pod", pod.Name), logger.Error(err))
+		return nil
+	}
+	poolTerms, found := poolNodeSelectorTerms(poolConfs, poolNames)
+	if !found {
+		return &admissionWarning{
+			reason:  WarningNoPoolNode,
+			message: "no node has all the CPU pools " + strings.Join(poolNames, ", ") + " requested by the pod",
+		}
+	}
+	if len(poolTerms) == 0 {
+		return nil
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := pod.Spec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	required.NodeSelectorTerms = mergeNodeSelectorTerms(required.NodeSelectorTerms, poolTerms)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func nodeTypeIn(values ...string) corev1.NodeSelectorRequirement {
+	return corev1.NodeSelectorRequirement{Key: "nodeType", Operator: corev1.NodeSelectorOpIn, Values: values}
+}
+
+func withPoolNodeAffinity(t *testing.T) {
+	origAffinity := poolNodeAffinity
+	poolNodeAffinity = true
+	t.Cleanup(func() {
+		poolNodeAffinity = origAffinity
+	})
+}
+
+func TestPoolNodeSelectorTerms(t *testing.T) {
+	assert := assert.New(t)
+	poolConfs := []types.PoolConfig{
+		{Pools: map[string]types.Pool{"exclusive-a": {}, "shared": {}}, NodeSelector: map[string]string{"nodeType": "a", "zone": "z1"}},
+		{Pools: map[string]types.Pool{"exclusive-b": {}, "shared": {}}, NodeSelector: map[string]string{"nodeType": "b"}},
+		{Pools: map[string]types.Pool{"exclusive-a": {}}, NodeSelector: map[string]string{"nodeType": "c"}},
+	}
+	terms, found := poolNodeSelectorTerms(poolConfs, []string{"exclusive-a", "shared"})
+	assert.True(found)
+	assert.Equal([]corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+		nodeTypeIn("a"),
+		{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"z1"}},
+	}}}, terms)
+
+	terms, found = poolNodeSelectorTerms(poolConfs, []string{"shared"})
+	assert.True(found)
+	assert.Len(terms, 2)
+
+	_, found = poolNodeSelectorTerms(poolConfs, []string{"exclusive-a", "exclusive-b"})
+	assert.False(found)
+
+	terms, found = poolNodeSelectorTerms(append(poolConfs, types.PoolConfig{Pools: map[string]types.Pool{"shared": {}}}), []string{"shared"})
+	assert.True(found)
+	assert.Nil(terms)
+}
+
+func TestMergeNodeSelectorTerms(t *testing.T) {
+	assert := assert.New(t)
+	gpu := corev1.NodeSelectorRequirement{Key: "gpu", Operator: corev1.NodeSelectorOpExists}
+	existing := []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{gpu}}}
+	poolTerms := []corev1.NodeSelectorTerm{
+		{MatchExpressions: []corev1.NodeSelectorRequirement{nodeTypeIn("node1")}},
+		{MatchExpressions: []corev1.NodeSelectorRequirement{nodeTypeIn("node2")}},
+	}
+	merged := mergeNodeSelectorTerms(existing, poolTerms)
+	assert.Equal([]corev1.NodeSelectorTerm{
+		{MatchExpressions: []corev1.NodeSelectorRequirement{gpu, nodeTypeIn("node1")}},
+		{MatchExpressions: []corev1.NodeSelectorRequirement{gpu, nodeTypeIn("node2")}},
+	}, merged)
+	assert.Equal(merged, mergeNodeSelectorTerms(merged, poolTerms))
+	assert.Equal(poolTerms, mergeNodeSelectorTerms(nil, poolTerms))
+}
+
+func TestMutatePodsSetsPoolNodeAffinity(t *testing.T) {
+	assert := assert.New(t)
+	withTestPoolConfigs(t)
+	withPoolNodeAffinity(t)
+	preferred := []corev1.PreferredSchedulingTerm{{Weight: 1, Preference: corev1.NodeSelectorTerm{
+		MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "ssd", Operator: corev1.NodeSelectorOpExists}},
+	}}}
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{poolContainer("app", map[string]string{"cmss.cn/sharedpool": "100"}, nil)},
+			Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: []corev1.NodeSelectorRequirement{nodeTypeIn("node1", "node3")}},
+				}},
+				PreferredDuringSchedulingIgnoredDuringExecution: preferred,
+			}},
+		},
+	}
+	raw, err := json.Marshal(&pod)
+	assert.Nil(err)
+	decodedPatch, err := jsonpatch.DecodePatch(mutate(t, raw))
+	assert.Nil(err)
+	patched, err := decodedPatch.Apply(raw)
+	assert.Nil(err)
+	mutated := corev1.Pod{}
+	assert.Nil(json.Unmarshal(patched, &mutated))
+	assert.Equal([]corev1.NodeSelectorTerm{
+		{MatchExpressions: []corev1.NodeSelectorRequirement{nodeTypeIn("node1", "node3"), nodeTypeIn("node1")}},
+		{MatchExpressions: []corev1.NodeSelectorRequirement{nodeTypeIn("node1", "node3"), nodeTypeIn("node2")}},
+	}, mutated.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms)
+	assert.Equal(preferred, mutated.Spec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	assert.Empty(mutate(t, patched))
+}
+
+func TestMutatePodsWarnsWithoutPoolNode(t *testing.T) {
+	assert := assert.New(t)
+	withTestPoolConfigs(t)
+	withPoolNodeAffinity(t)
+	pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		poolContainer("app", map[string]string{"cmss.cn/shared-unknown": "100"}, nil),
+	}}}
+	resp := mutatePodInNamespace(t, "default", pod)
+	assert.True(resp.Allowed)
+	assert.Equal([]string{"no node has all the CPU pools shared-unknown requested by the pod"}, resp.Warnings)
+}
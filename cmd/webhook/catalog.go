@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/config"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	k8sclient "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// catalogSyncTimeout is how long the webhook waits for the pool catalog before it starts serving anyway
+const catalogSyncTimeout = 30 * time.Second
+
+var (
+	// poolConfigMap is the namespace/name of the pool ConfigMap, the pool configs are read from local files when it is not set
+	poolConfigMap string
+	// catalog holds the pool configs the webhook computes limits and validates pods with
+	catalog = &poolCatalog{}
+
+	errCatalogNotSynced = errors.New("pool catalog is not synced with the pool ConfigMap yet")
+)
+
+// poolCatalog keeps the pool configs of the cluster in memory, one for every node selector
+// Without an informer the configs are read from the files matching config.FileMatch on every call
+type poolCatalog struct {
+	informer cache.SharedIndexInformer
+	factory  informers.SharedInformerFactory
+
+	lock    sync.RWMutex
+	configs map[string]types.PoolConfig
+}
+
+// newConfigMapPoolCatalog builds a catalog watching the pool ConfigMap
+// Every entry of the ConfigMap matching config.FileMatch holds the pool config of the nodes selected by its nodeSelector
+func newConfigMapPoolCatalog(kubeClient k8sclient.Interface, namespacedName string) (*poolCatalog, error) {
+	namespace, name, found := strings.Cut(namespacedName, "/")
+	if !found || namespace == "" || name == "" {
+		return nil, fmt.Errorf("pool ConfigMap %q must be given as namespace/name", namespacedName)
+	}
+	pc := &poolCatalog{configs: make(map[string]types.PoolConfig)}
+	pc.factory = informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	pc.informer = pc.factory.Core().V1().ConfigMaps().Informer()
+	_, err := pc.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pc.update(obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			pc.update(newObj.(*corev1.ConfigMap))
+		},
+		DeleteFunc: func(obj interface{}) {
+			mainLogger.Warn("Pool ConfigMap deleted, the pool catalog is empty", logger.Any("configmap", namespacedName))
+			pc.lock.Lock()
+			defer pc.lock.Unlock()
+			pc.configs = make(map[string]types.PoolConfig)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// start runs the informer, and waits until the catalog is synced or the timeout expires
+func (pc *poolCatalog) start(stopCh <-chan struct{}, timeout time.Duration) bool {
+	if pc.informer == nil {
+		return true
+	}
+	pc.factory.Start(stopCh)
+	timeoutCh := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(timeoutCh) })
+	defer timer.Stop()
+	return cache.WaitForCacheSync(mergeStopChannels(stopCh, timeoutCh), pc.informer.HasSynced)
+}
+
+// mergeStopChannels returns a channel closed when any of the given ones is closed
+func mergeStopChannels(a, b <-chan struct{}) <-chan struct{} {
+	merged := make(chan struct{})
+	go func() {
+		defer close(merged)
+		select {
+		case <-a:
+		case <-b:
+		}
+	}()
+	return merged
+}
+
+// nodeSelectorKey identifies the nodes of a pool config in the catalog
+func nodeSelectorKey(nodeSelector map[string]string) string {
+	return labels.Set(nodeSelector).String()
+}
+
+// update replaces the content of the catalog with the entries of the ConfigMap
+// The previous content is kept when any of the entries is invalid, the same way a node agent would refuse to start with it
+func (pc *poolCatalog) update(cm *corev1.ConfigMap) {
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		if config.FileMatch != "" {
+			if matched, err := path.Match(config.FileMatch, key); err != nil || !matched {
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	configs := make(map[string]types.PoolConfig)
+	for _, key := range keys {
+		poolConf, err := types.ParsePoolConfig([]byte(cm.Data[key]))
+		if err != nil {
+			mainLogger.Error("Invalid pool config in the pool ConfigMap, the pool catalog is not updated", logger.Any("key", key), logger.Error(err))
+			return
+		}
+		selector := nodeSelectorKey(poolConf.NodeSelector)
+		if _, exists := configs[selector]; exists {
+			mainLogger.Warn("Pool config overrides a previous one with the same nodeSelector", logger.Any("key", key), logger.Any("nodeSelector", selector))
+		}
+		configs[selector] = poolConf
+	}
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.configs = configs
+	mainLogger.Info("Pool catalog updated", logger.Any("configmap", cm.Namespace+"/"+cm.Name), logger.Any("nodeSelectors", len(configs)))
+}
+
+// poolConfigs returns the pool configs of the cluster, ordered by their node selectors
+func (pc *poolCatalog) poolConfigs() ([]types.PoolConfig, error) {
+	if pc.informer == nil {
+		return types.ReadAllPoolConfigs(config.FileMatch)
+	}
+	if !pc.informer.HasSynced() {
+		return nil, errCatalogNotSynced
+	}
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+	selectors := make([]string, 0, len(pc.configs))
+	for selector := range pc.configs {
+		selectors = append(selectors, selector)
+	}
+	sort.Strings(selectors)
+	poolConfs := make([]types.PoolConfig, 0, len(selectors))
+	for _, selector := range selectors {
+		poolConfs = append(poolConfs, pc.configs[selector])
+	}
+	return poolConfs, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	catalogNode1Config = `pools:
+  exclusive-pool:
+    cpus: "2-5"
+  shared-pool:
+    cpus: "1"
+nodeSelector:
+  nodeType: node1
+`
+	catalogNode2Config = `pools:
+  exclusive-pool:
+    cpus: "2-9"
+nodeSelector:
+  nodeType: node2
+`
+)
+
+func withCatalog(t *testing.T, pc *poolCatalog) {
+	origCatalog, origMatch := catalog, config.FileMatch
+	catalog, config.FileMatch = pc, "cpuset-*.yaml"
+	t.Cleanup(func() {
+		catalog, config.FileMatch = origCatalog, origMatch
+	})
+}
+
+func TestPoolCatalogFollowsConfigMap(t *testing.T) {
+	assert := assert.New(t)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cpusets-configmaps", Namespace: "kube-system"},
+		Data: map[string]string{
+			"cpuset-node1.yaml": catalogNode1Config,
+			"README":            "not a pool config",
+		},
+	}
+	kubeClient := fake.NewSimpleClientset(cm)
+	pc, err := newConfigMapPoolCatalog(kubeClient, "kube-system/cpusets-configmaps")
+	assert.Nil(err)
+	withCatalog(t, pc)
+	_, err = pc.poolConfigs()
+	assert.Equal(errCatalogNotSynced, err)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.True(pc.start(stopCh, 10*time.Second))
+	poolConfs, err := pc.poolConfigs()
+	assert.Nil(err)
+	assert.Len(poolConfs, 1)
+	assert.Equal(4, poolConfs[0].Pools["exclusive-pool"].CPUset.Size())
+	assert.Equal(map[string]int{"exclusive-pool": 4, "shared-pool": 1000}, maxPoolCapacities(poolConfs))
+
+	cm.Data["cpuset-node2.yaml"] = catalogNode2Config
+	_, err = kubeClient.CoreV1().ConfigMaps("kube-system").Update(context.TODO(), cm, metav1.UpdateOptions{})
+	assert.Nil(err)
+	assert.Eventually(func() bool {
+		poolConfs, _ := pc.poolConfigs()
+		return len(poolConfs) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	poolConfs, _ = pc.poolConfigs()
+	assert.Equal("node2", poolConfs[1].NodeSelector["nodeType"])
+	assert.Equal(map[string]int{"exclusive-pool": 8, "shared-pool": 1000}, maxPoolCapacities(poolConfs))
+
+	//an invalid entry keeps the last valid catalog
+	cm.Data["cpuset-node2.yaml"] = "pools:\n  exclusive-pool:\n    cpus: \"x\"\n"
+	_, err = kubeClient.CoreV1().ConfigMaps("kube-system").Update(context.TODO(), cm, metav1.UpdateOptions{})
+	assert.Nil(err)
+	time.Sleep(100 * time.Millisecond)
+	poolConfs, _ = pc.poolConfigs()
+	assert.Len(poolConfs, 2)
+
+	assert.Nil(kubeClient.CoreV1().ConfigMaps("kube-system").Delete(context.TODO(), cm.Name, metav1.DeleteOptions{}))
+	assert.Eventually(func() bool {
+		poolConfs, _ := pc.poolConfigs()
+		return len(poolConfs) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestValidatePodUsesCatalog(t *testing.T) {
+	assert := assert.New(t)
+	kubeClient := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cpusets-configmaps", Namespace: "kube-system"},
+		Data:       map[string]string{"cpuset-node1.yaml": catalogNode1Config},
+	})
+	pc, err := newConfigMapPoolCatalog(kubeClient, "kube-system/cpusets-configmaps")
+	assert.Nil(err)
+	withCatalog(t, pc)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.True(pc.start(stopCh, 10*time.Second))
+
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		poolContainer("app", map[string]string{"cmss.cn/exclusive-pool": "5"}, nil),
+	}}}
+	assert.Equal([]string{"pod requests 5 exclusive CPUs from pool exclusive-pool, but the pool holds at most 4 on any node"}, validatePod(pod, defaultPolicy()))
+}
+
+func TestNewConfigMapPoolCatalogRejectsName(t *testing.T) {
+	_, err := newConfigMapPoolCatalog(fake.NewSimpleClientset(), "cpusets-configmaps")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+)
+
+// selfManagedCertValidity is the validity of the CA and serving certificates generated in self-managed mode
+var selfManagedCertValidity = 365 * 24 * time.Hour
+
+// certReloader serves the certificate and key files, and reloads them when they are rotated on disk
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock        sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// newCertReloader loads the certificate and key files, and returns an error if they cannot be used
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both the certificate and the private key file must be given")
+	}
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) modTimes() (time.Time, time.Time, error) {
+	certStat, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyStat, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certStat.ModTime(), keyStat.ModTime(), nil
+}
+
+// reload loads the files if they changed since the last successful load
+func (cr *certReloader) reload() error {
+	certModTime, keyModTime, err := cr.modTimes()
+	if err != nil {
+		return err
+	}
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if cr.cert != nil && certModTime.Equal(cr.certModTime) && keyModTime.Equal(cr.keyModTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert, cr.certModTime, cr.keyModTime = &cert, certModTime, keyModTime
+	mainLogger.Info("Serving certificate loaded", logger.Any("certFile", cr.certFile), logger.Any("keyFile", cr.keyFile))
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+// The previously loaded certificate is kept serving while the rotated files are invalid, e.g. only one of them is updated yet
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := cr.reload(); err != nil {
+		mainLogger.Warn("Cannot reload the serving certificate, using the previous one", logger.Error(err))
+	}
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	return cr.cert, nil
+}
+
+// generateSelfManagedCerts generates a CA, and a serving certificate signed by it for the given DNS names
+// The PEM encoded CA certificate is returned to be published in the caBundle of the webhook configurations
+func generateSelfManagedCerts(dnsNames []string) (tls.Certificate, []byte, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: resourceBaseName + "-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfManagedCertValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	servingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	servingTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(selfManagedCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	servingDER, err := x509.CreateCertificate(rand.Reader, servingTemplate, caCert, &servingKey.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(servingKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: servingDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), nil
+}
+
+// serviceDNSNames returns the names the API server can use to reach the webhook service
+func serviceDNSNames(service, namespace string) []string {
+	return []string{
+		service + "." + namespace + ".svc",
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc.cluster.local",
+	}
+}
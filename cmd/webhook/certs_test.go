@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCertFiles(t *testing.T, dir, commonName string, modTime time.Time) (string, string) {
+	cert, _, err := generateSelfManagedCerts([]string{commonName})
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	assert.Nil(t, err)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	assert.Nil(t, os.Chtimes(certFile, modTime, modTime))
+	assert.Nil(t, os.Chtimes(keyFile, modTime, modTime))
+	return certFile, keyFile
+}
+
+func servedCommonName(t *testing.T, cr *certReloader) string {
+	cert, err := cr.GetCertificate(nil)
+	assert.Nil(t, err)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloaderReloadsRotatedFiles(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	certFile, keyFile := writeCertFiles(t, dir, "first.kube-system.svc", time.Now().Add(-time.Minute))
+	cr, err := newCertReloader(certFile, keyFile)
+	assert.Nil(err)
+	assert.Equal("first.kube-system.svc", servedCommonName(t, cr))
+
+	writeCertFiles(t, dir, "second.kube-system.svc", time.Now())
+	assert.Equal("second.kube-system.svc", servedCommonName(t, cr))
+
+	//A half-written rotation keeps the previous certificate serving
+	assert.Nil(os.WriteFile(keyFile, []byte("garbage"), 0600))
+	assert.Equal("second.kube-system.svc", servedCommonName(t, cr))
+}
+
+func TestCertReloaderFailsFast(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	_, err := newCertReloader("", "")
+	assert.NotNil(err)
+	_, err = newCertReloader(filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key"))
+	assert.NotNil(err)
+
+	certFile, keyFile := writeCertFiles(t, dir, "webhook", time.Now())
+	assert.Nil(os.WriteFile(keyFile, []byte("garbage"), 0600))
+	_, err = newCertReloader(certFile, keyFile)
+	assert.NotNil(err)
+}
+
+func TestGenerateSelfManagedCerts(t *testing.T) {
+	assert := assert.New(t)
+	cert, caBundle, err := generateSelfManagedCerts(serviceDNSNames("cpusets-webhook", "kube-system"))
+	assert.Nil(err)
+
+	roots := x509.NewCertPool()
+	assert.True(roots.AppendCertsFromPEM(caBundle))
+	serving, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(err)
+	_, err = serving.Verify(x509.VerifyOptions{DNSName: "cpusets-webhook.kube-system.svc", Roots: roots})
+	assert.Nil(err)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// cfsQuotaAnnotationName is the annotation pods override the CFS quota policy of their pools with
+// Its value maps pool names to policies, e.g. {"exclusive-pool1": {"mode": "exact"}, "shared-pool": {"mode": "padded", "padding": 200}}
+func cfsQuotaAnnotationName() string {
+	return resourceBaseName + "/cfs-quota"
+}
+
+// poolCFSQuotaPolicies returns the CFS quota policy of every pool requested by the pod
+// A pool of the same name can be configured differently on different nodes, their policies are merged
+// Pools which are not found in the pool configs get the default policy of their type
+func poolCFSQuotaPolicies(poolRequests poolRequestMap) map[string]types.CFSQuotaPolicy {
+	poolConfs, err := catalog.poolConfigs()
+	if err != nil {
+		mainLogger.Warn("Pool configs could not be read, default CFS quota policies are used", logger.Error(err))
+	}
+	policies := make(map[string]types.CFSQuotaPolicy)
+	for _, requests := range poolRequests {
+		for poolName := range requests.pools {
+			if _, resolved := policies[poolName]; resolved {
+				continue
+			}
+			policy, found, poolSize, cpusPerDevice := types.DefaultCFSQuotaPolicy(poolName), false, 0, 0
+			for _, poolConf := range poolConfs {
+				pool, ok := poolConf.Pools[poolName]
+				if !ok {
+					continue
+				}
+				if pool.CPUset.Size()*1000 > poolSize {
+					poolSize = pool.CPUset.Size() * 1000
+				}
+				if pool.CPUsPerDevice() > cpusPerDevice {
+					cpusPerDevice = pool.CPUsPerDevice()
+				}
+				if found {
+					policy = policy.Merge(pool.CFSQuota)
+				} else {
+					policy, found = pool.CFSQuota, true
+				}
+			}
+			policy.PoolSize, policy.CPUsPerDevice = poolSize, cpusPerDevice
+			policies[poolName] = policy
+		}
+	}
+	return policies
+}
+
+// cfsQuotaPolicies resolves the CFS quota policies of the pools requested by the pod, including the overrides of its annotation
+// An error is returned when the annotation is invalid, or overrides a policy in a way the pool does not allow
+func cfsQuotaPolicies(pod *corev1.Pod, poolRequests poolRequestMap) (map[string]types.CFSQuotaPolicy, error) {
+	policies := poolCFSQuotaPolicies(poolRequests)
+	value, exists := pod.Annotations[cfsQuotaAnnotationName()]
+	if !exists {
+		return policies, nil
+	}
+	overrides := make(map[string]types.CFSQuotaPolicy)
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&overrides); err != nil {
+		return nil, fmt.Errorf("%s annotation cannot be decoded: %s", cfsQuotaAnnotationName(), err.Error())
+	}
+	poolNames := make([]string, 0, len(overrides))
+	for poolName := range overrides {
+		poolNames = append(poolNames, poolName)
+	}
+	sort.Strings(poolNames)
+	for _, poolName := range poolNames {
+		override := overrides[poolName]
+		policy, requested := policies[poolName]
+		if !requested {
+			return nil, fmt.Errorf("%s annotation overrides pool %s which is not requested by any container", cfsQuotaAnnotationName(), poolName)
+		}
+		if err := override.Validate(); err != nil {
+			return nil, fmt.Errorf("%s annotation, pool %s: %s", cfsQuotaAnnotationName(), poolName, err.Error())
+		}
+		if !policy.Allows(override.Mode) {
+			return nil, fmt.Errorf("%s annotation asks for %s CFS quota of pool %s, but the pool only allows %s",
+				cfsQuotaAnnotationName(), override.Mode, poolName, strings.Join(append([]string{policy.Mode}, policy.AllowedOverrides...), ", "))
+		}
+		override.AllowedOverrides, override.PoolSize, override.CPUsPerDevice = policy.AllowedOverrides, policy.PoolSize, policy.CPUsPerDevice
+		policies[poolName] = override
+	}
+	return policies, nil
+}
+
+// containerCFSQuota returns the CFS quota in millicores of a container, summed up from the policies of its pools
+// false is returned when any of its pools disables quotas
+// A container using both exclusive and shared pools gets the full size of its shared pools in poolSize mode, the default of shared pools
+// To avoid artificially throttling the exclusive user threads when the shared threads are overstepping their boundaries,
+// the size of the shared pool replaces the padding of the exclusive pools then
+// This unfortunately allows mixed users to overstep their boundaries, but is the only way to ensure shared threads cannot
+// throttle the latency sensitive ones with their occasional bursts
+func containerCFSQuota(requests containerPoolRequests, quotaPolicies map[string]types.CFSQuotaPolicy) (int, bool) {
+	policyOf := func(poolName string) types.CFSQuotaPolicy {
+		if policy, exists := quotaPolicies[poolName]; exists {
+			return policy
+		}
+		return types.DefaultCFSQuotaPolicy(poolName)
+	}
+	mixed := requests.exclusiveCPURequests > 0 && requests.sharedCPURequests > 0
+	paddedBySharedPool := false
+	for poolName := range requests.pools {
+		if policy := policyOf(poolName); mixed && policy.Mode == types.CFSQuotaPoolSize && policy.PoolSize > 0 {
+			paddedBySharedPool = true
+		}
+	}
+	totalCFSLimit := 0
+	for poolName, devices := range requests.pools {
+		//exclusive devices are whole cores or CPUs, shared devices are millicores
+		policy := policyOf(poolName)
+		cpuTime := devices
+		switch types.DeterminePoolType(poolName) {
+		case types.ExclusivePoolID:
+			cpuTime = 1000 * devices
+			if policy.CPUsPerDevice > 0 {
+				cpuTime *= policy.CPUsPerDevice
+			}
+		case types.SharedPoolID:
+		default:
+			continue
+		}
+		if paddedBySharedPool && policy.Mode == types.CFSQuotaPadded {
+			policy = types.CFSQuotaPolicy{Mode: types.CFSQuotaExact}
+		}
+		quota, limited := policy.Quota(cpuTime, mixed)
+		if !limited {
+			return 0, false
+		}
+		totalCFSLimit += quota
+	}
+	return totalCFSLimit, totalCFSLimit > 0
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func cfsQuotaPod(annotation string) *corev1.Pod {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		poolContainer("app", map[string]string{"cmss.cn/exclusive-cpupool1": "1", "cmss.cn/sharedpool": "200"}, nil),
+	}}}
+	if annotation != "" {
+		pod.Annotations = map[string]string{"cmss.cn/cfs-quota": annotation}
+	}
+	return pod
+}
+
+func TestContainerCFSQuota(t *testing.T) {
+	withTestPoolConfigs(t)
+	tests := []struct {
+		name        string
+		annotation  string
+		wantErr     string
+		wantQuota   int
+		wantLimited bool
+	}{
+		{name: "pool policies", wantQuota: 2000, wantLimited: true},
+		{name: "exact override", annotation: `{"sharedpool": {"mode": "exact"}}`, wantQuota: 1300, wantLimited: true},
+		{name: "exact overrides", annotation: `{"exclusive-cpupool1": {"mode": "exact"}, "sharedpool": {"mode": "exact"}}`, wantQuota: 1200, wantLimited: true},
+		{name: "disabled override", annotation: `{"sharedpool": {"mode": "disabled"}}`},
+		{
+			name:        "same mode with another padding",
+			annotation:  `{"exclusive-cpupool1": {"mode": "padded", "padding": 500}, "sharedpool": {"mode": "exact"}}`,
+			wantQuota:   1700,
+			wantLimited: true,
+		},
+		{
+			name:       "override not allowed",
+			annotation: `{"exclusive-cpupool1": {"mode": "disabled"}}`,
+			wantErr:    "cmss.cn/cfs-quota annotation asks for disabled CFS quota of pool exclusive-cpupool1, but the pool only allows padded, exact",
+		},
+		{
+			name:       "pool not requested",
+			annotation: `{"exclusive-cpupool2": {"mode": "exact"}}`,
+			wantErr:    "cmss.cn/cfs-quota annotation overrides pool exclusive-cpupool2 which is not requested by any container",
+		},
+		{
+			name:       "invalid padding",
+			annotation: `{"sharedpool": {"mode": "exact", "padding": 100}}`,
+			wantErr:    "cmss.cn/cfs-quota annotation, pool sharedpool: CFS quota padding is only allowed in padded mode",
+		},
+		{name: "unknown field", annotation: `{"sharedpool": {"mode": "exact", "allowedOverrides": ["disabled"]}}`, wantErr: "cannot be decoded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pod := cfsQuotaPod(tt.annotation)
+			poolRequests, err := getCPUPoolRequests(pod)
+			assert.Nil(err)
+			quotaPolicies, err := cfsQuotaPolicies(pod, poolRequests)
+			if tt.wantErr != "" {
+				assert.ErrorContains(err, tt.wantErr)
+				assert.Contains(validatePod(pod, defaultPolicy()), err.Error())
+				return
+			}
+			assert.Nil(err)
+			quota, limited := containerCFSQuota(poolRequests["app"], quotaPolicies)
+			assert.Equal(tt.wantLimited, limited)
+			assert.Equal(tt.wantQuota, quota)
+		})
+	}
+}
+
+func TestSetCPULimitKeepsRequest(t *testing.T) {
+	assert := assert.New(t)
+	c := poolContainer("app", nil, map[string]string{"cpu": "100m"})
+	setCPULimit(1100, &c)
+	assert.Equal("100m", c.Resources.Requests.Cpu().String())
+
+	c = poolContainer("app", nil, map[string]string{"cpu": "2"})
+	setCPULimit(1100, &c)
+	assert.Equal("1100m", c.Resources.Requests.Cpu().String())
+}
+
+func TestMutatePodsAppliesCFSQuotaPolicy(t *testing.T) {
+	assert := assert.New(t)
+	withTestPoolConfigs(t)
+	pod := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"cmss.cn/cfs-quota": `{"sharedpool": {"mode": "disabled"}}`}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:      "app",
+			Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{"cmss.cn/sharedpool": resource.MustParse("200")}},
+		}, {
+			Name:      "exact",
+			Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{"cmss.cn/exclusive-cpupool1": resource.MustParse("1")}},
+		}}},
+	}
+	raw, err := json.Marshal(&pod)
+	assert.Nil(err)
+	decodedPatch, err := jsonpatch.DecodePatch(mutate(t, raw))
+	assert.Nil(err)
+	patched, err := decodedPatch.Apply(raw)
+	assert.Nil(err)
+	mutated := corev1.Pod{}
+	assert.Nil(json.Unmarshal(patched, &mutated))
+	_, limited := mutated.Spec.Containers[0].Resources.Limits[corev1.ResourceCPU]
+	assert.False(limited)
+	assert.Equal("1100m", mutated.Spec.Containers[1].Resources.Limits.Cpu().String())
+
+	pod.Annotations["cmss.cn/cfs-quota"] = `{"exclusive-cpupool1": {"mode": "disabled"}}`
+	assert.False(mutatePodInNamespace(t, "default", pod).Allowed)
+}
+
+func TestContainerCFSQuotaCountsCPUsPerDevice(t *testing.T) {
+	assert := assert.New(t)
+	coresPool := func(threadsPerCore int) string {
+		return fmt.Sprintf("pools:\n  exclusive-cores:\n    cpus: \"2-9\"\n    hyperThreadingPolicy: physicalCore\n    threadsPerCore: %d\n    cfsQuota:\n      mode: exact\n", threadsPerCore)
+	}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		poolContainer("app", map[string]string{"cmss.cn/exclusive-cores": "2"}, nil),
+	}}}
+	poolRequests, err := getCPUPoolRequests(pod)
+	assert.Nil(err)
+
+	//the quota covers all threads of the cores on the node giving the most CPUs per device
+	withPoolConfig(t, coresPool(2), coresPool(4))
+	quota, limited := containerCFSQuota(poolRequests["app"], poolCFSQuotaPolicies(poolRequests))
+	assert.True(limited)
+	assert.Equal(8000, quota)
+
+	//every device counts as one CPU when no node configures the pool
+	withPoolConfig(t)
+	quota, limited = containerCFSQuota(poolRequests["app"], poolCFSQuotaPolicies(poolRequests))
+	assert.True(limited)
+	assert.Equal(2100, quota)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+const (
+	// AdmissionAllowed is the result label of admissions allowed without changes
+	AdmissionAllowed = "allowed"
+	// AdmissionPatched is the result label of admissions allowed with a patch
+	AdmissionPatched = "patched"
+	// AdmissionDenied is the result label of denied admissions
+	AdmissionDenied = "denied"
+
+	// ReasonPatched is the reason label of admissions allowed with a patch
+	ReasonPatched = "Patched"
+	// ReasonUnchanged is the reason label of admissions allowed without changes
+	ReasonUnchanged = "Unchanged"
+	// ReasonSkippedByPolicy is the reason label of pods the policy does not let the webhook mutate
+	ReasonSkippedByPolicy = "SkippedByPolicy"
+	// ReasonUnsupportedResource is the reason label of admissions of resources the webhook does not handle
+	ReasonUnsupportedResource = "UnsupportedResource"
+
+	// AuditReasonAnnotation is the audit annotation telling why an admission was allowed without looking into the object
+	AuditReasonAnnotation = "reason"
+
+	// WarningCommandMissing is the reason of the warning given when a container asks exclusive CPUs, but cannot be pinned
+	WarningCommandMissing = "CommandMissing"
+	// WarningPinningDisabled is the reason of the warning given when a container asks exclusive CPUs, but the policy disables pinning
+	WarningPinningDisabled = "PinningDisabled"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	admissionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cpusets_webhook",
+		Name:      "admissions_total",
+		Help:      "Number of admission reviews answered, by endpoint, result and reason. The reason of a denial is the reason of its status, an allowed admission is Patched, Unchanged, or skipped for the reason in its audit annotations.",
+	}, []string{"endpoint", "result", "reason"})
+
+	admissionWarningsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cpusets_webhook",
+		Name:      "admission_warnings_total",
+		Help:      "Number of warnings returned to the users in admission responses, by endpoint and reason.",
+	}, []string{"endpoint", "reason"})
+
+	admissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cpusets_webhook",
+		Name:      "admission_duration_seconds",
+		Help:      "Time spent answering admission reviews, by endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"endpoint"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(admissionsTotal, admissionWarningsTotal, admissionDuration)
+}
+
+// admissionWarning collects a warning for the user, and the reason it is accounted for in the metrics
+type admissionWarning struct {
+	reason  string
+	message string
+}
+
+// addWarnings sets the warnings of the response, and counts them
+func addWarnings(endpoint string, resp *admissionv1.AdmissionResponse, warnings []admissionWarning) {
+	for _, warning := range warnings {
+		resp.Warnings = append(resp.Warnings, warning.message)
+		admissionWarningsTotal.WithLabelValues(endpoint, warning.reason).Inc()
+	}
+}
+
+// skippedResponse allows an admission without looking into the object, the reason is given in the audit annotations
+func skippedResponse(reason string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{Allowed: true, AuditAnnotations: map[string]string{AuditReasonAnnotation: reason}}
+}
+
+// recordAdmission accounts for one answered admission review
+func recordAdmission(endpoint string, resp *admissionv1.AdmissionResponse, start time.Time) {
+	admissionDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	result, reason := AdmissionAllowed, ReasonUnchanged
+	if !resp.Allowed {
+		result, reason = AdmissionDenied, "Unknown"
+		if resp.Result != nil && resp.Result.Reason != "" {
+			reason = string(resp.Result.Reason)
+		}
+	} else if len(resp.Patch) > 0 {
+		result, reason = AdmissionPatched, ReasonPatched
+	} else if skipped, ok := resp.AuditAnnotations[AuditReasonAnnotation]; ok {
+		reason = skipped
+	}
+	admissionsTotal.WithLabelValues(endpoint, result, reason).Inc()
+}
+
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte("ok")); err != nil {
+		mainLogger.Error("response write error", logger.Error(err))
+	}
+}
+
+// registerObservabilityHandlers adds the health and metrics endpoints to the mux
+func registerObservabilityHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kubeservice-stack/common/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func admissionV1Review(t *testing.T, pod corev1.Pod) admissionv1.AdmissionReview {
+	raw, err := json.Marshal(&pod)
+	assert.Nil(t, err)
+	return admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  &admissionv1.AdmissionRequest{Resource: podResource, Object: runtime.RawExtension{Raw: raw}},
+	}
+}
+
+func TestMutateWarnsAboutExclusiveContainerWithoutCommand(t *testing.T) {
+	assert := assert.New(t)
+	warningsBefore := testutil.ToFloat64(admissionWarningsTotal.WithLabelValues(MutatingPath, WarningCommandMissing))
+	patchedBefore := testutil.ToFloat64(admissionsTotal.WithLabelValues(MutatingPath, AdmissionPatched, ReasonPatched))
+	pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+		Name:      "app",
+		Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse("1")}},
+	}}}}
+
+	recorder := postAdmissionReview(t, admissionV1Review(t, pod))
+	response := admissionv1.AdmissionReview{}
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.True(response.Response.Allowed)
+	assert.Equal([]string{"container app asked for exclusive CPUs but has no command, its CPU affinity settings are possibly lost"}, response.Response.Warnings)
+	assert.Equal(warningsBefore+1, testutil.ToFloat64(admissionWarningsTotal.WithLabelValues(MutatingPath, WarningCommandMissing)))
+	assert.Equal(patchedBefore+1, testutil.ToFloat64(admissionsTotal.WithLabelValues(MutatingPath, AdmissionPatched, ReasonPatched)))
+}
+
+func TestDeniedAdmissionsCountedPerReason(t *testing.T) {
+	assert := assert.New(t)
+	deniedBefore := testutil.ToFloat64(admissionsTotal.WithLabelValues(MutatingPath, AdmissionDenied, string(metav1.StatusReasonInvalid)))
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"cmss.cn/cpus": "not json"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+
+	recorder := postAdmissionReview(t, admissionV1Review(t, pod))
+	response := admissionv1.AdmissionReview{}
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.False(response.Response.Allowed)
+	assert.Equal(deniedBefore+1, testutil.ToFloat64(admissionsTotal.WithLabelValues(MutatingPath, AdmissionDenied, string(metav1.StatusReasonInvalid))))
+}
+
+func TestAllowedAdmissionsCountedPerReason(t *testing.T) {
+	assert := assert.New(t)
+	withPolicy(t, utils.Pwd()+"/../../hack/examples/webhook-policy.yaml")
+	skippedBefore := testutil.ToFloat64(admissionsTotal.WithLabelValues(MutatingPath, AdmissionAllowed, ReasonSkippedByPolicy))
+	unchangedBefore := testutil.ToFloat64(admissionsTotal.WithLabelValues(MutatingPath, AdmissionAllowed, ReasonUnchanged))
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+
+	recorder := postAdmissionReview(t, admissionV1Review(t, pod))
+	response := admissionv1.AdmissionReview{}
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.True(response.Response.Allowed)
+	assert.Equal(map[string]string{AuditReasonAnnotation: ReasonSkippedByPolicy}, response.Response.AuditAnnotations)
+	assert.Equal(skippedBefore+1, testutil.ToFloat64(admissionsTotal.WithLabelValues(MutatingPath, AdmissionAllowed, ReasonSkippedByPolicy)))
+
+	pod.Namespace = "default"
+	recorder = postAdmissionReview(t, admissionV1Review(t, pod))
+	response = admissionv1.AdmissionReview{}
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.True(response.Response.Allowed)
+	assert.Empty(response.Response.Patch)
+	assert.Empty(response.Response.AuditAnnotations)
+	assert.Equal(unchangedBefore+1, testutil.ToFloat64(admissionsTotal.WithLabelValues(MutatingPath, AdmissionAllowed, ReasonUnchanged)))
+}
+
+func TestObservabilityHandlers(t *testing.T) {
+	assert := assert.New(t)
+	mux := http.NewServeMux()
+	registerObservabilityHandlers(mux)
+	postAdmissionReview(t, admissionV1Review(t, corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}}}))
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Equal("ok", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Contains(recorder.Body.String(), `cpusets_webhook_admissions_total{endpoint="/mutating",reason="Unchanged",result="allowed"}`)
+	assert.Contains(recorder.Body.String(), "cpusets_webhook_admission_duration_seconds_bucket")
+}
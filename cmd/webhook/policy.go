@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// QuotaNone is the value of the cfsQuotas policy setting disabling CFS quota provisioning
+const QuotaNone = "none"
+
+// policyFile is the optional policy file of the webhook, every pod gets the default policy when it is not set
+var policyFile string
+
+// PolicyRule selects pods by namespace and labels, and controls how the webhook handles them
+// Settings which are not given fall back to the command line configuration of the webhook
+type PolicyRule struct {
+	// Name identifies the rule in logs and admission messages
+	Name string `json:"name"`
+	// Namespaces lists the namespaces the rule applies to, all namespaces when empty
+	Namespaces []string `json:"namespaces,omitempty"`
+	// PodSelector selects the pods the rule applies to, all pods when not set
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// Mutate disables every mutation of the selected pods when false
+	Mutate *bool `json:"mutate,omitempty"`
+	// CFSQuotas is one of all, shared, or none
+	CFSQuotas *string `json:"cfsQuotas,omitempty"`
+	// Pinning disables injecting the process starter when false
+	Pinning *bool `json:"pinning,omitempty"`
+	// MaxExclusiveCPUs limits the exclusive CPUs of one pod, summed across all exclusive pools
+	MaxExclusiveCPUs *int `json:"maxExclusiveCPUs,omitempty"`
+	// AllowedProcessPaths lists the executables the cpus annotation may start
+	// The processes are not restricted when neither AllowedProcessPaths nor AllowedProcessPatterns is given
+	AllowedProcessPaths []string `json:"allowedProcessPaths,omitempty"`
+	// AllowedProcessPatterns lists regular expressions matching the whole path of the executables the cpus annotation may start
+	AllowedProcessPatterns []string `json:"allowedProcessPatterns,omitempty"`
+	// The settings below need AllowedProcessPaths or AllowedProcessPatterns, the restricted processes may not use the v2 process settings they do not allow
+	// AllowedEnv lists the environment variables the processes may set, none when empty
+	AllowedEnv []string `json:"allowedEnv,omitempty"`
+	// AllowedWorkingDirs lists the working directories the processes may be started in, only the one of the container when empty
+	AllowedWorkingDirs []string `json:"allowedWorkingDirs,omitempty"`
+	// MaxSchedPriority is the highest priority of the fifo and rr scheduling policies, the realtime policies are not allowed when it is not set
+	MaxSchedPriority *int `json:"maxSchedPriority,omitempty"`
+	// MinNice is the lowest nice value of the processes, 0 when it is not set
+	MinNice *int `json:"minNice,omitempty"`
+
+	selector        labels.Selector
+	processPatterns []*regexp.Regexp
+}
+
+// WebhookPolicy is the content of the policy file, the first matching rule applies to a pod
+type WebhookPolicy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// admissionPolicy is the policy resolved for one pod
+type admissionPolicy struct {
+	rule             string
+	mutate           bool
+	cfsQuotas        string
+	pinning          bool
+	maxExclusiveCPUs int
+	// processes is nil when the processes of the cpus annotation are not restricted
+	processes *processAllowlist
+}
+
+// processAllowlist holds the executables the cpus annotation may start, and the settings the processes may use
+type processAllowlist struct {
+	paths            []string
+	patterns         []*regexp.Regexp
+	env              []string
+	workingDirs      []string
+	maxSchedPriority int
+	minNice          int
+}
+
+// allows tells if the executable may be started, only absolute and clean paths are allowed, so a pattern like /opt/app/.* cannot be escaped with ..
+func (pa *processAllowlist) allows(processPath string) bool {
+	if !path.IsAbs(processPath) || path.Clean(processPath) != processPath {
+		return false
+	}
+	for _, allowed := range pa.paths {
+		if processPath == allowed {
+			return true
+		}
+	}
+	for _, pattern := range pa.patterns {
+		if pattern.MatchString(processPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// disallowedSetting describes the setting of the process which is not allowed, empty string is returned when all of them are
+// An environment variable like LD_PRELOAD would let an allowed executable run any code, and a realtime scheduling policy could starve the node
+func (pa *processAllowlist) disallowedSetting(process types.Process) string {
+	for _, env := range process.Env {
+		if !contains(pa.env, env.Name) {
+			return "environment variable " + env.Name
+		}
+	}
+	if process.WorkingDir != "" && !contains(pa.workingDirs, process.WorkingDir) {
+		return "working directory " + process.WorkingDir
+	}
+	if (process.SchedPolicy == types.SchedPolicyFIFO || process.SchedPolicy == types.SchedPolicyRR) && process.SchedPriority > pa.maxSchedPriority {
+		return fmt.Sprintf("scheduling policy %s with priority %d", process.SchedPolicy, process.SchedPriority)
+	}
+	if process.Nice < pa.minNice {
+		return fmt.Sprintf("nice value %d", process.Nice)
+	}
+	return ""
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultPolicy() admissionPolicy {
+	return admissionPolicy{mutate: true, cfsQuotas: cfsQuotas, pinning: true}
+}
+
+func parsePolicy(buf []byte) (*WebhookPolicy, error) {
+	policy := &WebhookPolicy{}
+	if err := yaml.UnmarshalStrict(buf, policy); err != nil {
+		return nil, err
+	}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.CFSQuotas != nil && *rule.CFSQuotas != QuotaAll && *rule.CFSQuotas != QuotaShared && *rule.CFSQuotas != QuotaNone {
+			return nil, fmt.Errorf("rule %s: cfsQuotas must be one of %s, %s, or %s", rule.Name, QuotaAll, QuotaShared, QuotaNone)
+		}
+		if rule.MaxExclusiveCPUs != nil && *rule.MaxExclusiveCPUs < 0 {
+			return nil, fmt.Errorf("rule %s: maxExclusiveCPUs must not be negative", rule.Name)
+		}
+		restricted := len(rule.AllowedProcessPaths) > 0 || len(rule.AllowedProcessPatterns) > 0
+		if !restricted && (len(rule.AllowedEnv) > 0 || len(rule.AllowedWorkingDirs) > 0 || rule.MaxSchedPriority != nil || rule.MinNice != nil) {
+			return nil, fmt.Errorf("rule %s: allowedEnv, allowedWorkingDirs, maxSchedPriority and minNice need allowedProcessPaths or allowedProcessPatterns", rule.Name)
+		}
+		if rule.MaxSchedPriority != nil && (*rule.MaxSchedPriority < types.MinRealtimePriority || *rule.MaxSchedPriority > types.MaxRealtimePriority) {
+			return nil, fmt.Errorf("rule %s: maxSchedPriority must be between %d and %d", rule.Name, types.MinRealtimePriority, types.MaxRealtimePriority)
+		}
+		if rule.MinNice != nil && (*rule.MinNice < types.MinNice || *rule.MinNice > types.MaxNice) {
+			return nil, fmt.Errorf("rule %s: minNice must be between %d and %d", rule.Name, types.MinNice, types.MaxNice)
+		}
+		for _, pattern := range rule.AllowedProcessPatterns {
+			//the patterns match the whole path, otherwise "/opt/app/" would allow "/tmp/opt/app/sh" too
+			processPattern, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: allowedProcessPatterns: %w", rule.Name, err)
+			}
+			rule.processPatterns = append(rule.processPatterns, processPattern)
+		}
+		rule.selector = labels.Everything()
+		if rule.PodSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(rule.PodSelector)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.selector = selector
+		}
+	}
+	return policy, nil
+}
+
+func (r *PolicyRule) matches(namespace string, podLabels map[string]string) bool {
+	if len(r.Namespaces) > 0 {
+		found := false
+		for _, ns := range r.Namespaces {
+			if ns == namespace {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.selector.Matches(labels.Set(podLabels))
+}
+
+// policyFor resolves the policy of a pod in the namespace
+func (p *WebhookPolicy) policyFor(namespace string, podLabels map[string]string) admissionPolicy {
+	policy := defaultPolicy()
+	if p == nil {
+		return policy
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matches(namespace, podLabels) {
+			continue
+		}
+		policy.rule = rule.Name
+		if rule.Mutate != nil {
+			policy.mutate = *rule.Mutate
+		}
+		if rule.CFSQuotas != nil {
+			policy.cfsQuotas = *rule.CFSQuotas
+		}
+		if rule.Pinning != nil {
+			policy.pinning = *rule.Pinning
+		}
+		if rule.MaxExclusiveCPUs != nil {
+			policy.maxExclusiveCPUs = *rule.MaxExclusiveCPUs
+		}
+		if len(rule.AllowedProcessPaths) > 0 || len(rule.processPatterns) > 0 {
+			policy.processes = &processAllowlist{
+				paths:       rule.AllowedProcessPaths,
+				patterns:    rule.processPatterns,
+				env:         rule.AllowedEnv,
+				workingDirs: rule.AllowedWorkingDirs,
+			}
+			if rule.MaxSchedPriority != nil {
+				policy.processes.maxSchedPriority = *rule.MaxSchedPriority
+			}
+			if rule.MinNice != nil {
+				policy.processes.minNice = *rule.MinNice
+			}
+		}
+		return policy
+	}
+	return policy
+}
+
+// check returns an error when the pod asks for something the policy does not allow
+func (ap admissionPolicy) check(pod *corev1.Pod, poolRequests poolRequestMap) error {
+	if _, exists := pod.Annotations[annotationNameFromConfig()]; exists && ap.mutate && !ap.pinning {
+		return fmt.Errorf("%s annotation is given, but pinning is disabled by policy %s", annotationNameFromConfig(), ap.rule)
+	}
+	if err := ap.checkProcesses(pod); err != nil {
+		return err
+	}
+	if ap.maxExclusiveCPUs == 0 {
+		return nil
+	}
+	total := 0
+	for _, requests := range poolRequests {
+		for poolName, devices := range requests.pools {
+			if types.DeterminePoolType(poolName) != types.ExclusivePoolID {
+				continue
+			}
+			cpus, err := exclusiveCPUs(poolName, devices)
+			if err != nil {
+				return err
+			}
+			total += cpus
+		}
+	}
+	if total > ap.maxExclusiveCPUs {
+		return fmt.Errorf("pod requests %d exclusive CPUs, policy %s allows at most %d", total, ap.rule, ap.maxExclusiveCPUs)
+	}
+	return nil
+}
+
+// checkProcesses returns an error when the cpus annotation starts an executable which is not allowed by the policy,
+// or gives a process settings the policy does not allow: the webhook signs the whole annotation as approved
+// Annotations which cannot be decoded are left to the annotation validation
+func (ap admissionPolicy) checkProcesses(pod *corev1.Pod) error {
+	value, exists := pod.Annotations[annotationNameFromConfig()]
+	if !exists || ap.processes == nil {
+		return nil
+	}
+	cpuAnnotation := types.NewCPUAnnotation()
+	if err := cpuAnnotation.Decode([]byte(value)); err != nil {
+		return nil
+	}
+	containerNames := cpuAnnotation.ContainerNames()
+	sort.Strings(containerNames)
+	for _, cName := range containerNames {
+		for _, process := range cpuAnnotation[cName].Processes {
+			if !ap.processes.allows(process.ProcName) {
+				return fmt.Errorf("container %s: process %s is not allowed by policy %s", cName, process.ProcName, ap.rule)
+			}
+			if setting := ap.processes.disallowedSetting(process); setting != "" {
+				return fmt.Errorf("container %s: process %s: %s is not allowed by policy %s", cName, process.ProcName, setting, ap.rule)
+			}
+		}
+	}
+	return nil
+}
+
+// policyLoader reads the policy file, and reloads it when it changes on disk
+type policyLoader struct {
+	fileName string
+
+	lock    sync.Mutex
+	policy  *WebhookPolicy
+	modTime time.Time
+}
+
+var policies = &policyLoader{}
+
+// newPolicyLoader loads the policy file, and returns an error if it is invalid
+func newPolicyLoader(fileName string) (*policyLoader, error) {
+	pl := &policyLoader{fileName: fileName}
+	if err := pl.reload(); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+func (pl *policyLoader) reload() error {
+	stat, err := os.Stat(pl.fileName)
+	if err != nil {
+		return err
+	}
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	if pl.policy != nil && stat.ModTime().Equal(pl.modTime) {
+		return nil
+	}
+	buf, err := os.ReadFile(pl.fileName)
+	if err != nil {
+		return err
+	}
+	policy, err := parsePolicy(buf)
+	if err != nil {
+		return err
+	}
+	pl.policy, pl.modTime = policy, stat.ModTime()
+	mainLogger.Info("Webhook policy loaded", logger.Any("file", pl.fileName), logger.Any("rules", len(policy.Rules)))
+	return nil
+}
+
+// policyForPod resolves the policy of the pod, using the previously loaded policy while the file is invalid
+func (pl *policyLoader) policyForPod(namespace string, pod *corev1.Pod) admissionPolicy {
+	if pl.fileName == "" {
+		return defaultPolicy()
+	}
+	if err := pl.reload(); err != nil {
+		mainLogger.Warn("Cannot reload the webhook policy, using the previous one", logger.Any("file", pl.fileName), logger.Error(err))
+	}
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	return pl.policy.policyFor(namespace, pod.Labels)
+}
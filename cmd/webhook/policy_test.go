@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/common/pkg/utils"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func withPolicy(t *testing.T, fileName string) {
+	loader, err := newPolicyLoader(fileName)
+	assert.Nil(t, err)
+	origPolicies := policies
+	policies = loader
+	t.Cleanup(func() {
+		policies = origPolicies
+	})
+}
+
+func TestPolicyFor(t *testing.T) {
+	assert := assert.New(t)
+	buf, err := os.ReadFile(utils.Pwd() + "/../../hack/examples/webhook-policy.yaml")
+	assert.Nil(err)
+	policy, err := parsePolicy(buf)
+	assert.Nil(err)
+
+	tests := []struct {
+		name      string
+		namespace string
+		labels    map[string]string
+		want      admissionPolicy
+	}{
+		{name: "system namespace", namespace: "kube-system",
+			want: admissionPolicy{rule: "system", mutate: false, cfsQuotas: QuotaAll, pinning: true}},
+		{name: "selected pod", namespace: "telco", labels: map[string]string{"cmss.cn/pinning": "enabled"},
+			want: admissionPolicy{rule: "telco", mutate: true, cfsQuotas: QuotaShared, pinning: true, maxExclusiveCPUs: 8}},
+		{name: "not selected pod", namespace: "telco",
+			want: admissionPolicy{rule: "default", mutate: true, cfsQuotas: QuotaNone, pinning: false, maxExclusiveCPUs: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policy.policyFor(tt.namespace, tt.labels)
+			//the process allowlist is checked by TestPolicyProcessAllowlist
+			got.processes = nil
+			assert.Equal(tt.want, got)
+		})
+	}
+
+	var noPolicy *WebhookPolicy
+	assert.Equal(defaultPolicy(), noPolicy.policyFor("default", nil))
+}
+
+func TestParsePolicyRejectsInvalidRules(t *testing.T) {
+	for _, content := range []string{
+		"rules: [ { name: bad, cfsQuotas: sometimes } ]",
+		"rules: [ { name: bad, maxExclusiveCPUs: -1 } ]",
+		"rules: [ { name: bad, podSelector: { matchExpressions: [ { key: a, operator: Bad } ] } } ]",
+		"rules: [ { name: bad, unknownField: true } ]",
+		"rules: [ { name: bad, allowedProcessPatterns: [ \"/opt/(\" ] } ]",
+		"rules: [ { name: bad, allowedEnv: [ LD_PRELOAD ] } ]",
+		"rules: [ { name: bad, minNice: -5 } ]",
+		"rules: [ { name: bad, allowedProcessPaths: [ /bin/app ], maxSchedPriority: 100 } ]",
+		"rules: [ { name: bad, allowedProcessPaths: [ /bin/app ], minNice: -21 } ]",
+	} {
+		_, err := parsePolicy([]byte(content))
+		assert.NotNil(t, err, content)
+	}
+}
+
+func TestPolicyLoaderReloadsChangedFile(t *testing.T) {
+	assert := assert.New(t)
+	fileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.Nil(os.WriteFile(fileName, []byte("rules: [ { name: first, mutate: false } ]"), 0600))
+	assert.Nil(os.Chtimes(fileName, time.Now().Add(-time.Minute), time.Now().Add(-time.Minute)))
+	loader, err := newPolicyLoader(fileName)
+	assert.Nil(err)
+	assert.Equal("first", loader.policyForPod("default", &corev1.Pod{}).rule)
+
+	assert.Nil(os.WriteFile(fileName, []byte("rules: [ { name: second, mutate: false } ]"), 0600))
+	assert.Equal("second", loader.policyForPod("default", &corev1.Pod{}).rule)
+
+	assert.Nil(os.WriteFile(fileName, []byte("rules: [ { name: third, cfsQuotas: sometimes } ]"), 0600))
+	assert.Equal("second", loader.policyForPod("default", &corev1.Pod{}).rule)
+
+	_, err = newPolicyLoader(fileName)
+	assert.NotNil(err)
+}
+
+func mutatePodInNamespace(t *testing.T, namespace string, pod corev1.Pod) *admissionv1.AdmissionResponse {
+	raw, err := json.Marshal(&pod)
+	assert.Nil(t, err)
+	return mutatePods(&admissionv1.AdmissionRequest{Resource: podResource, Namespace: namespace, Object: runtime.RawExtension{Raw: raw}})
+}
+
+func TestMutatePodsAppliesPolicy(t *testing.T) {
+	assert := assert.New(t)
+	withPolicy(t, utils.Pwd()+"/../../hack/examples/webhook-policy.yaml")
+	withPoolConfig(t, testPoolConfig)
+	exclusivePod := func(cpus string) corev1.Pod {
+		return corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:    "app",
+			Command: []string{"/bin/app"},
+			Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse(cpus)},
+			},
+		}}}}
+	}
+
+	resp := mutatePodInNamespace(t, "kube-system", exclusivePod("1"))
+	assert.True(resp.Allowed)
+	assert.Empty(resp.Patch)
+
+	//the namespace of the pod is used when the request has none
+	system := exclusivePod("1")
+	system.Namespace = "kube-system"
+	resp = mutatePodInNamespace(t, "", system)
+	assert.True(resp.Allowed)
+	assert.Empty(resp.Patch)
+
+	resp = mutatePodInNamespace(t, "default", exclusivePod("1"))
+	assert.True(resp.Allowed)
+	assert.NotContains(string(resp.Patch), "process-starter")
+	assert.NotContains(string(resp.Patch), "/resources/limits/cpu")
+	assert.Equal([]string{"container app asked for exclusive CPUs but pinning is disabled by policy default"}, resp.Warnings)
+
+	resp = mutatePodInNamespace(t, "default", exclusivePod("3"))
+	assert.False(resp.Allowed)
+	assert.Equal(metav1.StatusReasonForbidden, resp.Result.Reason)
+	assert.Equal("pod requests 3 exclusive CPUs, policy default allows at most 2", resp.Result.Message)
+
+	annotated := exclusivePod("1")
+	annotated.Annotations = map[string]string{"cmss.cn/cpus": `[{"container": "app", "processes": [{"process": "/bin/app", "args": [], "cpus": 1, "pool": "exclusive-pool"}]}]`}
+	resp = mutatePodInNamespace(t, "default", annotated)
+	assert.False(resp.Allowed)
+	assert.Equal("cmss.cn/cpus annotation is given, but pinning is disabled by policy default", resp.Result.Message)
+
+	selected := exclusivePod("1")
+	selected.Labels = map[string]string{"cmss.cn/pinning": "enabled"}
+	resp = mutatePodInNamespace(t, "telco", selected)
+	assert.True(resp.Allowed)
+	assert.Contains(string(resp.Patch), "process-starter")
+	assert.NotContains(string(resp.Patch), "/resources/limits/cpu")
+}
+
+func TestPolicyCountsExclusiveCPUs(t *testing.T) {
+	assert := assert.New(t)
+	withPoolConfig(t, "pools:\n  exclusive-cores:\n    cpus: \"2-9\"\n    hyperThreadingPolicy: physicalCore\n    threadsPerCore: 2\n")
+	policy := admissionPolicy{rule: "cores", maxExclusiveCPUs: 2}
+	pod := &corev1.Pod{}
+
+	assert.Nil(policy.check(pod, poolRequestMap{"app": {exclusiveCPURequests: 1, pools: map[string]int{"exclusive-cores": 1}}}))
+	assert.EqualError(policy.check(pod, poolRequestMap{"app": {exclusiveCPURequests: 2, pools: map[string]int{"exclusive-cores": 2}}}),
+		"pod requests 4 exclusive CPUs, policy cores allows at most 2")
+	assert.EqualError(policy.check(pod, poolRequestMap{"app": {exclusiveCPURequests: 1, pools: map[string]int{"exclusive-unknown": 1}}}),
+		"pool exclusive-unknown is not configured on any node")
+}
+
+func TestPolicyProcessAllowlist(t *testing.T) {
+	buf, err := os.ReadFile(utils.Pwd() + "/../../hack/examples/webhook-policy.yaml")
+	assert.Nil(t, err)
+	policy, err := parsePolicy(buf)
+	assert.Nil(t, err)
+	telco := policy.policyFor("telco", map[string]string{"cmss.cn/pinning": "enabled"})
+	assert.Nil(t, policy.policyFor("telco", nil).processes)
+
+	tests := []struct {
+		process string
+		allowed bool
+	}{
+		{process: "/usr/bin/dpdk-testpmd", allowed: true},
+		{process: "/opt/telco/bin/l2fwd", allowed: true},
+		{process: "/usr/bin/dpdk-testpmd2"},
+		{process: "/opt/telco/bin/l2fwd/../../../../bin/sh"},
+		{process: "/tmp/opt/telco/bin/l2fwd"},
+		{process: "opt/telco/bin/l2fwd"},
+		{process: "/bin/sh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.process, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				"cmss.cn/cpus": `[{"container":"app","processes":[{"process":"` + tt.process + `","cpus":1,"pool":"exclusive-pool"}]}]`,
+			}}}
+			err := telco.check(pod, poolRequestMap{})
+			if tt.allowed {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, "container app: process "+tt.process+" is not allowed by policy telco")
+			}
+		})
+	}
+}
+
+func TestPolicyProcessSettings(t *testing.T) {
+	buf, err := os.ReadFile(utils.Pwd() + "/../../hack/examples/webhook-policy.yaml")
+	assert.Nil(t, err)
+	policy, err := parsePolicy(buf)
+	assert.Nil(t, err)
+	telco := policy.policyFor("telco", map[string]string{"cmss.cn/pinning": "enabled"})
+
+	tests := []struct {
+		name     string
+		settings string
+		err      string
+	}{
+		{name: "allowed settings", settings: `"env": [{"name": "RTE_SDK", "value": "/opt/dpdk"}], "workingDir": "/opt/telco", "schedPolicy": "fifo", "schedPriority": 50, "nice": 5`},
+		{name: "preloaded library", settings: `"env": [{"name": "LD_PRELOAD", "value": "/tmp/evil.so"}]`,
+			err: "environment variable LD_PRELOAD"},
+		{name: "search path", settings: `"env": [{"name": "PATH", "value": "/tmp"}]`,
+			err: "environment variable PATH"},
+		{name: "working directory", settings: `"workingDir": "/tmp"`,
+			err: "working directory /tmp"},
+		{name: "realtime priority", settings: `"schedPolicy": "rr", "schedPriority": 99`,
+			err: "scheduling policy rr with priority 99"},
+		{name: "nice value", settings: `"nice": -10`,
+			err: "nice value -10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				"cmss.cn/cpus": `{"apiVersion": "v2", "containers": [{"container": "app", "processes": [{"process": "/usr/bin/dpdk-testpmd", "cpus": 1, "pool": "exclusive-pool", ` + tt.settings + `}]}]}`,
+			}}}
+			err := telco.check(pod, poolRequestMap{})
+			if tt.err == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, "container app: process /usr/bin/dpdk-testpmd: "+tt.err+" is not allowed by policy telco")
+			}
+		})
+	}
+
+	//the settings are not restricted without process allowlist
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		"cmss.cn/cpus": `{"apiVersion": "v2", "containers": [{"container": "app", "processes": [{"process": "/bin/app", "cpus": 1, "pool": "exclusive-pool", "env": [{"name": "LD_PRELOAD", "value": "/lib/x.so"}]}]}]}`,
+	}}}
+	assert.Nil(t, defaultPolicy().check(pod, poolRequestMap{}))
+}
+
+func TestMutatePodsRejectsProcessOutsideAllowlist(t *testing.T) {
+	assert := assert.New(t)
+	withPolicy(t, utils.Pwd()+"/../../hack/examples/webhook-policy.yaml")
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{"cmss.cn/pinning": "enabled"},
+			Annotations: map[string]string{"cmss.cn/cpus": `[{"container":"app","processes":[{"process":"/bin/sh","cpus":1,"pool":"exclusive-pool"}]}]`},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:      "app",
+			Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse("1")}},
+		}}},
+	}
+	resp := mutatePodInNamespace(t, "telco", pod)
+	assert.False(resp.Allowed)
+	assert.Equal(metav1.StatusReasonForbidden, resp.Result.Reason)
+	assert.Contains(validatePod(&pod, policies.policyForPod("telco", &pod)), "container app: process /bin/sh is not allowed by policy telco")
+}
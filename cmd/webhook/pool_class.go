@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// PoolClassNone disables the pool resource injection of a pod in a namespace which enables it
+const PoolClassNone = "none"
+
+var (
+	// poolClassInjection enables translating the standard CPU requests of the pods into pool resources
+	poolClassInjection bool
+	// namespaceLister reads the pool class annotation of the namespaces, nil when the injection is disabled
+	namespaceLister corelisters.NamespaceLister
+)
+
+// poolClassAnnotationName is the namespace or pod annotation naming the pools CPU requests are translated to
+// Its value lists at most one exclusive and one shared pool, e.g. "exclusive-pool1,shared-pool1"
+func poolClassAnnotationName() string {
+	return resourceBaseName + "/pool-class"
+}
+
+// poolClass holds the pools the CPU requests of a pod are translated to, an empty name disables the translation to its pool type
+type poolClass struct {
+	exclusivePool string
+	sharedPool    string
+}
+
+func parsePoolClass(value string) (poolClass, error) {
+	class := poolClass{}
+	value = strings.TrimSpace(value)
+	if value == "" || value == PoolClassNone {
+		return class, nil
+	}
+	for _, poolName := range strings.Split(value, ",") {
+		poolName = strings.TrimSpace(poolName)
+		switch types.DeterminePoolType(poolName) {
+		case types.ExclusivePoolID:
+			if class.exclusivePool != "" {
+				return poolClass{}, fmt.Errorf("pool class %q names more than one exclusive pool", value)
+			}
+			class.exclusivePool = poolName
+		case types.SharedPoolID:
+			if class.sharedPool != "" {
+				return poolClass{}, fmt.Errorf("pool class %q names more than one shared pool", value)
+			}
+			class.sharedPool = poolName
+		default:
+			return poolClass{}, fmt.Errorf("pool class %q names pool %q which is neither exclusive nor shared", value, poolName)
+		}
+	}
+	return class, nil
+}
+
+// resolvePoolClass returns the pool class of the pod, given by its own annotation or the annotation of its namespace
+func resolvePoolClass(namespace string, pod *corev1.Pod) (poolClass, error) {
+	if !poolClassInjection {
+		return poolClass{}, nil
+	}
+	if value, exists := pod.Annotations[poolClassAnnotationName()]; exists {
+		class, err := parsePoolClass(value)
+		if err != nil {
+			return poolClass{}, fmt.Errorf("%s annotation of the pod: %w", poolClassAnnotationName(), err)
+		}
+		return class, nil
+	}
+	if namespaceLister == nil || namespace == "" {
+		return poolClass{}, nil
+	}
+	ns, err := namespaceLister.Get(namespace)
+	if err != nil {
+		mainLogger.Warn("Namespace not found, pool resources are not injected", logger.Any("namespace", namespace), logger.Error(err))
+		return poolClass{}, nil
+	}
+	class, err := parsePoolClass(ns.Annotations[poolClassAnnotationName()])
+	if err != nil {
+		return poolClass{}, fmt.Errorf("%s annotation of namespace %s: %w", poolClassAnnotationName(), namespace, err)
+	}
+	return class, nil
+}
+
+// isGuaranteed tells if the pod is in the Guaranteed QoS class, i.e. all its containers have equal CPU and memory requests and limits
+func isGuaranteed(pod *corev1.Pod) bool {
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, c := range containers {
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			limit, exists := c.Resources.Limits[name]
+			if !exists || limit.IsZero() {
+				return false
+			}
+			if request, exists := c.Resources.Requests[name]; exists && !request.Equal(limit) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasPoolResources tells if the container already asks for CPU pool resources
+func hasPoolResources(c *corev1.Container) bool {
+	for key := range c.Resources.Limits {
+		if strings.HasPrefix(string(key), resourceBaseName+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// injectPoolResources translates the CPU requests of the containers into resources of the pools of the class
+// Integer CPU requests of Guaranteed pods ask for exclusive CPUs, other requests for shared millicores
+// Containers already asking for pool resources are left alone, so injecting again changes nothing
+// The CPU request and limit of the translated containers are removed, setRequestLimit provisions them from the pool policies
+// The names of the translated containers are returned
+func injectPoolResources(pod *corev1.Pod, class poolClass) []string {
+	if class.exclusivePool == "" && class.sharedPool == "" {
+		return nil
+	}
+	guaranteed := isGuaranteed(pod)
+	var injected []string
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		if hasPoolResources(c) {
+			continue
+		}
+		cpu, exists := c.Resources.Requests[corev1.ResourceCPU]
+		if !exists {
+			cpu, exists = c.Resources.Limits[corev1.ResourceCPU]
+		}
+		if !exists || cpu.IsZero() {
+			continue
+		}
+		var poolName string
+		var devices int64
+		if guaranteed && cpu.MilliValue()%1000 == 0 && class.exclusivePool != "" {
+			poolName, devices = class.exclusivePool, cpu.Value()
+		} else if class.sharedPool != "" {
+			poolName, devices = class.sharedPool, cpu.MilliValue()
+		} else {
+			continue
+		}
+		if c.Resources.Limits == nil {
+			c.Resources.Limits = corev1.ResourceList{}
+		}
+		if c.Resources.Requests == nil {
+			c.Resources.Requests = corev1.ResourceList{}
+		}
+		resourceName := corev1.ResourceName(resourceBaseName + "/" + poolName)
+		c.Resources.Limits[resourceName] = *resource.NewQuantity(devices, resource.DecimalSI)
+		c.Resources.Requests[resourceName] = *resource.NewQuantity(devices, resource.DecimalSI)
+		delete(c.Resources.Limits, corev1.ResourceCPU)
+		delete(c.Resources.Requests, corev1.ResourceCPU)
+		injected = append(injected, c.Name)
+	}
+	return injected
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func withPoolClassInjection(t *testing.T, namespaces ...*corev1.Namespace) {
+	kubeClient := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(kubeClient, 0)
+	for _, ns := range namespaces {
+		assert.Nil(t, factory.Core().V1().Namespaces().Informer().GetIndexer().Add(ns))
+	}
+	origInjection, origLister := poolClassInjection, namespaceLister
+	poolClassInjection, namespaceLister = true, factory.Core().V1().Namespaces().Lister()
+	t.Cleanup(func() {
+		poolClassInjection, namespaceLister = origInjection, origLister
+	})
+}
+
+func TestParsePoolClass(t *testing.T) {
+	assert := assert.New(t)
+	class, err := parsePoolClass("exclusive-pool1, shared-pool1")
+	assert.Nil(err)
+	assert.Equal(poolClass{exclusivePool: "exclusive-pool1", sharedPool: "shared-pool1"}, class)
+	class, err = parsePoolClass(PoolClassNone)
+	assert.Nil(err)
+	assert.Equal(poolClass{}, class)
+	_, err = parsePoolClass("exclusive-pool1,exclusive-pool2")
+	assert.NotNil(err)
+	_, err = parsePoolClass("default")
+	assert.NotNil(err)
+}
+
+func TestInjectPoolResources(t *testing.T) {
+	class := poolClass{exclusivePool: "exclusive-pool", sharedPool: "shared-pool"}
+	tests := []struct {
+		name         string
+		containers   []corev1.Container
+		wantLimits   map[string]string
+		wantInjected bool
+	}{
+		{
+			name:         "guaranteed integer",
+			containers:   []corev1.Container{poolContainer("app", map[string]string{"cpu": "2", "memory": "1Gi"}, nil)},
+			wantLimits:   map[string]string{"cmss.cn/exclusive-pool": "2", "memory": "1Gi"},
+			wantInjected: true,
+		},
+		{
+			name:         "guaranteed fraction",
+			containers:   []corev1.Container{poolContainer("app", map[string]string{"cpu": "1500m", "memory": "1Gi"}, nil)},
+			wantLimits:   map[string]string{"cmss.cn/shared-pool": "1500", "memory": "1Gi"},
+			wantInjected: true,
+		},
+		{
+			name:         "burstable integer",
+			containers:   []corev1.Container{poolContainer("app", map[string]string{"cpu": "2"}, map[string]string{"cpu": "1"})},
+			wantLimits:   map[string]string{"cmss.cn/shared-pool": "1k"},
+			wantInjected: true,
+		},
+		{
+			name:       "pool resources kept",
+			containers: []corev1.Container{poolContainer("app", map[string]string{"cpu": "2", "memory": "1Gi", "cmss.cn/exclusive-other": "1"}, nil)},
+			wantLimits: map[string]string{"cpu": "2", "memory": "1Gi", "cmss.cn/exclusive-other": "1"},
+		},
+		{
+			name:       "no cpu",
+			containers: []corev1.Container{poolContainer("app", map[string]string{"memory": "1Gi"}, nil)},
+			wantLimits: map[string]string{"memory": "1Gi"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: tt.containers}}
+			assert.Equal(tt.wantInjected, len(injectPoolResources(pod, class)) == 1)
+			limits := make(map[string]string)
+			for key, value := range pod.Spec.Containers[0].Resources.Limits {
+				limits[string(key)] = value.String()
+			}
+			assert.Equal(tt.wantLimits, limits)
+			if tt.wantInjected {
+				_, cpuRequested := pod.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU]
+				assert.False(cpuRequested)
+			}
+		})
+	}
+
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{poolContainer("app", map[string]string{"cpu": "1", "memory": "1Gi"}, nil)}}}
+	assert.Equal(t, []string{"app"}, injectPoolResources(pod, poolClass{sharedPool: "shared-pool"}))
+	assert.Equal(t, "1k", pod.Spec.Containers[0].Resources.Limits.Name("cmss.cn/shared-pool", "").String())
+	assert.Empty(t, injectPoolResources(pod, poolClass{sharedPool: "shared-pool"}))
+}
+
+func TestMutatePodsInjectsPoolResources(t *testing.T) {
+	assert := assert.New(t)
+	withTestPoolConfigs(t)
+	withPoolClassInjection(t,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "telco", Annotations: map[string]string{"cmss.cn/pool-class": "exclusive-cpupool1,sharedpool"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "broken", Annotations: map[string]string{"cmss.cn/pool-class": "default"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "plain"}},
+	)
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			poolContainer("app", map[string]string{"cpu": "1", "memory": "1Gi"}, nil),
+			poolContainer("sidecar", map[string]string{"cpu": "200m", "memory": "64Mi"}, nil),
+		}},
+	}
+	pod.Spec.Containers[0].Command = []string{"/bin/app"}
+
+	resp := mutatePodInNamespace(t, "telco", pod)
+	assert.True(resp.Allowed)
+	raw, err := json.Marshal(&pod)
+	assert.Nil(err)
+	decodedPatch, err := jsonpatch.DecodePatch(resp.Patch)
+	assert.Nil(err)
+	patched, err := decodedPatch.Apply(raw)
+	assert.Nil(err)
+	mutated := corev1.Pod{}
+	assert.Nil(json.Unmarshal(patched, &mutated))
+	app, sidecar := mutated.Spec.Containers[0], mutated.Spec.Containers[1]
+	assert.Equal("1", app.Resources.Limits.Name("cmss.cn/exclusive-cpupool1", "").String())
+	assert.Equal("1100m", app.Resources.Limits.Cpu().String())
+	assert.True(app.Resources.Requests.Cpu().IsZero())
+	assert.Equal([]string{processStarterPath}, app.Command)
+	assert.Equal("200", sidecar.Resources.Limits.Name("cmss.cn/sharedpool", "").String())
+	assert.Equal("200m", sidecar.Resources.Limits.Cpu().String())
+	assert.Empty(mutate(t, patched))
+	assert.Empty(validatePod(&mutated, defaultPolicy()))
+
+	resp = mutatePodInNamespace(t, "plain", pod)
+	assert.True(resp.Allowed)
+	assert.Empty(resp.Patch)
+
+	assert.False(mutatePodInNamespace(t, "broken", pod).Allowed)
+
+	pod.Annotations = map[string]string{"cmss.cn/pool-class": PoolClassNone}
+	resp = mutatePodInNamespace(t, "telco", pod)
+	assert.True(resp.Allowed)
+	assert.Empty(resp.Patch)
+}
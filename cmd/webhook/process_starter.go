@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// ProcessStarterInitContainerName is the name of the injected init container copying the process starter into the pod
+	ProcessStarterInitContainerName = "cpusets-process-starter"
+	// ProcessStarterVolumeName is the name of the emptyDir volume the process starter is copied to
+	ProcessStarterVolumeName = "cpusets-process-starter"
+	// ProcessStarterMountDir is where the emptyDir volume is mounted in the init container and in the pinned containers
+	ProcessStarterMountDir = "/opt/cpusets/bin"
+	// processStarterNonRootUID is the user the init container runs as, so it is admitted to namespaces enforcing the restricted Pod Security Standard
+	processStarterNonRootUID = 65534
+	// processStarterCPU and processStarterMemory are both the requests and the limits of the init container
+	// Requests equal to the limits keep the QoS class of Guaranteed pods, which the exclusive pools need
+	processStarterCPU    = "100m"
+	processStarterMemory = "32Mi"
+)
+
+var (
+	// version is the version of the webhook, set at build time with -ldflags "-X main.version=<version>"
+	version = "latest"
+	// processStarterImage enables the init container mode when set
+	processStarterImage string
+	// processStarterImageBinary is the path of the process starter binary inside processStarterImage
+	processStarterImageBinary = "/process-starter"
+)
+
+// initContainerMode tells if the process starter is injected with an init container instead of a hostPath volume
+func initContainerMode() bool {
+	return processStarterImage != ""
+}
+
+// processStarterCommand is the entrypoint of the pinned containers
+func processStarterCommand() string {
+	if initContainerMode() {
+		return path.Join(ProcessStarterMountDir, path.Base(processStarterImageBinary))
+	}
+	return processStarterPath
+}
+
+// processStarterImageRef returns the image of the init container
+// An image given without tag or digest is pinned to the version of the webhook, so the injected process starter always matches it
+func processStarterImageRef() string {
+	if strings.Contains(processStarterImage, "@") || strings.Contains(path.Base(processStarterImage), ":") {
+		return processStarterImage
+	}
+	return processStarterImage + ":" + version
+}
+
+// checkProcessStarterImageVersion warns when the process starter image is explicitly tagged with another version than the webhook's
+func checkProcessStarterImageVersion() {
+	if !initContainerMode() {
+		return
+	}
+	image := processStarterImageRef()
+	if strings.Contains(image, "@") {
+		return
+	}
+	if tag := image[strings.LastIndex(image, ":")+1:]; tag != version {
+		mainLogger.Warn("Process starter image version differs from the webhook version", logger.Any("image", image), logger.Any("version", version))
+	}
+}
+
+func processStarterInitContainer() corev1.Container {
+	nonRoot := true
+	noEscalation := false
+	uid := int64(processStarterNonRootUID)
+	resources := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(processStarterCPU),
+		corev1.ResourceMemory: resource.MustParse(processStarterMemory),
+	}
+	return corev1.Container{
+		Name:    ProcessStarterInitContainerName,
+		Image:   processStarterImageRef(),
+		Command: []string{"cp", processStarterImageBinary, processStarterCommand()},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: ProcessStarterVolumeName, MountPath: ProcessStarterMountDir},
+		},
+		Resources: corev1.ResourceRequirements{
+			Requests: resources,
+			Limits:   resources,
+		},
+		SecurityContext: &corev1.SecurityContext{
+			RunAsNonRoot:             &nonRoot,
+			RunAsUser:                &uid,
+			AllowPrivilegeEscalation: &noEscalation,
+			Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+			SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+		},
+	}
+}
+
+// setProcessStarterInitContainer puts the init container first, so the binary is in place before any other container starts
+// An already injected init container is updated in place
+func setProcessStarterInitContainer(pod *corev1.Pod) {
+	initContainer := processStarterInitContainer()
+	for i := range pod.Spec.InitContainers {
+		if pod.Spec.InitContainers[i].Name == ProcessStarterInitContainerName {
+			pod.Spec.InitContainers[i] = initContainer
+			return
+		}
+	}
+	pod.Spec.InitContainers = append([]corev1.Container{initContainer}, pod.Spec.InitContainers...)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func withProcessStarterImage(t *testing.T, image string) {
+	origImage, origVersion := processStarterImage, version
+	processStarterImage, version = image, "v1.2.3"
+	t.Cleanup(func() {
+		processStarterImage, version = origImage, origVersion
+	})
+}
+
+func TestProcessStarterImageRef(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "registry:5000/cpusets/process-starter", want: "registry:5000/cpusets/process-starter:v1.2.3"},
+		{image: "process-starter:v1.0.0", want: "process-starter:v1.0.0"},
+		{image: "process-starter@sha256:0123", want: "process-starter@sha256:0123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			withProcessStarterImage(t, tt.image)
+			assert.Equal(t, tt.want, processStarterImageRef())
+		})
+	}
+}
+
+func TestMutatePodsInjectsProcessStarterInitContainer(t *testing.T) {
+	assert := assert.New(t)
+	withProcessStarterImage(t, "cpusets/process-starter")
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "setup", Image: "busybox"}},
+			Containers: []corev1.Container{{
+				Name:    "app",
+				Command: []string{"/bin/app"},
+				Resources: corev1.ResourceRequirements{
+					Limits: corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse("1")},
+				},
+			}},
+		},
+	}
+	raw, err := json.Marshal(&pod)
+	assert.Nil(err)
+	decodedPatch, err := jsonpatch.DecodePatch(mutate(t, raw))
+	assert.Nil(err)
+	patched, err := decodedPatch.Apply(raw)
+	assert.Nil(err)
+
+	mutated := corev1.Pod{}
+	assert.Nil(json.Unmarshal(patched, &mutated))
+	assert.Len(mutated.Spec.InitContainers, 2)
+	initContainer := mutated.Spec.InitContainers[0]
+	assert.Equal(ProcessStarterInitContainerName, initContainer.Name)
+	assert.Equal("cpusets/process-starter:v1.2.3", initContainer.Image)
+	assert.Equal([]string{"cp", "/process-starter", "/opt/cpusets/bin/process-starter"}, initContainer.Command)
+	assert.False(*initContainer.SecurityContext.AllowPrivilegeEscalation)
+	assert.True(*initContainer.SecurityContext.RunAsNonRoot)
+	assert.Equal("100m", initContainer.Resources.Requests.Cpu().String())
+	assert.Equal("32Mi", initContainer.Resources.Requests.Memory().String())
+	assert.Equal(initContainer.Resources.Requests, initContainer.Resources.Limits)
+
+	app := mutated.Spec.Containers[0]
+	assert.Equal([]string{"/opt/cpusets/bin/process-starter"}, app.Command)
+	assert.Equal([]string{"/bin/app"}, app.Args)
+	assert.Contains(app.VolumeMounts, corev1.VolumeMount{Name: ProcessStarterVolumeName, MountPath: ProcessStarterMountDir, ReadOnly: true})
+	for _, volume := range mutated.Spec.Volumes {
+		assert.Nil(volume.HostPath)
+	}
+
+	assert.Empty(mutate(t, patched))
+}
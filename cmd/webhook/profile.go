@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	cpusetsv1alpha1 "github.com/kubeservice-stack/cpusets-controller/pkg/apis/cpusets/v1alpha1"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// pinningProfiles enables resolving the CPUPinningProfiles referenced by the pods
+	pinningProfiles bool
+	// profileLister reads the CPUPinningProfiles, nil when they are not enabled
+	profileLister cache.GenericLister
+)
+
+// cpusProfileAnnotationName is the pod annotation naming the CPUPinningProfile of its namespace the cpus annotation is resolved from
+func cpusProfileAnnotationName() string {
+	return resourceBaseName + "/cpus-profile"
+}
+
+// cpusProfileRevisionAnnotationName is the pod annotation recording the generation of the CPUPinningProfile the cpus annotation was resolved from
+func cpusProfileRevisionAnnotationName() string {
+	return resourceBaseName + "/cpus-profile-revision"
+}
+
+// profileAnnotation is the v2 cpus annotation holding the containers of a CPUPinningProfile in their order
+// Decoding it validates the processes, and the errors point at their place in the profile
+type profileAnnotation struct {
+	APIVersion string            `json:"apiVersion"`
+	Containers []types.Container `json:"containers"`
+}
+
+// getPinningProfile returns the CPUPinningProfile of the namespace
+func getPinningProfile(namespace, name string) (*cpusetsv1alpha1.CPUPinningProfile, error) {
+	if profileLister == nil {
+		return nil, errors.New("CPUPinningProfiles are not enabled in the webhook")
+	}
+	obj, err := profileLister.ByNamespace(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+	profile := &cpusetsv1alpha1.CPUPinningProfile{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// resolvePinningProfile sets the cpus annotation of the pod to the processes of the CPUPinningProfile it references,
+// and records the generation of the profile, so the pod keeps running what was admitted when the profile changes
+// The resolved annotation is validated against the pool requests of the pod like an inline one
+// A pod giving an inline cpus annotation next to a profile is rejected, unless the annotation was resolved by an earlier invocation
+func resolvePinningProfile(pod *corev1.Pod, namespace string, poolRequests poolRequestMap) error {
+	profileName, exists := pod.Annotations[cpusProfileAnnotationName()]
+	if !exists {
+		return nil
+	}
+	if _, inline := pod.Annotations[annotationNameFromConfig()]; inline {
+		if _, resolved := pod.Annotations[cpusProfileRevisionAnnotationName()]; !resolved {
+			return fmt.Errorf("%s and %s annotations cannot be given together", annotationNameFromConfig(), cpusProfileAnnotationName())
+		}
+	}
+	profile, err := getPinningProfile(namespace, profileName)
+	if err != nil {
+		return fmt.Errorf("CPUPinningProfile %s cannot be read: %w", profileName, err)
+	}
+	value, err := json.Marshal(profileAnnotation{APIVersion: types.CPUAnnotationV2, Containers: profile.Spec.Containers})
+	if err != nil {
+		return fmt.Errorf("CPUPinningProfile %s cannot be encoded: %w", profileName, err)
+	}
+	cpuAnnotation := types.NewCPUAnnotation()
+	if err = cpuAnnotation.Decode(value); err != nil {
+		return fmt.Errorf("CPUPinningProfile %s: %w", profileName, err)
+	}
+	if err = validateAnnotation(poolRequests, cpuAnnotation); err != nil {
+		return fmt.Errorf("CPUPinningProfile %s: %w", profileName, err)
+	}
+	if value, err = cpuAnnotation.Encode(); err != nil {
+		return fmt.Errorf("CPUPinningProfile %s cannot be encoded: %w", profileName, err)
+	}
+	pod.Annotations[annotationNameFromConfig()] = string(value)
+	pod.Annotations[cpusProfileRevisionAnnotationName()] = strconv.FormatInt(profile.Generation, 10)
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+
+	cpusetsv1alpha1 "github.com/kubeservice-stack/cpusets-controller/pkg/apis/cpusets/v1alpha1"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func pinningProfile(t *testing.T, name, namespace string, generation int64, containers ...types.Container) runtime.Object {
+	profile := &cpusetsv1alpha1.CPUPinningProfile{
+		TypeMeta:   metav1.TypeMeta{APIVersion: cpusetsv1alpha1.SchemeGroupVersion.String(), Kind: "CPUPinningProfile"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Generation: generation},
+		Spec:       cpusetsv1alpha1.CPUPinningProfileSpec{Containers: containers},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(profile)
+	assert.Nil(t, err)
+	return &unstructured.Unstructured{Object: content}
+}
+
+// withProfiles serves the CPUPinningProfiles from an informer on a fake client for the test
+func withProfiles(t *testing.T, profiles ...runtime.Object) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{cpusetsv1alpha1.CPUPinningProfileResource: "CPUPinningProfileList"}, profiles...)
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	informer := factory.ForResource(cpusetsv1alpha1.CPUPinningProfileResource)
+	stopCh := make(chan struct{})
+	factory.Start(stopCh)
+	for _, synced := range factory.WaitForCacheSync(stopCh) {
+		assert.True(t, synced)
+	}
+	origLister := profileLister
+	profileLister = informer.Lister()
+	t.Cleanup(func() {
+		close(stopCh)
+		profileLister = origLister
+	})
+}
+
+func profilePod(annotations map[string]string) corev1.Pod {
+	return corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:      "app",
+			Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse("1")}},
+		}}},
+	}
+}
+
+func TestMutatePodsResolvesPinningProfile(t *testing.T) {
+	assert := assert.New(t)
+	withPoolConfig(t, testPoolConfig)
+	withProfiles(t, pinningProfile(t, "dpdk", "telco", 3, types.Container{
+		Name:      "app",
+		Processes: []types.Process{{ProcName: "/bin/app", Args: []string{"-v"}, CPUs: 1, PoolName: "exclusive-pool"}},
+	}))
+	pod := profilePod(map[string]string{"cmss.cn/cpus-profile": "dpdk"})
+	raw, err := json.Marshal(&pod)
+	assert.Nil(err)
+	resp := mutatePods(&admissionv1.AdmissionRequest{Resource: podResource, Namespace: "telco", Object: runtime.RawExtension{Raw: raw}})
+	assert.True(resp.Allowed, resp.Result)
+	decodedPatch, err := jsonpatch.DecodePatch(resp.Patch)
+	assert.Nil(err)
+	patched, err := decodedPatch.Apply(raw)
+	assert.Nil(err)
+	mutated := corev1.Pod{}
+	assert.Nil(json.Unmarshal(patched, &mutated))
+
+	assert.Equal("3", mutated.Annotations["cmss.cn/cpus-profile-revision"])
+	cpuAnnotation := types.NewCPUAnnotation()
+	assert.Nil(cpuAnnotation.Decode([]byte(mutated.Annotations["cmss.cn/cpus"])))
+	assert.Equal([]string{"-v"}, cpuAnnotation["app"].Processes[0].Args)
+	assert.Contains(mutated.Spec.Containers[0].Command[0], "process-starter")
+
+	//the resolved annotation is not a conflict, so the webhook is idempotent
+	resp = mutatePods(&admissionv1.AdmissionRequest{Resource: podResource, Namespace: "telco", Object: runtime.RawExtension{Raw: patched}})
+	assert.True(resp.Allowed, resp.Result)
+	assert.Empty(resp.Patch)
+}
+
+func TestMutatePodsRejectsInvalidPinningProfile(t *testing.T) {
+	withPoolConfig(t, testPoolConfig)
+	withProfiles(t,
+		pinningProfile(t, "too-many-cpus", "telco", 1, types.Container{
+			Name:      "app",
+			Processes: []types.Process{{ProcName: "/bin/app", CPUs: 3, PoolName: "exclusive-pool"}},
+		}),
+		pinningProfile(t, "other-container", "telco", 1, types.Container{
+			Name:      "sidecar",
+			Processes: []types.Process{{ProcName: "/bin/app", CPUs: 1, PoolName: "exclusive-pool"}},
+		}),
+		pinningProfile(t, "no-processes", "telco", 1, types.Container{Name: "app"}),
+	)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		message     string
+	}{
+		{"missing profile", map[string]string{"cmss.cn/cpus-profile": "missing"}, "CPUPinningProfile missing cannot be read"},
+		{"too many CPUs", map[string]string{"cmss.cn/cpus-profile": "too-many-cpus"}, "CPUPinningProfile too-many-cpus: Exclusive CPU requests"},
+		{"unknown container", map[string]string{"cmss.cn/cpus-profile": "other-container"}, "CPUPinningProfile other-container: Container sidecar has no pool requests"},
+		{"no processes", map[string]string{"cmss.cn/cpus-profile": "no-processes"}, "CPUPinningProfile no-processes: containers[0]: " + types.ErrNoProcesses.Error()},
+		{"inline annotation next to the profile", map[string]string{
+			"cmss.cn/cpus-profile": "too-many-cpus",
+			"cmss.cn/cpus":         `[{"container":"app","processes":[{"process":"/bin/app","cpus":1,"pool":"exclusive-pool"}]}]`,
+		}, "cmss.cn/cpus and cmss.cn/cpus-profile annotations cannot be given together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := mutatePodInNamespace(t, "telco", profilePod(tt.annotations))
+			assert.False(t, resp.Allowed)
+			assert.Equal(t, metav1.StatusReasonInvalid, resp.Result.Reason)
+			assert.Contains(t, resp.Result.Message, tt.message)
+		})
+	}
+}
+
+func TestResolvePinningProfileNeedsProfilesEnabled(t *testing.T) {
+	pod := profilePod(map[string]string{"cmss.cn/cpus-profile": "dpdk"})
+	err := resolvePinningProfile(&pod, "telco", poolRequestMap{})
+	assert.EqualError(t, err, "CPUPinningProfile dpdk cannot be read: CPUPinningProfiles are not enabled in the webhook")
+
+	pod = profilePod(nil)
+	assert.Nil(t, resolvePinningProfile(&pod, "telco", poolRequestMap{}))
+}
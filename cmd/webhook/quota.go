@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	cpusetsv1alpha1 "github.com/kubeservice-stack/cpusets-controller/pkg/apis/cpusets/v1alpha1"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	k8sclient "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// quotaStatusPeriod is how often the usage in the status of the CPUQuotas is refreshed
+const quotaStatusPeriod = 10 * time.Second
+
+var (
+	// cpuQuotaEnforcement enables the CPUQuotas
+	cpuQuotaEnforcement bool
+	// cpuQuotas tracks the usage of the namespaces, nil when the CPUQuotas are not enforced
+	cpuQuotas *quotaTracker
+)
+
+// podPoolUsage returns the pool resources held by the pod, by pool type
+// Exclusive pools are counted in CPUs, shared pools in millicores
+// Init containers run one after the other before the application containers, so the largest of them and the sum of the application containers is held
+// An error is returned when the CPUs per device of an exclusive pool are not known, its devices are counted as one CPU each then
+func podPoolUsage(pod *corev1.Pod) (map[string]int64, error) {
+	var usageErr error
+	containerUsage := func(c corev1.Container) map[string]int64 {
+		usage := make(map[string]int64)
+		for key, limit := range c.Resources.Limits {
+			if !strings.HasPrefix(string(key), resourceBaseName+"/") {
+				continue
+			}
+			poolName := strings.TrimPrefix(string(key), resourceBaseName+"/")
+			switch types.DeterminePoolType(poolName) {
+			case types.ExclusivePoolID:
+				cpus, err := exclusiveCPUs(poolName, int(limit.Value()))
+				if err != nil {
+					cpus, usageErr = int(limit.Value()), err
+				}
+				usage[types.ExclusivePoolID] += int64(cpus)
+			case types.SharedPoolID:
+				usage[types.SharedPoolID] += limit.Value()
+			}
+		}
+		return usage
+	}
+	usage := make(map[string]int64)
+	for _, c := range pod.Spec.Containers {
+		for poolType, value := range containerUsage(c) {
+			usage[poolType] += value
+		}
+	}
+	for _, c := range pod.Spec.InitContainers {
+		for poolType, value := range containerUsage(c) {
+			if value > usage[poolType] {
+				usage[poolType] = value
+			}
+		}
+	}
+	return usage, usageErr
+}
+
+// quotaTracker keeps the pods and the CPUQuotas of the cluster in memory to enforce the quotas, and to show the usage in their status
+type quotaTracker struct {
+	dynamicClient dynamic.Interface
+	podFactory    informers.SharedInformerFactory
+	quotaFactory  dynamicinformer.DynamicSharedInformerFactory
+	podInformer   cache.SharedIndexInformer
+	quotaInformer cache.SharedIndexInformer
+}
+
+func newQuotaTracker(kubeClient k8sclient.Interface, dynamicClient dynamic.Interface) *quotaTracker {
+	qt := &quotaTracker{
+		dynamicClient: dynamicClient,
+		podFactory:    informers.NewSharedInformerFactory(kubeClient, 0),
+		quotaFactory:  dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0),
+	}
+	qt.podInformer = qt.podFactory.Core().V1().Pods().Informer()
+	qt.quotaInformer = qt.quotaFactory.ForResource(cpusetsv1alpha1.CPUQuotaResource).Informer()
+	return qt
+}
+
+// start runs the informers, and waits until they are synced
+func (qt *quotaTracker) start(stopCh <-chan struct{}) bool {
+	qt.podFactory.Start(stopCh)
+	qt.quotaFactory.Start(stopCh)
+	return cache.WaitForCacheSync(stopCh, qt.podInformer.HasSynced, qt.quotaInformer.HasSynced)
+}
+
+// usage returns the pool resources held by the pods of the namespace which are not terminated yet
+func (qt *quotaTracker) usage(namespace string) map[string]int64 {
+	usage := map[string]int64{types.ExclusivePoolID: 0, types.SharedPoolID: 0}
+	objs, err := qt.podInformer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		mainLogger.Error("Cannot list the pods of the namespace", logger.Any("namespace", namespace), logger.Error(err))
+		return usage
+	}
+	for _, obj := range objs {
+		pod := obj.(*corev1.Pod)
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		podUsage, err := podPoolUsage(pod)
+		if err != nil {
+			mainLogger.Warn("Exclusive devices of the pod are counted as one CPU each", logger.Any("namespace", namespace), logger.Any("pod", pod.Name), logger.Error(err))
+		}
+		for poolType, value := range podUsage {
+			usage[poolType] += value
+		}
+	}
+	return usage
+}
+
+// quotas returns the CPUQuotas of the namespace, ordered by name
+func (qt *quotaTracker) quotas(namespace string) []*cpusetsv1alpha1.CPUQuota {
+	objs, err := qt.quotaInformer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		mainLogger.Error("Cannot list the CPUQuotas of the namespace", logger.Any("namespace", namespace), logger.Error(err))
+		return nil
+	}
+	var quotas []*cpusetsv1alpha1.CPUQuota
+	for _, obj := range objs {
+		quota := &cpusetsv1alpha1.CPUQuota{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.(*unstructured.Unstructured).Object, quota); err != nil {
+			mainLogger.Error("Invalid CPUQuota", logger.Any("namespace", namespace), logger.Error(err))
+			continue
+		}
+		quotas = append(quotas, quota)
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Name < quotas[j].Name })
+	return quotas
+}
+
+// check returns an error when the pod does not fit into a CPUQuota of the namespace next to the pods already there
+// The pods are counted from the informer, so pods created at the same time can overstep the quota until the status catches up
+func (qt *quotaTracker) check(pod *corev1.Pod, namespace string) error {
+	quotas := qt.quotas(namespace)
+	if len(quotas) == 0 {
+		return nil
+	}
+	requested, err := podPoolUsage(pod)
+	if err != nil {
+		return err
+	}
+	if len(requested) == 0 {
+		return nil
+	}
+	used := qt.usage(namespace)
+	for _, quota := range quotas {
+		for _, poolType := range []string{types.ExclusivePoolID, types.SharedPoolID} {
+			hard, limited := quota.Spec.Hard[poolType]
+			if limited && requested[poolType] > 0 && used[poolType]+requested[poolType] > hard {
+				return fmt.Errorf("pod requests %d %s pool resources, but namespace %s already uses %d of the %d allowed by CPUQuota %s",
+					requested[poolType], poolType, namespace, used[poolType], hard, quota.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// updateStatuses writes the limits and the current usage of the namespaces into the status of their CPUQuotas
+func (qt *quotaTracker) updateStatuses(ctx context.Context) {
+	for _, obj := range qt.quotaInformer.GetIndexer().List() {
+		u := obj.(*unstructured.Unstructured)
+		quota := &cpusetsv1alpha1.CPUQuota{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, quota); err != nil {
+			mainLogger.Error("Invalid CPUQuota", logger.Any("namespace", u.GetNamespace()), logger.Any("name", u.GetName()), logger.Error(err))
+			continue
+		}
+		status := cpusetsv1alpha1.CPUQuotaStatus{Hard: quota.Spec.Hard, Used: qt.usage(quota.Namespace)}
+		if reflect.DeepEqual(status, quota.Status) {
+			continue
+		}
+		quota.Status = status
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(quota)
+		if err != nil {
+			mainLogger.Error("Cannot convert CPUQuota", logger.Any("namespace", quota.Namespace), logger.Any("name", quota.Name), logger.Error(err))
+			continue
+		}
+		_, err = qt.dynamicClient.Resource(cpusetsv1alpha1.CPUQuotaResource).Namespace(quota.Namespace).
+			UpdateStatus(ctx, &unstructured.Unstructured{Object: content}, metav1.UpdateOptions{})
+		if err != nil {
+			mainLogger.Warn("Cannot update the status of the CPUQuota", logger.Any("namespace", quota.Namespace), logger.Any("name", quota.Name), logger.Error(err))
+		}
+	}
+}
+
+// runStatusUpdates refreshes the status of the CPUQuotas periodically until stopCh is closed
+func (qt *quotaTracker) runStatusUpdates(stopCh <-chan struct{}) {
+	wait.Until(func() { qt.updateStatuses(context.Background()) }, quotaStatusPeriod, stopCh)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	cpusetsv1alpha1 "github.com/kubeservice-stack/cpusets-controller/pkg/apis/cpusets/v1alpha1"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func quotaPod(name, namespace string, phase corev1.PodPhase, containers ...corev1.Container) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       corev1.PodSpec{Containers: containers},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+func cpuQuota(t *testing.T, name, namespace string, hard map[string]int64) *unstructured.Unstructured {
+	quota := &cpusetsv1alpha1.CPUQuota{
+		TypeMeta:   metav1.TypeMeta{APIVersion: cpusetsv1alpha1.SchemeGroupVersion.String(), Kind: "CPUQuota"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       cpusetsv1alpha1.CPUQuotaSpec{Hard: hard},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(quota)
+	assert.Nil(t, err)
+	return &unstructured.Unstructured{Object: content}
+}
+
+// withQuotaTracker starts a tracker on fake clients holding the objects, and enforces it for the test
+func withQuotaTracker(t *testing.T, pods []runtime.Object, quotas ...runtime.Object) *quotaTracker {
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{cpusetsv1alpha1.CPUQuotaResource: "CPUQuotaList"}, quotas...)
+	tracker := newQuotaTracker(fake.NewSimpleClientset(pods...), dynamicClient)
+	stopCh := make(chan struct{})
+	assert.True(t, tracker.start(stopCh))
+	origQuotas := cpuQuotas
+	cpuQuotas = tracker
+	t.Cleanup(func() {
+		close(stopCh)
+		cpuQuotas = origQuotas
+	})
+	return tracker
+}
+
+func TestPodPoolUsage(t *testing.T) {
+	withTestPoolConfigs(t)
+	pod := quotaPod("app", "default", corev1.PodRunning,
+		poolContainer("a", map[string]string{"cmss.cn/exclusive-cpupool1": "2", "cmss.cn/exclusive-cpupool2": "1"}, nil),
+		poolContainer("b", map[string]string{"cmss.cn/sharedpool": "300", "cmss.cn/default": "100", "memory": "1Gi"}, nil),
+	)
+	pod.Spec.InitContainers = []corev1.Container{
+		poolContainer("init1", map[string]string{"cmss.cn/exclusive-cpupool1": "4"}, nil),
+		poolContainer("init2", map[string]string{"cmss.cn/sharedpool": "200"}, nil),
+	}
+	usage, err := podPoolUsage(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"exclusive": 4, "shared": 300}, usage)
+	usage, err = podPoolUsage(quotaPod("plain", "default", corev1.PodRunning, corev1.Container{Name: "c"}))
+	assert.Nil(t, err)
+	assert.Empty(t, usage)
+}
+
+func TestPodPoolUsageCountsCPUsPerDevice(t *testing.T) {
+	withPoolConfig(t, "pools:\n  exclusive-cores:\n    cpus: \"2-9\"\n    hyperThreadingPolicy: physicalCore\n    threadsPerCore: 2\n")
+	pod := quotaPod("app", "default", corev1.PodRunning,
+		poolContainer("a", map[string]string{"cmss.cn/exclusive-cores": "2"}, nil),
+		poolContainer("b", map[string]string{"cmss.cn/exclusive-unknown": "1"}, nil),
+	)
+	usage, err := podPoolUsage(pod)
+	assert.EqualError(t, err, "pool exclusive-unknown is not configured on any node")
+	assert.Equal(t, map[string]int64{"exclusive": 5}, usage)
+}
+
+func TestQuotaTrackerUsageSkipsTerminatedPods(t *testing.T) {
+	withTestPoolConfigs(t)
+	tracker := withQuotaTracker(t, []runtime.Object{
+		quotaPod("running", "team-a", corev1.PodRunning, poolContainer("c", map[string]string{"cmss.cn/exclusive-cpupool1": "2"}, nil)),
+		quotaPod("pending", "team-a", corev1.PodPending, poolContainer("c", map[string]string{"cmss.cn/sharedpool": "500"}, nil)),
+		quotaPod("done", "team-a", corev1.PodSucceeded, poolContainer("c", map[string]string{"cmss.cn/exclusive-cpupool2": "2"}, nil)),
+		quotaPod("failed", "team-a", corev1.PodFailed, poolContainer("c", map[string]string{"cmss.cn/exclusive-cpupool2": "2"}, nil)),
+		quotaPod("other", "team-b", corev1.PodRunning, poolContainer("c", map[string]string{"cmss.cn/exclusive-cpupool2": "1"}, nil)),
+	})
+	assert.Equal(t, map[string]int64{"exclusive": 2, "shared": 500}, tracker.usage("team-a"))
+	assert.Equal(t, map[string]int64{"exclusive": 1, "shared": 0}, tracker.usage("team-b"))
+	assert.Equal(t, map[string]int64{"exclusive": 0, "shared": 0}, tracker.usage("team-c"))
+}
+
+func TestQuotaTrackerCheck(t *testing.T) {
+	withTestPoolConfigs(t)
+	tracker := withQuotaTracker(t,
+		[]runtime.Object{
+			quotaPod("running", "team-a", corev1.PodRunning, poolContainer("c", map[string]string{"cmss.cn/exclusive-cpupool1": "2", "cmss.cn/sharedpool": "500"}, nil)),
+		},
+		cpuQuota(t, "cpus", "team-a", map[string]int64{"exclusive": 4}),
+		cpuQuota(t, "millicores", "team-a", map[string]int64{"shared": 1000}),
+	)
+	tests := []struct {
+		name   string
+		limits map[string]string
+		err    string
+	}{
+		{"fits into the exclusive quota across pools", map[string]string{"cmss.cn/exclusive-cpupool1": "1", "cmss.cn/exclusive-cpupool2": "1"}, ""},
+		{"exceeds the exclusive quota", map[string]string{"cmss.cn/exclusive-cpupool2": "3"},
+			"pod requests 3 exclusive pool resources, but namespace team-a already uses 2 of the 4 allowed by CPUQuota cpus"},
+		{"fits into the shared quota", map[string]string{"cmss.cn/sharedpool": "500"}, ""},
+		{"exceeds the shared quota", map[string]string{"cmss.cn/sharedpool": "600"},
+			"pod requests 600 shared pool resources, but namespace team-a already uses 500 of the 1000 allowed by CPUQuota millicores"},
+		{"does not request pool resources", map[string]string{"memory": "1Gi"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tracker.check(quotaPod("new", "team-a", "", poolContainer("c", tt.limits, nil)), "team-a")
+			if tt.err == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+		})
+	}
+	//namespaces without quotas are not limited
+	assert.Nil(t, tracker.check(quotaPod("new", "team-b", "", poolContainer("c", map[string]string{"cmss.cn/exclusive-cpupool1": "100"}, nil)), "team-b"))
+}
+
+func TestValidatePodsEnforcesCPUQuotas(t *testing.T) {
+	assert := assert.New(t)
+	withTestPoolConfigs(t)
+	withQuotaTracker(t,
+		[]runtime.Object{
+			quotaPod("running", "team-a", corev1.PodRunning, poolContainer("c", map[string]string{"cmss.cn/exclusive-cpupool1": "1"}, nil)),
+		},
+		cpuQuota(t, "cpus", "team-a", map[string]int64{"exclusive": 2}),
+	)
+	pod := quotaPod("new", "team-a", "", poolContainer("c", map[string]string{"cmss.cn/exclusive-cpupool2": "2"}, nil))
+	raw, err := json.Marshal(pod)
+	assert.Nil(err)
+	req := &admissionv1.AdmissionRequest{Resource: podResource, Namespace: "team-a", Operation: admissionv1.Create, Object: runtime.RawExtension{Raw: raw}}
+	resp := validatePods(req)
+	assert.False(resp.Allowed)
+	assert.Equal(metav1.StatusReasonForbidden, resp.Result.Reason)
+	assert.Contains(resp.Result.Message, "CPUQuota cpus")
+
+	//updates of existing pods do not take more CPUs
+	req.Operation = admissionv1.Update
+	assert.True(validatePods(req).Allowed)
+}
+
+func TestQuotaTrackerUpdatesStatuses(t *testing.T) {
+	assert := assert.New(t)
+	tracker := withQuotaTracker(t,
+		[]runtime.Object{
+			quotaPod("running", "team-a", corev1.PodRunning, poolContainer("c", map[string]string{"cmss.cn/exclusive-cpupool1": "2", "cmss.cn/sharedpool": "250"}, nil)),
+		},
+		cpuQuota(t, "cpus", "team-a", map[string]int64{"exclusive": 4, "shared": 1000}),
+	)
+	tracker.updateStatuses(context.TODO())
+	assert.Eventually(func() bool {
+		quotas := tracker.quotas("team-a")
+		return len(quotas) == 1 && quotas[0].Status.Used != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	status := tracker.quotas("team-a")[0].Status
+	assert.Equal(map[string]int64{"exclusive": 4, "shared": 1000}, status.Hard)
+	assert.Equal(map[string]int64{"exclusive": 2, "shared": 250}, status.Used)
+}
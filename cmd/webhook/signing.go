@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"os"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	// annotationSigningKeyFile is the PEM file of the ed25519 key the approved cpus annotations are signed with, they are not signed when it is not set
+	annotationSigningKeyFile string
+	annotationSigningKey     ed25519.PrivateKey
+)
+
+// cpusSignatureAnnotationName is the annotation holding the signature of the approved cpus annotation
+func cpusSignatureAnnotationName() string {
+	return annotationNameFromConfig() + "-signature"
+}
+
+func loadAnnotationSigningKey() error {
+	buf, err := os.ReadFile(annotationSigningKeyFile)
+	if err != nil {
+		return err
+	}
+	annotationSigningKey, err = types.ParseSigningKey(buf)
+	return err
+}
+
+// setEnvFromField sets the environment variable of the container to a field of the pod, adding it if it does not exist yet
+func setEnvFromField(c *corev1.Container, name, fieldPath string) {
+	valueFrom := &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: fieldPath}}
+	for i := range c.Env {
+		if c.Env[i].Name == name {
+			c.Env[i].Value = ""
+			c.Env[i].ValueFrom = valueFrom
+			return
+		}
+	}
+	c.Env = append(c.Env, corev1.EnvVar{Name: name, ValueFrom: valueFrom})
+}
+
+// setContainerForVerification gives the process starter the namespace the cpus annotation is verified in, and requires it to verify the annotation
+// The public key is not given, the process starter is built with it: one taken from the pod spec would be chosen by the author of the pod
+// A process starter having the key refuses to start the processes of an annotation which is not signed, or was changed after admission,
+// one without key refuses every annotation
+func setContainerForVerification(c *corev1.Container) {
+	if annotationSigningKey == nil {
+		return
+	}
+	setEnvFromField(c, types.PodNamespaceEnv, "metadata.namespace")
+	setEnv(c, types.AnnotationSignatureRequiredEnv, "true")
+}
+
+// annotationPublicKey returns the public key the process starter has to be built with to verify the signed annotations
+func annotationPublicKey() string {
+	return types.EncodePublicKey(annotationSigningKey.Public().(ed25519.PublicKey))
+}
+
+// setCPUAnnotationSignature signs the cpus annotation approved by the webhook, and drops a signature given without annotation
+func setCPUAnnotationSignature(pod *corev1.Pod, namespace string) {
+	if annotationSigningKey == nil {
+		return
+	}
+	value, exists := pod.Annotations[annotationNameFromConfig()]
+	if !exists {
+		delete(pod.Annotations, cpusSignatureAnnotationName())
+		return
+	}
+	pod.Annotations[cpusSignatureAnnotationName()] = types.SignCPUAnnotation(annotationSigningKey, namespace, value)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func withAnnotationSigningKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	origKey := annotationSigningKey
+	annotationSigningKey = key
+	t.Cleanup(func() {
+		annotationSigningKey = origKey
+	})
+}
+
+func TestMutatePodsSignsCPUAnnotation(t *testing.T) {
+	assert := assert.New(t)
+	withAnnotationSigningKey(t)
+	withPoolConfig(t, testPoolConfig)
+	annotation := `[{"container":"app","processes":[{"process":"/bin/app","cpus":1,"pool":"exclusive-pool"}]}]`
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			"cmss.cn/cpus":           annotation,
+			"cmss.cn/cpus-signature": "forged",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:      "app",
+			Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse("1")}},
+		}}},
+	}
+	raw, err := json.Marshal(&pod)
+	assert.Nil(err)
+	resp := mutatePods(&admissionv1.AdmissionRequest{Resource: podResource, Namespace: "telco", Object: runtime.RawExtension{Raw: raw}})
+	assert.True(resp.Allowed)
+	decodedPatch, err := jsonpatch.DecodePatch(resp.Patch)
+	assert.Nil(err)
+	patched, err := decodedPatch.Apply(raw)
+	assert.Nil(err)
+	mutated := corev1.Pod{}
+	assert.Nil(json.Unmarshal(patched, &mutated))
+
+	env := make(map[string]corev1.EnvVar)
+	for _, e := range mutated.Spec.Containers[0].Env {
+		env[e.Name] = e
+	}
+	assert.Equal("metadata.namespace", env[types.PodNamespaceEnv].ValueFrom.FieldRef.FieldPath)
+	assert.Equal("true", env[types.AnnotationSignatureRequiredEnv].Value)
+	_, keyInPod := env["CPUSETS_ANNOTATION_PUBLIC_KEY"]
+	assert.False(keyInPod)
+	signature := mutated.Annotations["cmss.cn/cpus-signature"]
+	assert.Nil(types.VerifyCPUAnnotation(annotationPublicKey(), "telco", annotation, signature))
+
+	resp = mutatePods(&admissionv1.AdmissionRequest{Resource: podResource, Namespace: "telco", Object: runtime.RawExtension{Raw: patched}})
+	assert.True(resp.Allowed)
+	assert.Empty(resp.Patch)
+}
+
+func TestSetCPUAnnotationSignatureDropsSignatureWithoutAnnotation(t *testing.T) {
+	withAnnotationSigningKey(t)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"cmss.cn/cpus-signature": "forged"}}}
+	setCPUAnnotationSignature(pod, "telco")
+	assert.Empty(t, pod.Annotations)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// poolCapacity returns the number of devices the pool advertises on a node
+func poolCapacity(poolName string, pool types.Pool) int {
+	if types.DeterminePoolType(poolName) == types.SharedPoolID {
+		return pool.CPUset.Size() * 1000
+	}
+	if pool.HTPolicy == types.PhysicalCoreHTPolicy {
+		return pool.CPUset.Size() / pool.CPUsPerDevice()
+	}
+	return pool.CPUset.Size()
+}
+
+// maxPoolCapacities returns the largest capacity of every pool across all the pool configs
+func maxPoolCapacities(poolConfs []types.PoolConfig) map[string]int {
+	capacities := make(map[string]int)
+	for _, poolConf := range poolConfs {
+		for poolName, pool := range poolConf.Pools {
+			if capacity := poolCapacity(poolName, pool); capacity > capacities[poolName] {
+				capacities[poolName] = capacity
+			}
+		}
+	}
+	return capacities
+}
+
+// validatePoolResources checks the pool resources of the containers against the pool configs of the cluster
+// capacities is nil when the pool configs are not available, in which case only the pod itself is checked
+func validatePoolResources(pod *corev1.Pod, capacities map[string]int) []string {
+	var problems []string
+	initRequests, appRequests := make(map[string]int64), make(map[string]int64)
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for i, c := range containers {
+		for key, limit := range c.Resources.Limits {
+			if !strings.HasPrefix(string(key), resourceBaseName+"/") {
+				continue
+			}
+			poolName := strings.TrimPrefix(string(key), resourceBaseName+"/")
+			if _, exists := capacities[poolName]; capacities != nil && !exists {
+				problems = append(problems, fmt.Sprintf("container %s requests pool %s which is not configured on any node", c.Name, poolName))
+				continue
+			}
+			if types.DeterminePoolType(poolName) != types.ExclusivePoolID {
+				continue
+			}
+			if request, exists := c.Resources.Requests[key]; exists && !request.Equal(limit) {
+				problems = append(problems, fmt.Sprintf("container %s requests %s of %s but its limit is %s, exclusive CPUs need requests equal to limits",
+					c.Name, request.String(), key, limit.String()))
+			}
+			//Init containers run one after the other before the application containers, so the pod holds the CPUs of the largest of them,
+			//or the ones of all the application containers
+			if i < len(pod.Spec.InitContainers) {
+				if limit.Value() > initRequests[poolName] {
+					initRequests[poolName] = limit.Value()
+				}
+			} else {
+				appRequests[poolName] += limit.Value()
+			}
+		}
+		for key := range c.Resources.Requests {
+			if !strings.HasPrefix(string(key), resourceBaseName+"/") ||
+				types.DeterminePoolType(strings.TrimPrefix(string(key), resourceBaseName+"/")) != types.ExclusivePoolID {
+				continue
+			}
+			if _, exists := c.Resources.Limits[key]; !exists {
+				problems = append(problems, fmt.Sprintf("container %s requests %s without a limit, exclusive CPUs need requests equal to limits", c.Name, key))
+			}
+		}
+	}
+	if capacities == nil {
+		return problems
+	}
+	exclusiveRequests := appRequests
+	for poolName, requested := range initRequests {
+		if requested > exclusiveRequests[poolName] {
+			exclusiveRequests[poolName] = requested
+		}
+	}
+	for poolName, requested := range exclusiveRequests {
+		if capacity, exists := capacities[poolName]; exists && requested > int64(capacity) {
+			problems = append(problems, fmt.Sprintf("pod requests %d exclusive CPUs from pool %s, but the pool holds at most %d on any node",
+				requested, poolName, capacity))
+		}
+	}
+	return problems
+}
+
+// validateCPUAnnotation checks that the pinning annotation can be decoded, only names existing containers, and matches the pool requests
+func validateCPUAnnotation(pod *corev1.Pod) []string {
+	podAnnotation, exists := pod.ObjectMeta.Annotations[annotationNameFromConfig()]
+	if !exists {
+		return nil
+	}
+	cpuAnnotation := types.NewCPUAnnotation()
+	if err := cpuAnnotation.Decode([]byte(podAnnotation)); err != nil {
+		return []string{fmt.Sprintf("%s annotation cannot be decoded: %s", annotationNameFromConfig(), err.Error())}
+	}
+	var problems []string
+	containerNames := make(map[string]bool)
+	for _, c := range pod.Spec.Containers {
+		containerNames[c.Name] = true
+	}
+	for _, cName := range cpuAnnotation.ContainerNames() {
+		if !containerNames[cName] {
+			problems = append(problems, fmt.Sprintf("%s annotation references container %s which does not exist in the pod", annotationNameFromConfig(), cName))
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	poolRequests, err := getCPUPoolRequests(pod)
+	if err != nil {
+		//reported by validatePod
+		return nil
+	}
+	if err := validateAnnotation(poolRequests, cpuAnnotation); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// validatePod returns every problem found in the CPU pool related settings of the pod, and the violations of its policy
+func validatePod(pod *corev1.Pod, policy admissionPolicy) []string {
+	var capacities map[string]int
+	poolConfs, err := catalog.poolConfigs()
+	if err != nil || len(poolConfs) == 0 {
+		mainLogger.Warn("Pool configs could not be read, pools of the pod are not validated", logger.Any("pod", pod.Name), logger.Error(err))
+	} else {
+		capacities = maxPoolCapacities(poolConfs)
+	}
+	problems := append(validatePoolResources(pod, capacities), validateCPUAnnotation(pod)...)
+	if poolRequests, err := getCPUPoolRequests(pod); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		if err := policy.check(pod, poolRequests); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if _, err := cfsQuotaPolicies(pod, poolRequests); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+var (
+	deploymentResource  = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	statefulSetResource = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}
+	daemonSetResource   = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"}
+	jobResource         = metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	cronJobResource     = metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"}
+)
+
+// podTemplateOf decodes the workload object of the request, and returns the template of its pods
+// false is returned for resources which are not workloads
+func podTemplateOf(req *admissionv1.AdmissionRequest) (*corev1.PodTemplateSpec, bool, error) {
+	var (
+		obj      runtime.Object
+		template func() *corev1.PodTemplateSpec
+	)
+	switch req.Resource {
+	case deploymentResource:
+		deployment := &appsv1.Deployment{}
+		obj, template = deployment, func() *corev1.PodTemplateSpec { return &deployment.Spec.Template }
+	case statefulSetResource:
+		statefulSet := &appsv1.StatefulSet{}
+		obj, template = statefulSet, func() *corev1.PodTemplateSpec { return &statefulSet.Spec.Template }
+	case daemonSetResource:
+		daemonSet := &appsv1.DaemonSet{}
+		obj, template = daemonSet, func() *corev1.PodTemplateSpec { return &daemonSet.Spec.Template }
+	case jobResource:
+		job := &batchv1.Job{}
+		obj, template = job, func() *corev1.PodTemplateSpec { return &job.Spec.Template }
+	case cronJobResource:
+		cronJob := &batchv1.CronJob{}
+		obj, template = cronJob, func() *corev1.PodTemplateSpec { return &cronJob.Spec.JobTemplate.Spec.Template }
+	default:
+		return nil, false, nil
+	}
+	if _, _, err := codecs.UniversalDeserializer().Decode(req.Object.Raw, nil, obj); err != nil {
+		return nil, true, err
+	}
+	return template(), true, nil
+}
+
+// validatePods validates pods, and the pod templates of workloads, so a workload which would create invalid pods is rejected up front
+func validatePods(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	pod := &corev1.Pod{}
+	kind, message := "Pod", "CPU pool validation failed: "
+	if req.Resource == podResource {
+		if _, _, err := codecs.UniversalDeserializer().Decode(req.Object.Raw, nil, pod); err != nil {
+			mainLogger.Error("deserializer Decode error!", logger.Error(err))
+			return toAdmissionResponse(err)
+		}
+	} else {
+		template, isWorkload, err := podTemplateOf(req)
+		if !isWorkload {
+			mainLogger.Error("expect resource to be a pod or a workload", logger.Any("resource", req.Resource))
+			return skippedResponse(ReasonUnsupportedResource)
+		}
+		if err != nil {
+			mainLogger.Error("deserializer Decode error!", logger.Error(err))
+			return toAdmissionResponse(err)
+		}
+		pod.ObjectMeta, pod.Spec = template.ObjectMeta, template.Spec
+		if pod.Name == "" {
+			pod.Name = req.Name
+		}
+		kind, message = req.Kind.Kind+" pod template", "CPU pool validation of the pod template failed: "
+	}
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = pod.Namespace
+	}
+	if problems := validatePod(pod, policies.policyForPod(namespace, pod)); len(problems) > 0 {
+		mainLogger.Info("Pod rejected", logger.Any("kind", kind), logger.Any("pod", pod.Name), logger.Any("namespace", namespace), logger.Any("problems", problems))
+		return toInvalidResponse(errors.New(message + strings.Join(problems, "; ")))
+	}
+	//only new pods take CPUs, the pool resources of existing pods cannot change
+	if cpuQuotas != nil && req.Resource == podResource && req.Operation == admissionv1.Create {
+		if err := cpuQuotas.check(pod, namespace); err != nil {
+			mainLogger.Info("Pod rejected", logger.Any("kind", kind), logger.Any("pod", pod.Name), logger.Any("namespace", namespace), logger.Error(err))
+			return toForbiddenResponse(err)
+		}
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+func serveValidatePod(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, validatePods)
+}
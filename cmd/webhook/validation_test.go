@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubeservice-stack/common/pkg/utils"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/config"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func withTestPoolConfigs(t *testing.T) {
+	origDir, origMatch := types.PoolConfigDir, config.FileMatch
+	types.PoolConfigDir = utils.Pwd() + "/../../test/testdata"
+	config.FileMatch = "cpuset-*.yaml"
+	t.Cleanup(func() {
+		types.PoolConfigDir, config.FileMatch = origDir, origMatch
+	})
+}
+
+// testPoolConfig configures the pools most tests request
+const testPoolConfig = `pools:
+  exclusive-pool:
+    cpus: "2-5"
+  shared-pool:
+    cpus: "1"
+  default:
+    cpus: "0"
+`
+
+// withPoolConfig makes the contents the pool configs of the cluster
+func withPoolConfig(t *testing.T, contents ...string) {
+	dir := t.TempDir()
+	for i, content := range contents {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("cpuset-test%d.yaml", i)), []byte(content), 0644))
+	}
+	origDir, origMatch := types.PoolConfigDir, config.FileMatch
+	types.PoolConfigDir, config.FileMatch = dir, "cpuset-*.yaml"
+	t.Cleanup(func() {
+		types.PoolConfigDir, config.FileMatch = origDir, origMatch
+	})
+}
+
+func poolContainer(name string, limits, requests map[string]string) corev1.Container {
+	c := corev1.Container{Name: name, Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{}, Requests: corev1.ResourceList{}}}
+	for key, value := range limits {
+		c.Resources.Limits[corev1.ResourceName(key)] = resource.MustParse(value)
+	}
+	for key, value := range requests {
+		c.Resources.Requests[corev1.ResourceName(key)] = resource.MustParse(value)
+	}
+	return c
+}
+
+func TestValidatePodAccepted(t *testing.T) {
+	withTestPoolConfigs(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			"cmss.cn/cpus": `[{"container": "app", "processes": [{"process": "/bin/app", "args": [], "cpus": 2, "pool": "exclusive-cpupool1"}]}]`,
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			poolContainer("app", map[string]string{"cmss.cn/exclusive-cpupool1": "2"}, map[string]string{"cmss.cn/exclusive-cpupool1": "2"}),
+			poolContainer("sidecar", map[string]string{"cmss.cn/sharedpool": "200"}, nil),
+		}},
+	}
+	assert.Empty(t, validatePod(pod, defaultPolicy()))
+}
+
+func TestValidatePodReportsAllProblems(t *testing.T) {
+	assert := assert.New(t)
+	withTestPoolConfigs(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			"cmss.cn/cpus": `[{"container": "missing", "processes": [{"process": "/bin/app", "args": [], "cpus": 1, "pool": "exclusive-cpupool1"}]}]`,
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			poolContainer("unknown", map[string]string{"cmss.cn/exclusive-nopool": "1"}, nil),
+			poolContainer("mismatch", map[string]string{"cmss.cn/exclusive-cpupool2": "2"}, map[string]string{"cmss.cn/exclusive-cpupool2": "1"}),
+			poolContainer("big", map[string]string{"cmss.cn/exclusive-cpupool1": "3"}, nil),
+		}},
+	}
+	problems := validatePod(pod, defaultPolicy())
+	assert.Len(problems, 4)
+	assert.Contains(problems, "container unknown requests pool exclusive-nopool which is not configured on any node")
+	assert.Contains(problems, "container mismatch requests 1 of cmss.cn/exclusive-cpupool2 but its limit is 2, exclusive CPUs need requests equal to limits")
+	assert.Contains(problems, "pod requests 3 exclusive CPUs from pool exclusive-cpupool1, but the pool holds at most 2 on any node")
+	assert.Contains(problems, "cmss.cn/cpus annotation references container missing which does not exist in the pod")
+}
+
+func TestValidatePodInitContainersDoNotAddUp(t *testing.T) {
+	assert := assert.New(t)
+	withTestPoolConfigs(t)
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{
+			poolContainer("init", map[string]string{"cmss.cn/exclusive-cpupool1": "2"}, nil),
+		},
+		Containers: []corev1.Container{
+			poolContainer("app1", map[string]string{"cmss.cn/exclusive-cpupool1": "1"}, nil),
+			poolContainer("app2", map[string]string{"cmss.cn/exclusive-cpupool1": "1"}, nil),
+		},
+	}}
+	assert.Empty(validatePod(pod, defaultPolicy()))
+
+	pod.Spec.InitContainers[0] = poolContainer("init", map[string]string{"cmss.cn/exclusive-cpupool1": "3"}, nil)
+	assert.Equal([]string{"pod requests 3 exclusive CPUs from pool exclusive-cpupool1, but the pool holds at most 2 on any node"}, validatePod(pod, defaultPolicy()))
+}
+
+func TestValidatePodChecksCPUIndices(t *testing.T) {
+	assert := assert.New(t)
+	withTestPoolConfigs(t)
+	annotatedPod := func(annotation string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"cmss.cn/cpus": annotation}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{
+				poolContainer("app", map[string]string{"cmss.cn/exclusive-cpupool1": "2"}, nil),
+			}},
+		}
+	}
+	assert.Empty(validatePod(annotatedPod(`{"apiVersion": "v2", "containers": [{"container": "app", "processes": [
+		{"process": "/bin/app", "cpus": 2, "pool": "exclusive-cpupool1", "cpuIndices": [1, 0]}]}]}`), defaultPolicy()))
+	assert.Equal([]string{"Container app; process 0 picks CPU 2, but gets only 2 CPUs from pool exclusive-cpupool1"},
+		validatePod(annotatedPod(`{"apiVersion": "v2", "containers": [{"container": "app", "processes": [
+		{"process": "/bin/app", "cpus": 2, "pool": "exclusive-cpupool1", "cpuIndices": [0, 2]}]}]}`), defaultPolicy()))
+	assert.Equal([]string{"cmss.cn/cpus annotation cannot be decoded: containers[0].processes[0]: field needs apiVersion v2 of the annotation: cpuIndices"},
+		validatePod(annotatedPod(`[{"container": "app", "processes": [
+		{"process": "/bin/app", "cpus": 2, "pool": "exclusive-cpupool1", "cpuIndices": [0, 1]}]}]`), defaultPolicy()))
+}
+
+func TestValidatePodWithoutPoolConfigs(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		poolContainer("unknown", map[string]string{"cmss.cn/exclusive-nopool": "1"}, nil),
+	}}}
+	assert.Empty(t, validatePod(pod, defaultPolicy()))
+}
+
+func TestValidatePodsDeniesWithOneMessage(t *testing.T) {
+	assert := assert.New(t)
+	withTestPoolConfigs(t)
+	pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		poolContainer("a", map[string]string{"cmss.cn/exclusive-nopool": "1"}, nil),
+		poolContainer("b", map[string]string{"cmss.cn/shared-nopool": "100"}, nil),
+	}}}
+	raw, err := json.Marshal(&pod)
+	assert.Nil(err)
+	resp := validatePods(&admissionv1.AdmissionRequest{Resource: podResource, Object: runtime.RawExtension{Raw: raw}})
+	assert.False(resp.Allowed)
+	assert.Equal(metav1.StatusReasonInvalid, resp.Result.Reason)
+	assert.Equal("CPU pool validation failed: container a requests pool exclusive-nopool which is not configured on any node; "+
+		"container b requests pool shared-nopool which is not configured on any node", resp.Result.Message)
+}
+
+func TestValidatePodsChecksWorkloadTemplates(t *testing.T) {
+	withTestPoolConfigs(t)
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"cmss.cn/cpus": "not json"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			poolContainer("app", map[string]string{"cmss.cn/exclusive-cpupool1": "1"}, nil),
+		}},
+	}
+	workloads := []struct {
+		resource metav1.GroupVersionResource
+		kind     string
+		obj      interface{}
+	}{
+		{deploymentResource, "Deployment", &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}}},
+		{statefulSetResource, "StatefulSet", &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: template}}},
+		{daemonSetResource, "DaemonSet", &appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{Template: template}}},
+		{jobResource, "Job", &batchv1.Job{Spec: batchv1.JobSpec{Template: template}}},
+		{cronJobResource, "CronJob", &batchv1.CronJob{Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}}}}},
+	}
+	for _, workload := range workloads {
+		t.Run(workload.kind, func(t *testing.T) {
+			assert := assert.New(t)
+			raw, err := json.Marshal(workload.obj)
+			assert.Nil(err)
+			req := &admissionv1.AdmissionRequest{
+				Resource: workload.resource,
+				Kind:     metav1.GroupVersionKind{Group: workload.resource.Group, Version: "v1", Kind: workload.kind},
+				Name:     "app",
+				Object:   runtime.RawExtension{Raw: raw},
+			}
+			resp := validatePods(req)
+			assert.False(resp.Allowed)
+			assert.Contains(resp.Result.Message, "CPU pool validation of the pod template failed: cmss.cn/cpus annotation cannot be decoded")
+
+			fixed := strings.Replace(string(raw), `"cmss.cn/cpus":"not json"`, `"team":"a"`, 1)
+			req.Object = runtime.RawExtension{Raw: []byte(fixed)}
+			assert.True(validatePods(req).Allowed)
+		})
+	}
+}
+
+func TestValidatePodsIgnoresOtherResources(t *testing.T) {
+	resp := validatePods(&admissionv1.AdmissionRequest{
+		Resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"},
+		Object:   runtime.RawExtension{Raw: []byte("{}")},
+	})
+	assert.True(t, resp.Allowed)
+}
+
+func TestValidateAnnotationCountsCPUsPerDevice(t *testing.T) {
+	assert := assert.New(t)
+	coresPool := func(threadsPerCore int) string {
+		return fmt.Sprintf("pools:\n  exclusive-cores:\n    cpus: \"2-9\"\n    hyperThreadingPolicy: physicalCore\n    threadsPerCore: %d\n", threadsPerCore)
+	}
+	poolRequests := poolRequestMap{"app": {exclusiveCPURequests: 1, pools: map[string]int{"exclusive-cores": 1}}}
+	annotation := func(cpus int) types.CPUAnnotation {
+		cpuAnnotation := types.NewCPUAnnotation()
+		assert.Nil(cpuAnnotation.Decode([]byte(fmt.Sprintf(`[{"container":"app","processes":[{"process":"/bin/app","cpus":%d,"pool":"exclusive-cores"}]}]`, cpus))))
+		return cpuAnnotation
+	}
+
+	withPoolConfig(t, coresPool(2))
+	assert.Nil(validateAnnotation(poolRequests, annotation(2)))
+	assert.EqualError(validateAnnotation(poolRequests, annotation(3)), "Exclusive CPU requests 1 do not match to annotation 3")
+
+	//the annotation has to fit on the node giving the fewest CPUs per device
+	withPoolConfig(t, coresPool(4), coresPool(2))
+	assert.Nil(validateAnnotation(poolRequests, annotation(2)))
+	assert.NotNil(validateAnnotation(poolRequests, annotation(4)))
+
+	//the CPUs per device are not assumed when no node configures the pool
+	withPoolConfig(t)
+	assert.EqualError(validateAnnotation(poolRequests, annotation(1)), "pool exclusive-cores is not configured on any node")
+}
+
+func TestValidatePodRejectsSeveralSharedPools(t *testing.T) {
+	assert := assert.New(t)
+	withPoolConfig(t, testPoolConfig+"  shared-pool2:\n    cpus: \"6\"\n")
+	pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		poolContainer("app", map[string]string{"cmss.cn/shared-pool": "100", "cmss.cn/shared-pool2": "100"}, nil),
+	}}}
+	assert.Equal([]string{"container app requests shared pools shared-pool, shared-pool2, but a container can use only one shared pool"},
+		validatePod(&pod, defaultPolicy()))
+	resp := mutatePodInNamespace(t, "default", pod)
+	assert.False(resp.Allowed)
+	assert.Equal(metav1.StatusReasonInvalid, resp.Result.Reason)
+
+	//init containers get their own shared pool
+	pod.Spec.InitContainers = []corev1.Container{poolContainer("init", map[string]string{"cmss.cn/shared-pool2": "100"}, nil)}
+	pod.Spec.Containers[0] = poolContainer("app", map[string]string{"cmss.cn/shared-pool": "100"}, nil)
+	assert.Empty(validatePod(&pod, defaultPolicy()))
+}
@@ -7,19 +7,29 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/kubeservice-stack/common/pkg/logger"
-	"github.com/kubeservice-stack/cpusets-controller/pkg/config"
-	"github.com/kubeservice-stack/cpusets-controller/third_party/forked/nokia/CPU-Pooler/pkg/types"
-	"k8s.io/api/admission/v1beta1"
+	cpusetsv1alpha1 "github.com/kubeservice-stack/cpusets-controller/pkg/apis/cpusets/v1alpha1"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/client"
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 )
 
 const (
@@ -27,6 +37,16 @@ const (
 	QuotaAll = "all"
 	//QuotaShared is one of the possible values of the webhook cfs-quotas parameter. Shared means CFS quotas should be automatically provisioned only for shared user containers
 	QuotaShared = "shared"
+	//MutatingPath is the path the mutating admission webhook is served on
+	MutatingPath = "/mutating"
+	//ValidatingPath is the path the validating admission webhook is served on
+	ValidatingPath = "/validating"
+	//PodInfoVolumeName is the name of the downward API volume exposing the annotations of the pod to the process starter
+	PodInfoVolumeName = "podinfo"
+	//PodInfoMountDir is where the downward API volume is mounted in the pinned containers
+	PodInfoMountDir = "/etc/podinfo"
+	//HostBinVolumeName is the name of the hostPath volume of the process starter binary
+	HostBinVolumeName = "hostbin"
 )
 
 var (
@@ -36,7 +56,14 @@ var (
 	processStarterPath = "/opt/bin/process-starter"
 	certFile           string
 	keyFile            string
-	cfsQuotas          string
+	listenAddress      = ":443"
+	selfManagedCerts   bool
+	serviceName        = "cpusets-webhook"
+	serviceNamespace   = "kube-system"
+	mutatingConfig     string
+	metricsAddress     string
+	validatingConfig   string
+	cfsQuotas          = QuotaAll
 	mainLogger         = logger.GetLogger("cmd/webhook", "main")
 )
 
@@ -48,14 +75,8 @@ type containerPoolRequests struct {
 
 type poolRequestMap map[string]containerPoolRequests
 
-type patch struct {
-	Op    string          `json:"op"`
-	Path  string          `json:"path"`
-	Value json.RawMessage `json:"value"`
-}
-
-func toAdmissionResponse(err error) *v1beta1.AdmissionResponse {
-	return &v1beta1.AdmissionResponse{
+func toAdmissionResponse(err error) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
 		Result: &metav1.Status{
 			Message: err.Error(),
 		},
@@ -63,21 +84,65 @@ func toAdmissionResponse(err error) *v1beta1.AdmissionResponse {
 	}
 }
 
+// toForbiddenResponse denies a pod which is not allowed by the policy of the webhook
+func toForbiddenResponse(err error) *admissionv1.AdmissionResponse {
+	resp := toAdmissionResponse(err)
+	resp.Result.Reason = metav1.StatusReasonForbidden
+	resp.Result.Code = http.StatusForbidden
+	return resp
+}
+
+// toInvalidResponse denies a pod whose CPU pool settings are invalid
+func toInvalidResponse(err error) *admissionv1.AdmissionResponse {
+	resp := toAdmissionResponse(err)
+	resp.Result.Reason = metav1.StatusReasonInvalid
+	resp.Result.Code = http.StatusUnprocessableEntity
+	return resp
+}
+
+// checkSharedPools returns an error when the container requests more than one shared pool
+// Every shared pool sets SHARED_CPUS to its own CPUs, the container would only see one of them while its cpuset is the union of all
+func checkSharedPools(c corev1.Container) error {
+	var sharedPools []string
+	for key := range c.Resources.Limits {
+		if strings.HasPrefix(string(key), resourceBaseName+"/shared") {
+			sharedPools = append(sharedPools, strings.TrimPrefix(string(key), resourceBaseName+"/"))
+		}
+	}
+	if len(sharedPools) > 1 {
+		sort.Strings(sharedPools)
+		return fmt.Errorf("container %s requests shared pools %s, but a container can use only one shared pool", c.Name, strings.Join(sharedPools, ", "))
+	}
+	return nil
+}
+
 func getCPUPoolRequests(pod *corev1.Pod) (poolRequestMap, error) {
 	var poolRequests = make(poolRequestMap)
+	for _, c := range pod.Spec.InitContainers {
+		if err := checkSharedPools(c); err != nil {
+			return poolRequestMap{}, err
+		}
+	}
 	for _, c := range pod.Spec.Containers {
+		if err := checkSharedPools(c); err != nil {
+			return poolRequestMap{}, err
+		}
 		cPoolRequests, exists := poolRequests[c.Name]
 		if !exists {
 			cPoolRequests.pools = make(map[string]int)
 		}
 		for key, value := range c.Resources.Limits {
 			if strings.HasPrefix(string(key), resourceBaseName) {
-				//convert back from human readable format
-				val, err := strconv.Atoi(strings.Replace(value.String(), "k", "000", 1))
-				if err != nil {
+				//pool resources are counted in devices, which are whole CPUs for exclusive, and millicores for shared pools
+				val64, ok := value.AsInt64()
+				if !ok || val64 > math.MaxInt32 {
 					mainLogger.Error("Cannot convert cpu request to int", logger.Any("key", key), logger.Any("value", value))
-					return poolRequestMap{}, err
+					if strings.HasPrefix(string(key), resourceBaseName+"/exclusive") {
+						return poolRequestMap{}, fmt.Errorf("container %s: exclusive CPU request %s of %s must be a whole number of CPUs", c.Name, value.String(), key)
+					}
+					return poolRequestMap{}, fmt.Errorf("container %s: request %s of %s must be a whole number of millicores", c.Name, value.String(), key)
 				}
+				val := int(val64)
 				if strings.HasPrefix(string(key), resourceBaseName+"/shared") {
 					cPoolRequests.sharedCPURequests += val
 				}
@@ -115,224 +180,365 @@ func validateAnnotation(poolRequests poolRequestMap, cpuAnnotation types.CPUAnno
 			if !exists {
 				return fmt.Errorf("Container %s; Pool %s in annotation not found from resources", cName, pool)
 			}
-			// cpu request in annotation can be twice as exclusive pool request in resources in case of HT is enabled (HT policy is "multiThreaded")
-			if cpuAnnotation.ContainerTotalCPURequest(pool, cName) > 2*value {
+			if types.DeterminePoolType(pool) == types.SharedPoolID && cpuAnnotation.ContainerTotalCPURequest(pool, cName) > value {
+				return fmt.Errorf("Container %s; Shared pool %s requests %d do not match to annotation %d",
+					cName, pool, value,
+					cpuAnnotation.ContainerTotalCPURequest(pool, cName))
+			}
+			if types.DeterminePoolType(pool) != types.ExclusivePoolID {
+				continue
+			}
+			// every exclusive device stands for as many CPUs as the pool allocates per device, i.e. all threads of the core when HT siblings are allocated too
+			// the annotation has to fit into the CPUs the container gets on any of the nodes
+			fewest, _, err := cpusPerDevice(pool)
+			if err != nil {
+				return err
+			}
+			if cpuAnnotation.ContainerTotalCPURequest(pool, cName) > fewest*value {
 				return fmt.Errorf("Exclusive CPU requests %d do not match to annotation %d",
 					cPoolRequests.pools[pool],
 					cpuAnnotation.ContainerTotalCPURequest(pool, cName))
 			}
 		}
+		for i, process := range cpuAnnotation[cName].Processes {
+			if len(process.CPUIndices) == 0 {
+				continue
+			}
+			fewest, _, err := cpusPerDevice(process.PoolName)
+			if err != nil {
+				return err
+			}
+			for _, index := range process.CPUIndices {
+				if cpus := fewest * poolRequests[cName].pools[process.PoolName]; index >= cpus {
+					return fmt.Errorf("Container %s; process %d picks CPU %d, but gets only %d CPUs from pool %s",
+						cName, i, index, cpus, process.PoolName)
+				}
+			}
+		}
 	}
 	return nil
 }
 
-func setRequestLimit(requests containerPoolRequests, patchList []patch, contID int, contSpec *corev1.Container) []patch {
-	totalCFSLimit := 0
-	if requests.exclusiveCPURequests > 0 && cfsQuotas == QuotaAll {
-		if requests.sharedCPURequests > 0 {
-			//This is the case when both shared, and exclusive pool resources are requested by the same container
-			//To avoid artificially throttling the exclusive user threads when the shared threads are overstepping their boundaries,
-			// we need to include the full size of the shared pool into the limit calculation.
-			//This unfortunately allows mixed users to overstep their boundaries, but is the only way to ensure shared threads cannot
-			// throttle the latency sensitive ones with their occasional bursts.
-			//#PerformanceFirst
-			totalCFSLimit = 1000*requests.exclusiveCPURequests + getMaxSharedPoolLimit(requests, contSpec)
-		} else {
-			//When only exclusive CPUs are requested we pad the limits with an arbitrary margin to avoid accidentally throttling sensitive workloads
-			totalCFSLimit = 1000*requests.exclusiveCPURequests + 100
+// cpusPerDevice returns how many CPUs one device of the exclusive pool gives to a container, on the nodes giving the fewest and the most
+// A pool of the same name can be configured differently on different nodes, the device plugin checks the threads per core of the pool against its node
+// An error is returned when the pool configs cannot be read, or no node configures the pool
+func cpusPerDevice(poolName string) (int, int, error) {
+	poolConfs, err := catalog.poolConfigs()
+	if err != nil {
+		return 0, 0, fmt.Errorf("CPUs per device of pool %s are not known: %w", poolName, err)
+	}
+	fewest, most := 0, 0
+	for _, poolConf := range poolConfs {
+		pool, ok := poolConf.Pools[poolName]
+		if !ok {
+			continue
+		}
+		if cpus := pool.CPUsPerDevice(); fewest == 0 || cpus < fewest {
+			fewest = cpus
+		}
+		if cpus := pool.CPUsPerDevice(); cpus > most {
+			most = cpus
 		}
-	} else if requests.sharedCPURequests > 0 {
-		totalCFSLimit = requests.sharedCPURequests
 	}
-	if totalCFSLimit > 0 {
-		patchList = patchCPULimit(totalCFSLimit, patchList, contID, contSpec)
+	if most == 0 {
+		return 0, 0, fmt.Errorf("pool %s is not configured on any node", poolName)
 	}
-	return patchList
+	return fewest, most, nil
 }
 
-func getMaxSharedPoolLimit(requests containerPoolRequests, contSpec *corev1.Container) int {
-	poolConfs, err := types.ReadAllPoolConfigs(config.FileMatch)
+// exclusiveCPUs returns how many CPUs the devices of the exclusive pool give to a container, on the node giving the most
+func exclusiveCPUs(poolName string, devices int) (int, error) {
+	_, most, err := cpusPerDevice(poolName)
 	if err != nil {
-		mainLogger.Warn("Container " + contSpec.Name + " asked for mixed allocations but pool configs could not be read to determine proper CFS limit - only exclusive allocations are accounted for properly")
-		return requests.sharedCPURequests
+		return 0, err
 	}
-	var sharedPoolName string
-	for poolName, request := range requests.pools {
-		if request == requests.sharedCPURequests {
-			sharedPoolName = poolName
-		}
+	return most * devices, nil
+}
+
+// setRequestLimit sets the CPU limit of the container to the CFS quota the policies of its pools entitle it to
+// quotaMode is one of QuotaAll, QuotaShared, or QuotaNone, QuotaShared leaves containers using exclusive pools unlimited
+func setRequestLimit(requests containerPoolRequests, contSpec *corev1.Container, quotaMode string, quotaPolicies map[string]types.CFSQuotaPolicy) {
+	if quotaMode == QuotaNone || (quotaMode == QuotaShared && requests.exclusiveCPURequests > 0) {
+		return
 	}
-	maxSharedPoolSize := 0
-	for _, poolConf := range poolConfs {
-		if pool, ok := poolConf.Pools[sharedPoolName]; ok {
-			if pool.CPUset.Size()*1000 > maxSharedPoolSize {
-				maxSharedPoolSize = pool.CPUset.Size() * 1000
-			}
-		}
+	if totalCFSLimit, limited := containerCFSQuota(requests, quotaPolicies); limited {
+		setCPULimit(totalCFSLimit, contSpec)
 	}
-	return maxSharedPoolSize
 }
 
-func patchCPULimit(sharedCPUTime int, patchList []patch, i int, c *corev1.Container) []patch {
-	var patchItem patch
-
-	patchItem.Op = "replace"
-	cpuVal := `"` + strconv.Itoa(sharedCPUTime) + `m"`
-	patchItem.Path = "/spec/containers/" + strconv.Itoa(i) + "/resources/limits/cpu"
-	patchItem.Value = json.RawMessage(cpuVal)
-	patchList = append(patchList, patchItem)
-
-	patchItem.Op = "replace"
-	cpuVal = `"0m"`
-	patchItem.Path = "/spec/containers/" + strconv.Itoa(i) + "/resources/requests/cpu"
-	patchItem.Value = json.RawMessage(cpuVal)
-	patchList = append(patchList, patchItem)
+// setCPULimit sets the CPU limit of the container, keeping its CPU request when it is not above the limit
+// A missing request is set to zero, otherwise it would default to the limit, and the pool CPUs would be accounted twice by the scheduler
+func setCPULimit(cpuTime int, c *corev1.Container) {
+	if c.Resources.Limits == nil {
+		c.Resources.Limits = corev1.ResourceList{}
+	}
+	if c.Resources.Requests == nil {
+		c.Resources.Requests = corev1.ResourceList{}
+	}
+	limit := *resource.NewMilliQuantity(int64(cpuTime), resource.DecimalSI)
+	c.Resources.Limits[corev1.ResourceCPU] = limit
+	if request, exists := c.Resources.Requests[corev1.ResourceCPU]; !exists {
+		c.Resources.Requests[corev1.ResourceCPU] = *resource.NewMilliQuantity(0, resource.DecimalSI)
+	} else if request.Cmp(limit) > 0 {
+		c.Resources.Requests[corev1.ResourceCPU] = limit
+	}
+}
 
-	return patchList
+// setEnv sets the environment variable of the container, adding it if it does not exist yet
+func setEnv(c *corev1.Container, name, value string) {
+	for i := range c.Env {
+		if c.Env[i].Name == name {
+			c.Env[i].Value = value
+			c.Env[i].ValueFrom = nil
+			return
+		}
+	}
+	c.Env = append(c.Env, corev1.EnvVar{Name: name, Value: value})
 }
 
-func patchContainerEnv(poolRequests poolRequestMap, envPatched bool, patchList []patch, i int, c *corev1.Container) ([]patch, error) {
-	var patchItem patch
-	var poolStr string
+// setVolumeMount mounts the volume into the container, unless a volume of the same name is already mounted
+func setVolumeMount(c *corev1.Container, mount corev1.VolumeMount) {
+	for _, volMount := range c.VolumeMounts {
+		if volMount.Name == mount.Name {
+			return
+		}
+	}
+	c.VolumeMounts = append(c.VolumeMounts, mount)
+}
 
-	for _, envVar := range c.Env {
-		if envVar.Name == "CPU_POOLS" {
-			// Don't reapply already patched item
-			return patchList, nil
+// setVolume adds the volume to the pod, unless a volume of the same name already exists
+func setVolume(pod *corev1.Pod, volume corev1.Volume) {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == volume.Name {
+			return
 		}
 	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+}
 
-	if poolRequests[c.Name].exclusiveCPURequests > 0 && poolRequests[c.Name].sharedCPURequests > 0 {
+func setContainerEnv(requests containerPoolRequests, c *corev1.Container) {
+	var poolStr string
+	if requests.exclusiveCPURequests > 0 && requests.sharedCPURequests > 0 {
 		poolStr = types.ExclusivePoolID + "&" + types.SharedPoolID
-	} else if poolRequests[c.Name].exclusiveCPURequests > 0 {
+	} else if requests.exclusiveCPURequests > 0 {
 		poolStr = types.ExclusivePoolID
-	} else if poolRequests[c.Name].sharedCPURequests > 0 {
+	} else if requests.sharedCPURequests > 0 {
 		poolStr = types.SharedPoolID
 	} else {
 		poolStr = types.DefaultPoolID
 	}
-	patchItem.Op = "add"
-	cpuPoolEnvPatch := `{"name":"CPU_POOLS","value":"` + poolStr + `" }`
-	patchItem.Path = "/spec/containers/" + strconv.Itoa(i) + "/env"
-	if envPatched || len(c.Env) > 0 {
-		patchItem.Path += "/-"
+	setEnv(c, "CPU_POOLS", poolStr)
+}
+
+// setContainerForPinning makes the process starter the entrypoint of the container
+// Applying it again on an already mutated container changes nothing
+func setContainerForPinning(cpuAnnotation types.CPUAnnotation, c *corev1.Container) {
+	setVolumeMount(c, corev1.VolumeMount{Name: PodInfoVolumeName, MountPath: PodInfoMountDir, ReadOnly: true})
+	if initContainerMode() {
+		setVolumeMount(c, corev1.VolumeMount{Name: ProcessStarterVolumeName, MountPath: ProcessStarterMountDir, ReadOnly: true})
 	} else {
-		cpuPoolEnvPatch = `[` + cpuPoolEnvPatch + `]`
+		// hostbin volumeMount. Location for process starter binary
+		setVolumeMount(c, corev1.VolumeMount{Name: HostBinVolumeName, MountPath: processStarterPath, ReadOnly: true})
 	}
-	patchItem.Value = json.RawMessage(cpuPoolEnvPatch)
-	patchList = append(patchList, patchItem)
-
-	return patchList, nil
+	setEnv(c, "CONTAINER_NAME", c.Name)
+	if len(c.Command) == 1 && c.Command[0] == processStarterCommand() {
+		return
+	}
+	// Put command to args if pod cpu annotation does not exist for the container
+	if len(c.Command) > 0 && !cpuAnnotation.IsContainerExists(c.Name) {
+		c.Args = append(append([]string{}, c.Command...), c.Args...)
+	}
+	// Overwrite entrypoint
+	c.Command = []string{processStarterCommand()}
 }
 
-func patchContainerForPinning(cpuAnnotation types.CPUAnnotation, patchList []patch, i int, c *corev1.Container) ([]patch, error) {
-	var patchItem patch
-
-	for _, volMount := range c.VolumeMounts {
-		if volMount.Name == "podinfo" {
-			// Assuming that all other container related patch is already patched, skip reapply these patches
-			return patchList, nil
-		}
+func setVolumesForPinning(pod *corev1.Pod) {
+	setVolume(pod, corev1.Volume{Name: PodInfoVolumeName, VolumeSource: corev1.VolumeSource{DownwardAPI: &corev1.DownwardAPIVolumeSource{
+		Items: []corev1.DownwardAPIVolumeFile{{Path: "annotations", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations"}}},
+	}}})
+	if initContainerMode() {
+		setVolume(pod, corev1.Volume{Name: ProcessStarterVolumeName, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}})
+		setProcessStarterInitContainer(pod)
+		return
 	}
+	setVolume(pod, corev1.Volume{Name: HostBinVolumeName, VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: processStarterPath}}})
+}
 
-	mainLogger.Info("Adding CPU pinning patches")
-	// podinfo volumeMount
-	patchItem.Op = "add"
-
-	patchItem.Path = "/spec/containers/" + strconv.Itoa(i) + "/volumeMounts/-"
-	patchItem.Value =
-		json.RawMessage(`{"name":"podinfo","mountPath":"/etc/podinfo","readOnly":true}`)
-	patchList = append(patchList, patchItem)
-
-	// hostbin volumeMount. Location for process starter binary
-
-	patchItem.Path = "/spec/containers/" + strconv.Itoa(i) + "/volumeMounts/-"
-	contVolumePatch := `{"name":"hostbin","mountPath":"` + processStarterPath + `","readOnly":true}`
-	patchItem.Value =
-		json.RawMessage(contVolumePatch)
-	patchList = append(patchList, patchItem)
-
-	// Container name to env variable
-	contNameEnvPatch := `{"name":"CONTAINER_NAME","value":"` + c.Name + `" }`
-	patchItem.Path = "/spec/containers/" + strconv.Itoa(i) + "/env"
-	if len(c.Env) > 0 {
-		patchItem.Path += "/-"
-	} else {
-		contNameEnvPatch = `[` + contNameEnvPatch + `]`
+// webhookMountPaths returns where the volumes the webhook adds to the pinned pods are mounted, by volume name
+func webhookMountPaths() map[string]string {
+	return map[string]string{
+		PodInfoVolumeName:        PodInfoMountDir,
+		HostBinVolumeName:        processStarterPath,
+		ProcessStarterVolumeName: ProcessStarterMountDir,
 	}
-	patchItem.Value = json.RawMessage(contNameEnvPatch)
-	patchList = append(patchList, patchItem)
+}
 
-	// Overwrite entrypoint
-	patchItem.Path = "/spec/containers/" + strconv.Itoa(i) + "/command"
-	contEPPatch := `[ "` + processStarterPath + `" ]`
-	patchItem.Value = json.RawMessage(contEPPatch)
-	patchList = append(patchList, patchItem)
+// isWebhookVolume tells if the volume is the one the webhook adds to the pinned pods under its name
+// Only the sources are compared, the API server defaults the other fields of the volumes added by the webhook
+func isWebhookVolume(volume corev1.Volume) bool {
+	switch volume.Name {
+	case PodInfoVolumeName:
+		source := volume.DownwardAPI
+		return source != nil && len(source.Items) == 1 && source.Items[0].Path == "annotations" &&
+			source.Items[0].FieldRef != nil && source.Items[0].FieldRef.FieldPath == "metadata.annotations"
+	case HostBinVolumeName:
+		return volume.HostPath != nil && volume.HostPath.Path == processStarterPath
+	case ProcessStarterVolumeName:
+		return volume.EmptyDir != nil
+	}
+	return false
+}
 
-	// Put command to args if pod cpu annotation does not exist for the container
-	if len(c.Command) > 0 && !cpuAnnotation.IsContainerExists(c.Name) {
-		patchItem.Path = "/spec/containers/" + strconv.Itoa(i) + "/args"
-		args := `[ "` + strings.Join(c.Command, "\",\"") + `" `
-		if len(c.Args) > 0 {
-			args += `,"` + strings.Join(c.Args, "\",\"") + `"`
+// checkReservedVolumes refuses the volumes and mounts of a pinned pod which could replace the process starter or the annotations it reads
+// The webhook does not add its volumes and mounts again when they exist, so the ones of the pod would be used instead
+func checkReservedVolumes(pod *corev1.Pod) error {
+	mountPaths := webhookMountPaths()
+	for _, volume := range pod.Spec.Volumes {
+		if _, reserved := mountPaths[volume.Name]; reserved && !isWebhookVolume(volume) {
+			return fmt.Errorf("volume name %s is reserved for the process starter", volume.Name)
 		}
-		args += `]`
-		patchItem.Value = json.RawMessage(args)
-		patchList = append(patchList, patchItem)
 	}
-	return patchList, nil
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, c := range containers {
+		// the init container of the webhook is replaced when the pod has one of the same name
+		if c.Name == ProcessStarterInitContainerName {
+			continue
+		}
+		for _, mount := range c.VolumeMounts {
+			mountPath := path.Clean(mount.MountPath)
+			for name, reservedPath := range mountPaths {
+				inside := mountPath == reservedPath || strings.HasPrefix(mountPath, reservedPath+"/")
+				if (mount.Name == name && (mountPath != reservedPath || !mount.ReadOnly)) || (mount.Name != name && inside) {
+					return fmt.Errorf("volume mount %s of container %s is reserved for the process starter", mount.MountPath, c.Name)
+				}
+			}
+		}
+	}
+	return nil
 }
 
-func patchVolumesForPinning(patchList []patch) []patch {
-	var patchItem patch
-	patchItem.Op = "add"
+// createPatch returns the JSON patch turning the original object into the mutated one
+// decoded is the original object as it was decoded, the fields it does not know are not removed by the patch
+func createPatch(original []byte, decoded, mutated interface{}) ([]byte, error) {
+	mutatedRaw, err := json.Marshal(mutated)
+	if err != nil {
+		return nil, err
+	}
+	decodedRaw, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	var known interface{}
+	if err = json.Unmarshal(decodedRaw, &known); err != nil {
+		return nil, err
+	}
+	operations, err := jsonpatch.CreatePatch(original, mutatedRaw)
+	if err != nil {
+		return nil, err
+	}
+	kept := operations[:0]
+	for _, operation := range operations {
+		if operation.Operation == "remove" && !jsonPointerExists(known, operation.Path) {
+			continue
+		}
+		kept = append(kept, operation)
+	}
+	if len(kept) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(kept)
+}
 
-	// podinfo volume
-	patchItem.Path = "/spec/volumes/-"
-	patchItem.Value = json.RawMessage(`{"name":"podinfo","downwardAPI": { "items": [ { "path" : "annotations","fieldRef":{ "fieldPath": "metadata.annotations"} } ] } }`)
-	patchList = append(patchList, patchItem)
-	// hostbin volume
-	patchItem.Path = "/spec/volumes/-"
-	volumePathPatch := `{"name":"hostbin","hostPath":{ "path":"` + processStarterPath + `"} }`
-	patchItem.Value = json.RawMessage(volumePathPatch)
-	patchList = append(patchList, patchItem)
-	return patchList
+// jsonPointerExists tells if the JSON pointer path points to a value of the document
+func jsonPointerExists(document interface{}, path string) bool {
+	if path == "" {
+		return true
+	}
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	for _, token := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		switch value := document.(type) {
+		case map[string]interface{}:
+			child, ok := value[unescape.Replace(token)]
+			if !ok {
+				return false
+			}
+			document = child
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(value) {
+				return false
+			}
+			document = value[index]
+		default:
+			return false
+		}
+	}
+	return true
 }
 
-func mutatePods(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+func mutatePods(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
 	mainLogger.Info("mutating pods")
 	var (
-		patchList         []patch
-		err               error
-		cpuAnnotation     types.CPUAnnotation
-		pinningPatchAdded bool
+		err           error
+		cpuAnnotation types.CPUAnnotation
+		pinningNeeded bool
+		warnings      []admissionWarning
 	)
 
 	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-	if ar.Request.Resource != podResource {
+	if req.Resource != podResource {
 		mainLogger.Error("expect resource to be", logger.Any("resource", podResource))
-		return nil
+		return skippedResponse(ReasonUnsupportedResource)
 	}
 
-	raw := ar.Request.Object.Raw
+	raw := req.Object.Raw
 	pod := corev1.Pod{}
 	deserializer := codecs.UniversalDeserializer()
 	if _, _, err = deserializer.Decode(raw, nil, &pod); err != nil {
 		mainLogger.Error("deserializer Decode error!", logger.Error(err))
 		return toAdmissionResponse(err)
 	}
-	reviewResponse := v1beta1.AdmissionResponse{}
+	reviewResponse := admissionv1.AdmissionResponse{}
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = pod.Namespace
+	}
 
 	annotationName := annotationNameFromConfig()
 
 	reviewResponse.Allowed = true
 
-	podAnnotation, podAnnotationExists := pod.ObjectMeta.Annotations[annotationName]
+	policy := policies.policyForPod(namespace, &pod)
+	if !policy.mutate {
+		mainLogger.Info("Pod is not mutated by policy", logger.Any("pod", pod.Name), logger.Any("namespace", namespace), logger.Any("rule", policy.rule))
+		return skippedResponse(ReasonSkippedByPolicy)
+	}
 
-	poolRequests, err := getCPUPoolRequests(&pod)
+	// The mutations are applied on a copy, and the patch is the difference of the copy and the original object.
+	// Every mutation only changes what is not yet as desired, so a re-invoked webhook returns no patch.
+	mutated := pod.DeepCopy()
+	class, err := resolvePoolClass(namespace, &pod)
+	if err != nil {
+		mainLogger.Error("Invalid pool class", logger.Error(err))
+		return toInvalidResponse(err)
+	}
+	if injected := injectPoolResources(mutated, class); len(injected) > 0 {
+		mainLogger.Info("Pool resources injected from CPU requests", logger.Any("pod", pod.Name), logger.Any("containers", injected))
+	}
+
+	poolRequests, err := getCPUPoolRequests(mutated)
 	if err != nil {
 		mainLogger.Error("Failed to get pod cpu pool requests", logger.Error(err))
-		return toAdmissionResponse(err)
+		return toInvalidResponse(err)
+	}
+	if err = resolvePinningProfile(mutated, namespace, poolRequests); err != nil {
+		mainLogger.Error("Failed to resolve the CPU pinning profile", logger.Any("pod", pod.Name), logger.Error(err))
+		return toInvalidResponse(err)
+	}
+	podAnnotation, podAnnotationExists := mutated.Annotations[annotationName]
+	if err = policy.check(mutated, poolRequests); err != nil {
+		mainLogger.Info("Pod rejected by policy", logger.Any("pod", pod.Name), logger.Any("namespace", namespace), logger.Error(err))
+		return toForbiddenResponse(err)
 	}
 
 	if podAnnotationExists {
@@ -341,17 +547,22 @@ func mutatePods(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 		err = cpuAnnotation.Decode([]byte(podAnnotation))
 		if err != nil {
 			mainLogger.Error("Failed to decode pod annotation ", logger.Error(err))
-			return toAdmissionResponse(err)
+			return toInvalidResponse(err)
 		}
 		if err = validateAnnotation(poolRequests, cpuAnnotation); err != nil {
 			mainLogger.Error("validateAnnotation error ", logger.Error(err))
-			return toAdmissionResponse(err)
+			return toInvalidResponse(err)
 		}
 	}
+	quotaPolicies, err := cfsQuotaPolicies(mutated, poolRequests)
+	if err != nil {
+		mainLogger.Error("Invalid CFS quota annotation", logger.Error(err))
+		return toInvalidResponse(err)
+	}
 
-	// Patch container if needed.
-	for contID, contSpec := range pod.Spec.Containers {
-		patchList = setRequestLimit(poolRequests[contSpec.Name], patchList, contID, &contSpec)
+	for contID := range mutated.Spec.Containers {
+		contSpec := &mutated.Spec.Containers[contID]
+		setRequestLimit(poolRequests[contSpec.Name], contSpec, policy.cfsQuotas, quotaPolicies)
 		// If pod annotation has entry for this container or
 		// container asks for exclusive cpus, we add patches to enable pinning.
 		// The patches enable process in container to be started with cpu pooler's 'process starter'
@@ -362,64 +573,71 @@ func mutatePods(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 		// and starts the application process after that.
 		pinningPatchNeeded := cpuAnnotation.IsContainerExists(contSpec.Name)
 		if poolRequests[contSpec.Name].exclusiveCPURequests > 0 {
-			if len(contSpec.Command) == 0 && !pinningPatchNeeded {
+			if !policy.pinning {
+				warnings = append(warnings, admissionWarning{
+					reason:  WarningPinningDisabled,
+					message: "container " + contSpec.Name + " asked for exclusive CPUs but pinning is disabled by policy " + policy.rule,
+				})
+			} else if len(contSpec.Command) == 0 && !pinningPatchNeeded {
 				mainLogger.Warn("Container " + contSpec.Name + " asked exclusive cpus but command not given. CPU affinity settings possibly lost for container")
+				warnings = append(warnings, admissionWarning{
+					reason:  WarningCommandMissing,
+					message: "container " + contSpec.Name + " asked for exclusive CPUs but has no command, its CPU affinity settings are possibly lost",
+				})
 			} else {
 				pinningPatchNeeded = true
 			}
 		}
-		containerEnvPatched := false
 		if pinningPatchNeeded {
 			mainLogger.Info("Patch container for pinning " + contSpec.Name)
-
-			patchList, err = patchContainerForPinning(cpuAnnotation, patchList, contID, &contSpec)
-			if err != nil {
-				return toAdmissionResponse(err)
-			}
-			pinningPatchAdded = true
-			containerEnvPatched = true
+			setContainerForPinning(cpuAnnotation, contSpec)
+			setContainerForVerification(contSpec)
+			pinningNeeded = true
 		}
 		if poolRequests[contSpec.Name].sharedCPURequests > 0 ||
 			poolRequests[contSpec.Name].exclusiveCPURequests > 0 {
-			// Patch container environment variable
-			patchList, err = patchContainerEnv(poolRequests, containerEnvPatched, patchList, contID, &contSpec)
-			if err != nil {
-				return toAdmissionResponse(err)
-			}
+			setContainerEnv(poolRequests[contSpec.Name], contSpec)
 		}
 	}
 	// Add volumes if any container was patched for pinning
-	if pinningPatchAdded {
-		exists := false
-		for _, volume := range pod.Spec.Volumes {
-			if volume.Name == "hostbin" || volume.Name == "podinfo" {
-				exists = true
-			}
-		}
-		if !exists {
-			patchList = patchVolumesForPinning(patchList)
+	if pinningNeeded {
+		if err = checkReservedVolumes(&pod); err != nil {
+			mainLogger.Info("Pod rejected", logger.Any("pod", pod.Name), logger.Any("namespace", namespace), logger.Error(err))
+			return toInvalidResponse(err)
 		}
+		setVolumesForPinning(mutated)
+		setCPUAnnotationSignature(mutated, namespace)
 	} else if podAnnotationExists {
 		mainLogger.Error("CPU annotation exists but no container was patched", logger.Any("annotation", cpuAnnotation), logger.Any("containers", pod.Spec.Containers))
-		return toAdmissionResponse(errors.New("CPU Annotation error"))
+		return toInvalidResponse(errors.New("CPU Annotation error"))
 	}
-
-	if len(patchList) > 0 {
-		patch, err := json.Marshal(patchList)
-		if err != nil {
-			mainLogger.Error("Patch marshall error", logger.Error(err), logger.Any("patchlist", patchList))
-			reviewResponse.Allowed = false
-			return toAdmissionResponse(err)
+	if poolNodeAffinity {
+		if warning := setPoolNodeAffinity(mutated, poolRequests); warning != nil {
+			warnings = append(warnings, *warning)
 		}
-		reviewResponse.Patch = []byte(patch)
-		pt := v1beta1.PatchTypeJSONPatch
+	}
+
+	patch, err := createPatch(raw, &pod, mutated)
+	if err != nil {
+		mainLogger.Error("Patch creation error", logger.Error(err))
+		return toAdmissionResponse(err)
+	}
+	if len(patch) > 0 {
+		reviewResponse.Patch = patch
+		pt := admissionv1.PatchTypeJSONPatch
 		reviewResponse.PatchType = &pt
 	}
+	addWarnings(MutatingPath, &reviewResponse, warnings)
 
 	return &reviewResponse
 }
 
 func serveMutatePod(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, mutatePods)
+}
+
+// serveAdmission decodes the AdmissionReview of the request, and answers it with the response of the admit function
+func serveAdmission(w http.ResponseWriter, r *http.Request, admit func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) {
 	var body []byte
 	if r.Body != nil {
 		if data, err := ioutil.ReadAll(r.Body); err == nil {
@@ -434,21 +652,19 @@ func serveMutatePod(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	requestedAdmissionReview := v1beta1.AdmissionReview{}
-
-	responseAdmissionReview := v1beta1.AdmissionReview{}
-
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(body, nil, &requestedAdmissionReview); err != nil {
+	// the response is sent in the same admission API version as the request
+	request, responseReview, err := decodeAdmissionReview(body)
+	if err != nil {
 		mainLogger.Error("deserializer decode error", logger.Error(err))
-		responseAdmissionReview.Response = toAdmissionResponse(err)
-	} else {
-		responseAdmissionReview.Response = mutatePods(requestedAdmissionReview)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	start := time.Now()
+	response := admit(request)
+	response.UID = request.UID
+	recordAdmission(r.URL.Path, response, start)
 
-	responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
-
-	respBytes, err := json.Marshal(responseAdmissionReview)
+	respBytes, err := json.Marshal(responseReview(response))
 
 	if err != nil {
 		mainLogger.Error("json Marshal error", logger.Error(err))
@@ -468,24 +684,225 @@ func main() {
 		"File containing the default x509 private key matching --tls-cert-file.")
 	flag.StringVar(&processStarterPath, "process-starter-path", processStarterPath, ""+
 		"Path to process-starter binary file. Optional parameter, default path is /opt/bin/process-starter.")
-	flag.StringVar(&cfsQuotas, "cfs-quotas", QuotaAll,
+	flag.StringVar(&processStarterImage, "process-starter-image", processStarterImage, ""+
+		"Image injected as an init container copying the process starter into an emptyDir volume of the pinned pods, instead of mounting --process-starter-path from the host.\n"+
+		"An image without tag or digest is used with the version of the webhook as tag.")
+	flag.StringVar(&processStarterImageBinary, "process-starter-image-binary", processStarterImageBinary,
+		"Path of the process-starter binary inside --process-starter-image.")
+	flag.StringVar(&annotationSigningKeyFile, "annotation-signing-key-file", "", ""+
+		"PEM file of an ed25519 private key in PKCS #8 form. The approved cpus annotations are signed with it. A process starter built with the public key,\n"+
+		"which is logged at startup, refuses to start the processes of an annotation which was not signed, or was changed after admission. One built without it refuses every annotation.")
+	flag.StringVar(&policyFile, "policy-file", policyFile, ""+
+		"Optional YAML file of rules selecting pods by namespace and labels, and controlling their mutation, CFS quotas, pinning, and exclusive CPU limit.\n"+
+		"The file is reloaded when it changes.")
+	flag.StringVar(&cfsQuotas, "cfs-quotas", cfsQuotas,
 		"Controls if CPUSets automatically provisions CFS quotas for its managed containers.\n"+
 			"Possible values are:\n"+
 			"'all'    - CPUSets provisions CFS quotas for all containers\n"+
 			"'shared' - CPUSets doesn't provision quotas for containers using exclusive pools")
+	flag.StringVar(&listenAddress, "listen-address", listenAddress, "Address the webhook server listens on.")
+	flag.BoolVar(&selfManagedCerts, "self-managed-certs", false, ""+
+		"Generate a CA and a serving certificate on startup instead of using --tls-cert-file and --tls-private-key-file.\n"+
+		"The CA is published in the caBundle of the webhook configurations given by --mutating-webhook-config and --validating-webhook-config.\n"+
+		"Every start generates a new CA, so the webhook must run with a single replica in this mode.")
+	flag.StringVar(&serviceName, "service-name", serviceName, "Name of the webhook Service, used in the self-managed serving certificate.")
+	flag.StringVar(&serviceNamespace, "service-namespace", serviceNamespace, "Namespace of the webhook Service, used in the self-managed serving certificate.")
+	flag.StringVar(&mutatingConfig, "mutating-webhook-config", "", "Name of the MutatingWebhookConfiguration whose caBundle is patched in self-managed mode.")
+	flag.StringVar(&validatingConfig, "validating-webhook-config", "", "Name of the ValidatingWebhookConfiguration whose caBundle is patched in self-managed mode.")
+	flag.StringVar(&metricsAddress, "metrics-address", "", ""+
+		"Optional plain HTTP address serving /healthz and /metrics, e.g. :8080. Both are served on --listen-address too.")
+	flag.StringVar(&poolConfigMap, "pool-configmap", "", ""+
+		"Namespace/name of the pool ConfigMap, watched to keep the pools of every node selector in memory.\n"+
+		"When not set, the pool configs are read from the files matching FILE_MATCH in the pool config directory.")
+	flag.BoolVar(&poolClassInjection, "pool-class-injection", false, ""+
+		"Translate the CPU requests of the pods into pool resources, in namespaces or pods annotated with the pools to use, e.g. cmss.cn/pool-class: exclusive-pool1,shared-pool1.\n"+
+		"Integer CPU requests of Guaranteed pods are translated to exclusive CPUs, other requests to shared millicores.")
+	flag.BoolVar(&poolNodeAffinity, "pool-node-affinity", false, ""+
+		"Add a required node affinity to the pods requesting CPU pools, built from the nodeSelector of the pool configs defining all of their pools.\n"+
+		"An existing node affinity of the pod is narrowed down, not replaced.")
+	flag.BoolVar(&pinningProfiles, "pinning-profiles", false, ""+
+		"Resolve the CPUPinningProfile referenced by the cmss.cn/cpus-profile annotation of a pod into its cmss.cn/cpus annotation.")
+	flag.BoolVar(&cpuQuotaEnforcement, "cpu-quota-enforcement", false, ""+
+		"Enforce the CPUQuotas of the namespaces, which limit the exclusive CPUs and shared millicores their pods request,\n"+
+		"and keep the usage in their status up to date.")
 	flag.Parse()
 
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	mainLogger.Info("Starting webhook", logger.Any("version", version))
+	if poolConfigMap != "" {
+		if err := startPoolCatalog(); err != nil {
+			mainLogger.Error("Cannot watch the pool ConfigMap, exiting", logger.Any("configmap", poolConfigMap), logger.Error(err))
+			os.Exit(1)
+		}
+	}
+	if policyFile != "" {
+		loader, err := newPolicyLoader(policyFile)
+		if err != nil {
+			mainLogger.Error("Cannot load the webhook policy, exiting", logger.Any("file", policyFile), logger.Error(err))
+			os.Exit(1)
+		}
+		policies = loader
+	}
+	if annotationSigningKeyFile != "" {
+		if err := loadAnnotationSigningKey(); err != nil {
+			mainLogger.Error("Cannot load the annotation signing key, exiting", logger.Any("file", annotationSigningKeyFile), logger.Error(err))
+			os.Exit(1)
+		}
+		mainLogger.Info("Annotations are signed, the process starter has to be built with the public key", logger.Any("publicKey", annotationPublicKey()))
+	}
+	if poolClassInjection {
+		if err := startNamespaceLister(); err != nil {
+			mainLogger.Error("Cannot watch the namespaces, exiting", logger.Error(err))
+			os.Exit(1)
+		}
+	}
+	if pinningProfiles {
+		if err := startProfileLister(); err != nil {
+			mainLogger.Error("Cannot watch the CPUPinningProfiles, exiting", logger.Error(err))
+			os.Exit(1)
+		}
+	}
+	if cpuQuotaEnforcement {
+		if err := startCPUQuotas(); err != nil {
+			mainLogger.Error("Cannot watch the CPUQuotas, exiting", logger.Error(err))
+			os.Exit(1)
+		}
+	}
+	checkProcessStarterImageVersion()
+
+	tlsConfig, err := serverTLSConfig()
 	if err != nil {
-		mainLogger.Error("tls LoadX509KeyPair error", logger.Error(err))
+		mainLogger.Error("Cannot set up the serving certificate, exiting", logger.Error(err))
+		os.Exit(1)
 	}
 
-	http.HandleFunc("/mutating", serveMutatePod)
+	http.HandleFunc(MutatingPath, serveMutatePod)
+	http.HandleFunc(ValidatingPath, serveValidatePod)
+	registerObservabilityHandlers(http.DefaultServeMux)
+	if metricsAddress != "" {
+		mux := http.NewServeMux()
+		registerObservabilityHandlers(mux)
+		go func() {
+			if err := http.ListenAndServe(metricsAddress, mux); err != nil {
+				mainLogger.Error("Metrics server stopped", logger.Error(err))
+			}
+		}()
+	}
 	server := &http.Server{
-		Addr:         ":443",
-		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
+		Addr:         listenAddress,
+		TLSConfig:    tlsConfig,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 	}
-	server.ListenAndServeTLS("", "")
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		mainLogger.Error("Webhook server stopped", logger.Error(err))
+		os.Exit(1)
+	}
+}
+
+// startPoolCatalog replaces the local pool config files with the catalog built from the pool ConfigMap
+func startPoolCatalog() error {
+	if err := client.KubeClient(); err != nil {
+		return err
+	}
+	configMapCatalog, err := newConfigMapPoolCatalog(client.Clientset, poolConfigMap)
+	if err != nil {
+		return err
+	}
+	if !configMapCatalog.start(make(chan struct{}), catalogSyncTimeout) {
+		mainLogger.Warn("Pool catalog is not synced yet, pods are not validated against the pools until it is", logger.Any("configmap", poolConfigMap))
+	}
+	catalog = configMapCatalog
+	return nil
+}
+
+// startNamespaceLister caches the namespaces, so their pool class annotation is read without calling the API server on every admission
+func startNamespaceLister() error {
+	if err := client.KubeClient(); err != nil {
+		return err
+	}
+	factory := informers.NewSharedInformerFactory(client.Clientset, 0)
+	lister := factory.Core().V1().Namespaces().Lister()
+	stopCh := make(chan struct{})
+	factory.Start(stopCh)
+	for informerType, synced := range factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("cache of %v is not synced", informerType)
+		}
+	}
+	namespaceLister = lister
+	return nil
+}
+
+// startProfileLister caches the CPUPinningProfiles, so the pods referencing them are mutated without calling the API server
+func startProfileLister() error {
+	if err := client.KubeClient(); err != nil {
+		return err
+	}
+	dynamicClient, err := dynamic.NewForConfig(client.RestConfig)
+	if err != nil {
+		return err
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	informer := factory.ForResource(cpusetsv1alpha1.CPUPinningProfileResource)
+	stopCh := make(chan struct{})
+	factory.Start(stopCh)
+	for resource, synced := range factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("cache of %v is not synced", resource)
+		}
+	}
+	profileLister = informer.Lister()
+	return nil
+}
+
+// startCPUQuotas caches the pods and the CPUQuotas of the cluster, and keeps the status of the CPUQuotas up to date
+func startCPUQuotas() error {
+	if err := client.KubeClient(); err != nil {
+		return err
+	}
+	dynamicClient, err := dynamic.NewForConfig(client.RestConfig)
+	if err != nil {
+		return err
+	}
+	tracker := newQuotaTracker(client.Clientset, dynamicClient)
+	stopCh := make(chan struct{})
+	if !tracker.start(stopCh) {
+		return errors.New("caches of the pods and the CPUQuotas are not synced")
+	}
+	go tracker.runStatusUpdates(stopCh)
+	cpuQuotas = tracker
+	return nil
+}
+
+// serverTLSConfig either serves the configured certificate files, reloading them when rotated,
+// or generates its own certificates, and publishes the CA in the webhook configurations
+func serverTLSConfig() (*tls.Config, error) {
+	if !selfManagedCerts {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{GetCertificate: reloader.GetCertificate}, nil
+	}
+	cert, caBundle, err := generateSelfManagedCerts(serviceDNSNames(serviceName, serviceNamespace))
+	if err != nil {
+		return nil, err
+	}
+	if mutatingConfig != "" || validatingConfig != "" {
+		if err := client.KubeClient(); err != nil {
+			return nil, err
+		}
+	}
+	if mutatingConfig != "" {
+		if err := client.SetMutatingWebhookCABundle(client.Clientset, mutatingConfig, caBundle); err != nil {
+			return nil, err
+		}
+	}
+	if validatingConfig != "" {
+		if err := client.SetValidatingWebhookCABundle(client.Clientset, validatingConfig, caBundle); err != nil {
+			return nil, err
+		}
+	}
+	mainLogger.Info("Serving self-managed certificate", logger.Any("service", serviceName), logger.Any("namespace", serviceNamespace))
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
 }
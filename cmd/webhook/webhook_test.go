@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	apitypes "k8s.io/apimachinery/pkg/types"
+)
+
+var podResource = metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+
+func sharedPoolPod(t *testing.T) runtime.RawExtension {
+	pod := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:    "app",
+			Command: []string{"/bin/app"},
+			Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{"cmss.cn/shared-pool": resource.MustParse("200")},
+			},
+		}}},
+	}
+	raw, err := json.Marshal(&pod)
+	assert.Nil(t, err)
+	return runtime.RawExtension{Raw: raw}
+}
+
+func postAdmissionReview(t *testing.T, review interface{}) *httptest.ResponseRecorder {
+	body, err := json.Marshal(review)
+	assert.Nil(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/mutating", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	serveMutatePod(recorder, req)
+	return recorder
+}
+
+func TestServeMutatePodAdmissionV1(t *testing.T) {
+	assert := assert.New(t)
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       apitypes.UID("v1-uid"),
+			Resource:  podResource,
+			Operation: admissionv1.Create,
+			Object:    sharedPoolPod(t),
+		},
+	}
+	recorder := postAdmissionReview(t, review)
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	response := admissionv1.AdmissionReview{}
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal("admission.k8s.io/v1", response.APIVersion)
+	assert.Equal("AdmissionReview", response.Kind)
+	assert.Equal(apitypes.UID("v1-uid"), response.Response.UID)
+	assert.True(response.Response.Allowed)
+	assert.Equal(admissionv1.PatchTypeJSONPatch, *response.Response.PatchType)
+	assert.Contains(string(response.Response.Patch), "CPU_POOLS")
+}
+
+func TestServeMutatePodAdmissionV1beta1(t *testing.T) {
+	assert := assert.New(t)
+	review := v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &v1beta1.AdmissionRequest{
+			UID:       apitypes.UID("v1beta1-uid"),
+			Resource:  podResource,
+			Operation: v1beta1.Create,
+			Object:    sharedPoolPod(t),
+		},
+	}
+	recorder := postAdmissionReview(t, review)
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	response := v1beta1.AdmissionReview{}
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal("admission.k8s.io/v1beta1", response.APIVersion)
+	assert.Equal(apitypes.UID("v1beta1-uid"), response.Response.UID)
+	assert.True(response.Response.Allowed)
+	assert.Equal(v1beta1.PatchTypeJSONPatch, *response.Response.PatchType)
+	assert.Contains(string(response.Response.Patch), "CPU_POOLS")
+}
+
+func TestServeMutatePodRejectsMalformedReview(t *testing.T) {
+	assert := assert.New(t)
+	recorder := postAdmissionReview(t, admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+	})
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+
+	recorder = postAdmissionReview(t, corev1.Pod{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}})
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+}
+
+func TestGetCPUPoolRequests(t *testing.T) {
+	tests := []struct {
+		name          string
+		limits        corev1.ResourceList
+		wantErr       bool
+		wantShared    int
+		wantExclusive int
+		wantPools     map[string]int
+	}{
+		{
+			name:       "shared millicores",
+			limits:     corev1.ResourceList{"cmss.cn/shared-pool": resource.MustParse("200")},
+			wantShared: 200,
+			wantPools:  map[string]int{"shared-pool": 200},
+		},
+		{
+			name:       "decimal suffix with fraction",
+			limits:     corev1.ResourceList{"cmss.cn/shared-pool": resource.MustParse("1.5k")},
+			wantShared: 1500,
+			wantPools:  map[string]int{"shared-pool": 1500},
+		},
+		{
+			name:       "mega suffix",
+			limits:     corev1.ResourceList{"cmss.cn/shared-pool": resource.MustParse("1M")},
+			wantShared: 1000000,
+			wantPools:  map[string]int{"shared-pool": 1000000},
+		},
+		{
+			name:          "binary suffix",
+			limits:        corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse("1Ki")},
+			wantExclusive: 1024,
+			wantPools:     map[string]int{"exclusive-pool": 1024},
+		},
+		{
+			name: "exclusive and shared",
+			limits: corev1.ResourceList{
+				"cmss.cn/exclusive-pool": resource.MustParse("2"),
+				"cmss.cn/shared-pool":    resource.MustParse("100"),
+				corev1.ResourceCPU:       resource.MustParse("500m"),
+			},
+			wantShared:    100,
+			wantExclusive: 2,
+			wantPools:     map[string]int{"exclusive-pool": 2, "shared-pool": 100},
+		},
+		{
+			name:    "fractional exclusive",
+			limits:  corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse("1500m")},
+			wantErr: true,
+		},
+		{
+			name:    "fractional shared",
+			limits:  corev1.ResourceList{"cmss.cn/shared-pool": resource.MustParse("0.5")},
+			wantErr: true,
+		},
+		{
+			name:    "too large",
+			limits:  corev1.ResourceList{"cmss.cn/shared-pool": resource.MustParse("1E")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:      "app",
+				Resources: corev1.ResourceRequirements{Limits: tt.limits},
+			}}}}
+			requests, err := getCPUPoolRequests(pod)
+			if tt.wantErr {
+				assert.NotNil(err)
+				return
+			}
+			assert.Nil(err)
+			assert.Equal(tt.wantShared, requests["app"].sharedCPURequests)
+			assert.Equal(tt.wantExclusive, requests["app"].exclusiveCPURequests)
+			assert.Equal(tt.wantPools, requests["app"].pools)
+		})
+	}
+}
+
+func TestSetCPULimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		cpuTime   int
+		wantLimit string
+	}{
+		{name: "millicores", cpuTime: 1100, wantLimit: "1100m"},
+		{name: "whole cpus", cpuTime: 2000, wantLimit: "2"},
+		{name: "below one cpu", cpuTime: 150, wantLimit: "150m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			c := &corev1.Container{}
+			setCPULimit(tt.cpuTime, c)
+			assert.Equal(tt.wantLimit, c.Resources.Limits.Cpu().String())
+			assert.True(c.Resources.Requests.Cpu().IsZero())
+		})
+	}
+}
+
+func mutate(t *testing.T, raw []byte) []byte {
+	resp := mutatePods(&admissionv1.AdmissionRequest{Resource: podResource, Object: runtime.RawExtension{Raw: raw}})
+	assert.True(t, resp.Allowed, resp.Result)
+	return resp.Patch
+}
+
+func TestMutatePodsPatchIsIdempotent(t *testing.T) {
+	assert := assert.New(t)
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:    "app",
+			Command: []string{"/bin/sh", "-c"},
+			Args:    []string{`echo "quoted \"arg\"" ', "x'`},
+			Env:     []corev1.EnvVar{{Name: "FOO", Value: "bar"}},
+			Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse("1")},
+			},
+		}, {
+			Name: "sidecar",
+			Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{"cmss.cn/shared-pool": resource.MustParse("100")},
+			},
+		}}},
+	}
+	raw, err := json.Marshal(&pod)
+	assert.Nil(err)
+
+	patch := mutate(t, raw)
+	assert.NotEmpty(patch)
+	decodedPatch, err := jsonpatch.DecodePatch(patch)
+	assert.Nil(err)
+	patched, err := decodedPatch.Apply(raw)
+	assert.Nil(err)
+
+	mutated := corev1.Pod{}
+	assert.Nil(json.Unmarshal(patched, &mutated))
+	app := mutated.Spec.Containers[0]
+	assert.Equal([]string{processStarterPath}, app.Command)
+	assert.Equal([]string{"/bin/sh", "-c", `echo "quoted \"arg\"" ', "x'`}, app.Args)
+	assert.Equal([]corev1.EnvVar{{Name: "FOO", Value: "bar"}, {Name: "CONTAINER_NAME", Value: "app"}, {Name: "CPU_POOLS", Value: "exclusive"}}, app.Env)
+	assert.Equal("1100m", app.Resources.Limits.Cpu().String())
+	assert.Len(app.VolumeMounts, 2)
+	sidecar := mutated.Spec.Containers[1]
+	assert.Empty(sidecar.Command)
+	assert.Equal([]corev1.EnvVar{{Name: "CPU_POOLS", Value: "shared"}}, sidecar.Env)
+	assert.Equal("100m", sidecar.Resources.Limits.Cpu().String())
+	assert.Len(mutated.Spec.Volumes, 2)
+
+	//reinvocationPolicy: IfNeeded calls the webhook again with the already mutated pod
+	assert.Empty(mutate(t, patched))
+}
+
+func TestMutatePodsKeepsUnknownFields(t *testing.T) {
+	assert := assert.New(t)
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:    "app",
+			Command: []string{"/bin/app"},
+			Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse("1")},
+			},
+		}}},
+	}
+	raw, err := json.Marshal(&pod)
+	assert.Nil(err)
+	//fields of a newer API version, unknown to the pod type of the webhook
+	var object map[string]interface{}
+	assert.Nil(json.Unmarshal(raw, &object))
+	spec := object["spec"].(map[string]interface{})
+	spec["futureField"] = "spec"
+	spec["containers"].([]interface{})[0].(map[string]interface{})["futureField"] = map[string]interface{}{"a/b": "container"}
+	raw, err = json.Marshal(object)
+	assert.Nil(err)
+
+	patch := mutate(t, raw)
+	assert.NotEmpty(patch)
+	assert.NotContains(string(patch), "futureField")
+	decodedPatch, err := jsonpatch.DecodePatch(patch)
+	assert.Nil(err)
+	patched, err := decodedPatch.Apply(raw)
+	assert.Nil(err)
+
+	var mutated map[string]interface{}
+	assert.Nil(json.Unmarshal(patched, &mutated))
+	spec = mutated["spec"].(map[string]interface{})
+	assert.Equal("spec", spec["futureField"])
+	app := spec["containers"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(map[string]interface{}{"a/b": "container"}, app["futureField"])
+	assert.Equal([]interface{}{processStarterPath}, app["command"])
+}
+
+func TestJSONPointerExists(t *testing.T) {
+	assert := assert.New(t)
+	var document interface{}
+	assert.Nil(json.Unmarshal([]byte(`{"a": {"b/c": [1, {"d~e": true}]}}`), &document))
+	assert.True(jsonPointerExists(document, ""))
+	assert.True(jsonPointerExists(document, "/a/b~1c/0"))
+	assert.True(jsonPointerExists(document, "/a/b~1c/1/d~0e"))
+	assert.False(jsonPointerExists(document, "/a/b"))
+	assert.False(jsonPointerExists(document, "/a/b~1c/2"))
+	assert.False(jsonPointerExists(document, "/a/b~1c/x"))
+	assert.False(jsonPointerExists(document, "/a/b~1c/0/d"))
+}
+
+func TestMutatePodsRejectsReservedVolumes(t *testing.T) {
+	assert := assert.New(t)
+	pinnedPod := func() corev1.Pod {
+		return corev1.Pod{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:    "app",
+				Command: []string{"/bin/app"},
+				Resources: corev1.ResourceRequirements{
+					Limits: corev1.ResourceList{"cmss.cn/exclusive-pool": resource.MustParse("1")},
+				},
+			}}},
+		}
+	}
+	mutateRaw := func(pod corev1.Pod) *admissionv1.AdmissionResponse {
+		raw, err := json.Marshal(&pod)
+		assert.Nil(err)
+		return mutatePods(&admissionv1.AdmissionRequest{Resource: podResource, Object: runtime.RawExtension{Raw: raw}})
+	}
+
+	//a volume of the pod replacing the process starter binary
+	pod := pinnedPod()
+	pod.Spec.Volumes = []corev1.Volume{{Name: "hostbin", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+	resp := mutateRaw(pod)
+	assert.False(resp.Allowed)
+	assert.Equal("volume name hostbin is reserved for the process starter", resp.Result.Message)
+
+	//a volume of the pod replacing the annotations the process starter reads
+	pod = pinnedPod()
+	pod.Spec.Volumes = []corev1.Volume{{Name: "podinfo", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}}}
+	resp = mutateRaw(pod)
+	assert.False(resp.Allowed)
+	assert.Equal("volume name podinfo is reserved for the process starter", resp.Result.Message)
+
+	//a mount of the pod inside the mount of the annotations
+	pod = pinnedPod()
+	pod.Spec.Volumes = []corev1.Volume{{Name: "fake", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "fake", MountPath: "/etc/podinfo/annotations"}}
+	resp = mutateRaw(pod)
+	assert.False(resp.Allowed)
+	assert.Equal("volume mount /etc/podinfo/annotations of container app is reserved for the process starter", resp.Result.Message)
+
+	//an init container writing into the volume of the process starter
+	withProcessStarterImage(t, "cpusets/process-starter")
+	pod = pinnedPod()
+	pod.Spec.Volumes = []corev1.Volume{{Name: ProcessStarterVolumeName, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+	pod.Spec.InitContainers = []corev1.Container{{Name: "setup", VolumeMounts: []corev1.VolumeMount{{Name: ProcessStarterVolumeName, MountPath: ProcessStarterMountDir}}}}
+	resp = mutateRaw(pod)
+	assert.False(resp.Allowed)
+	assert.Equal("volume mount /opt/cpusets/bin of container setup is reserved for the process starter", resp.Result.Message)
+
+	//the volumes and mounts added by the webhook are accepted when it is invoked again
+	pod = pinnedPod()
+	raw, err := json.Marshal(&pod)
+	assert.Nil(err)
+	decodedPatch, err := jsonpatch.DecodePatch(mutate(t, raw))
+	assert.Nil(err)
+	patched, err := decodedPatch.Apply(raw)
+	assert.Nil(err)
+	assert.Empty(mutate(t, patched))
+}
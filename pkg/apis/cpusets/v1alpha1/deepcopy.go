@@ -0,0 +1,194 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func deepCopyLimits(in map[string]int64) map[string]int64 {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]int64, len(in))
+	for key, val := range in {
+		out[key] = val
+	}
+	return out
+}
+
+func deepCopyContainers(in []types.Container) []types.Container {
+	if in == nil {
+		return nil
+	}
+	out := make([]types.Container, len(in))
+	for i, container := range in {
+		out[i] = container
+		if container.Processes == nil {
+			continue
+		}
+		out[i].Processes = make([]types.Process, len(container.Processes))
+		for j, process := range container.Processes {
+			out[i].Processes[j] = process
+			if process.Args != nil {
+				out[i].Processes[j].Args = append([]string{}, process.Args...)
+			}
+			if process.Env != nil {
+				out[i].Processes[j].Env = append([]types.EnvVar{}, process.Env...)
+			}
+			if process.CPUIndices != nil {
+				out[i].Processes[j].CPUIndices = append([]int{}, process.CPUIndices...)
+			}
+		}
+	}
+	return out
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *CPUQuota) DeepCopyInto(out *CPUQuota) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy copies the receiver into a new CPUQuota
+func (in *CPUQuota) DeepCopy() *CPUQuota {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUQuota)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver into a new runtime.Object
+func (in *CPUQuota) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *CPUQuotaSpec) DeepCopyInto(out *CPUQuotaSpec) {
+	*out = *in
+	out.Hard = deepCopyLimits(in.Hard)
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *CPUQuotaStatus) DeepCopyInto(out *CPUQuotaStatus) {
+	*out = *in
+	out.Hard = deepCopyLimits(in.Hard)
+	out.Used = deepCopyLimits(in.Used)
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *CPUQuotaList) DeepCopyInto(out *CPUQuotaList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]CPUQuota, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver into a new CPUQuotaList
+func (in *CPUQuotaList) DeepCopy() *CPUQuotaList {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUQuotaList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver into a new runtime.Object
+func (in *CPUQuotaList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *CPUPinningProfile) DeepCopyInto(out *CPUPinningProfile) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy copies the receiver into a new CPUPinningProfile
+func (in *CPUPinningProfile) DeepCopy() *CPUPinningProfile {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUPinningProfile)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver into a new runtime.Object
+func (in *CPUPinningProfile) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *CPUPinningProfileSpec) DeepCopyInto(out *CPUPinningProfileSpec) {
+	*out = *in
+	out.Containers = deepCopyContainers(in.Containers)
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *CPUPinningProfileList) DeepCopyInto(out *CPUPinningProfileList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]CPUPinningProfile, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver into a new CPUPinningProfileList
+func (in *CPUPinningProfileList) DeepCopy() *CPUPinningProfileList {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUPinningProfileList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver into a new runtime.Object
+func (in *CPUPinningProfileList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the API group of the CPUSets custom resources
+const GroupName = "cpusets.cmss.cn"
+
+var (
+	// SchemeGroupVersion is the group version of the CPUSets custom resources
+	SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+	// CPUQuotaResource is the resource of the CPUQuotas
+	CPUQuotaResource = SchemeGroupVersion.WithResource("cpuquotas")
+	// CPUPinningProfileResource is the resource of the CPUPinningProfiles
+	CPUPinningProfileResource = SchemeGroupVersion.WithResource("cpupinningprofiles")
+
+	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes)
+	AddToScheme   = SchemeBuilder.AddToScheme
+)
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(SchemeGroupVersion, &CPUQuota{}, &CPUQuotaList{}, &CPUPinningProfile{}, &CPUPinningProfileList{})
+	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
+	return nil
+}
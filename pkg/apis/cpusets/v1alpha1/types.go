@@ -0,0 +1,75 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"github.com/kubeservice-stack/cpusets-controller/pkg/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CPUQuota limits the CPU pool resources the pods of its namespace hold together
+// Every CPUQuota of a namespace is enforced, a pod is admitted only if it fits into all of them
+type CPUQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CPUQuotaSpec   `json:"spec"`
+	Status CPUQuotaStatus `json:"status,omitempty"`
+}
+
+// CPUQuotaSpec defines the limits of a CPUQuota
+type CPUQuotaSpec struct {
+	// Hard limits the pool resources by pool type
+	// exclusive is the number of CPUs summed across all exclusive pools, shared is the millicores summed across all shared pools
+	Hard map[string]int64 `json:"hard"`
+}
+
+// CPUQuotaStatus shows the limits and the pool resources held by the pods of the namespace
+type CPUQuotaStatus struct {
+	Hard map[string]int64 `json:"hard,omitempty"`
+	Used map[string]int64 `json:"used,omitempty"`
+}
+
+// CPUQuotaList is a list of CPUQuotas
+type CPUQuotaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []CPUQuota `json:"items"`
+}
+
+// CPUPinningProfile holds a named process layout, which pods of its namespace reference instead of inlining the cpus annotation
+type CPUPinningProfile struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CPUPinningProfileSpec `json:"spec"`
+}
+
+// CPUPinningProfileSpec defines the processes of a CPUPinningProfile
+type CPUPinningProfileSpec struct {
+	// Containers lists the processes started in the containers, the same way as the cpus annotation does
+	Containers []types.Container `json:"containers"`
+}
+
+// CPUPinningProfileList is a list of CPUPinningProfiles
+type CPUPinningProfileList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []CPUPinningProfile `json:"items"`
+}
@@ -17,9 +17,16 @@ limitations under the License.
 package checkpoint
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
 	cp "k8s.io/kubernetes/pkg/kubelet/cm/devicemanager/checkpoint"
 )
 
+// KubeletCheckpointFile is the location of the kubelet Device Manager's internal checkpoint file
+var KubeletCheckpointFile = "/var/lib/kubelet/device-plugins/kubelet_internal_checkpoint"
+
 // PodDevicesEntry is representing Pod specific deviceID allocations from kubelet checkpoint file structure - valid until K8s 1.20
 // TODO: REMOVE THIS TPYE AFTER 1.20 SUPPORT IS DROPPED
 type PodDevicesEntry struct {
@@ -70,3 +77,22 @@ func TranslateNewCheckpointToOld(newFile NewFile) File {
 	}
 	return oldFile
 }
+
+// ReadFile reads the kubelet Device Manager checkpoint file and returns it in the pre 1.21 representation
+// Both the old and the 1.21+ file structures are accepted
+func ReadFile(fileName string) (File, error) {
+	var cp File
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return cp, fmt.Errorf("kubelet checkpoint file could not be accessed because: %s", err)
+	}
+	if err = json.Unmarshal(buf, &cp); err != nil {
+		//K8s 1.21 changed internal file structure, so let's try that too before returning with error
+		var newCpFile NewFile
+		if err = json.Unmarshal(buf, &newCpFile); err != nil {
+			return cp, err
+		}
+		cp = TranslateNewCheckpointToOld(newCpFile)
+	}
+	return cp, nil
+}
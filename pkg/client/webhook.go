@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sclient "k8s.io/client-go/kubernetes"
+)
+
+// SetMutatingWebhookCABundle sets the CA bundle of every webhook of the MutatingWebhookConfiguration
+func SetMutatingWebhookCABundle(k8sclient k8sclient.Interface, name string, caBundle []byte) error {
+	configs := k8sclient.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	webhookConfig, err := configs.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i := range webhookConfig.Webhooks {
+		if !bytes.Equal(webhookConfig.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			webhookConfig.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	_, err = configs.Update(context.TODO(), webhookConfig, metav1.UpdateOptions{})
+	return err
+}
+
+// SetValidatingWebhookCABundle sets the CA bundle of every webhook of the ValidatingWebhookConfiguration
+func SetValidatingWebhookCABundle(k8sclient k8sclient.Interface, name string, caBundle []byte) error {
+	configs := k8sclient.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	webhookConfig, err := configs.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i := range webhookConfig.Webhooks {
+		if !bytes.Equal(webhookConfig.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			webhookConfig.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	_, err = configs.Update(context.TODO(), webhookConfig, metav1.UpdateOptions{})
+	return err
+}
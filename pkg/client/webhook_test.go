@@ -0,0 +1,55 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetWebhookCABundle(t *testing.T) {
+	assert := assert.New(t)
+	fakeClient := k8sfake.NewSimpleClientset(
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "cpusets"},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "mutating.cmss.cn"}, {Name: "other.cmss.cn"}},
+		},
+		&admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "cpusets"},
+			Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "validating.cmss.cn"}},
+		},
+	)
+	assert.Nil(SetMutatingWebhookCABundle(fakeClient, "cpusets", []byte("ca")))
+	assert.Nil(SetValidatingWebhookCABundle(fakeClient, "cpusets", []byte("ca")))
+
+	mutating, err := fakeClient.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), "cpusets", metav1.GetOptions{})
+	assert.Nil(err)
+	for _, webhook := range mutating.Webhooks {
+		assert.Equal([]byte("ca"), webhook.ClientConfig.CABundle)
+	}
+	validating, err := fakeClient.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.TODO(), "cpusets", metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal([]byte("ca"), validating.Webhooks[0].ClientConfig.CABundle)
+
+	assert.NotNil(SetMutatingWebhookCABundle(fakeClient, "missing", []byte("ca")))
+}
@@ -17,7 +17,6 @@ limitations under the License.
 package controller
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -296,25 +295,27 @@ func (cc *CpuSetController) adjustContainerSets(pod v1.Pod, containersToBeSet ma
 }
 
 func (cc *CpuSetController) determineCorrectCpuset(pod v1.Pod, container v1.Container) (cpuset.CPUSet, error) {
-	var (
-		sharedCPUSet, exclusiveCPUSet cpuset.CPUSet
-		err                           error
-	)
+	var sharedCPUSet, exclusiveCPUSet cpuset.CPUSet
 	for resourceName := range container.Resources.Requests {
 		resNameAsString := string(resourceName)
-		if strings.Contains(resNameAsString, resourceBaseName) && strings.Contains(resNameAsString, types.SharedPoolID) {
-			sharedCPUSet = cc.poolConfig.SelectPoolConfig(types.SharedPoolID).CPUset
-		} else if strings.Contains(resNameAsString, resourceBaseName) && strings.Contains(resNameAsString, types.ExclusivePoolID) {
-			exclusiveCPUSet, err = cc.getListOfAllocatedExclusiveCpus(resNameAsString, pod, container)
+		if !strings.HasPrefix(resNameAsString, resourceBaseName+"/") {
+			continue
+		}
+		poolName := strings.TrimPrefix(resNameAsString, resourceBaseName+"/")
+		switch types.DeterminePoolType(poolName) {
+		case types.SharedPoolID:
+			//Every shared pool is its own resource, the container gets the CPUs of exactly the pools it asked for
+			sharedCPUSet = sharedCPUSet.Union(cc.poolConfig.Pools[poolName].CPUset)
+		case types.ExclusivePoolID:
+			poolCPUSet, err := cc.getListOfAllocatedExclusiveCpus(resNameAsString, pod, container)
 			if err != nil {
 				return cpuset.CPUSet{}, err
 			}
-			fullResName := strings.Split(resNameAsString, "/")
-			exclusivePoolName := fullResName[1]
-			if cc.poolConfig.SelectPoolConfig(exclusivePoolName).HTPolicy == types.MultiThreadHTPolicy {
+			if cc.poolConfig.Pools[poolName].AllocatesHTSiblings() {
 				htMap := topology.GetHTTopology()
-				exclusiveCPUSet = topology.AddHTSiblingsToCPUSet(exclusiveCPUSet, htMap)
+				poolCPUSet = topology.AddHTSiblingsToCPUSet(poolCPUSet, htMap)
 			}
+			exclusiveCPUSet = exclusiveCPUSet.Union(poolCPUSet)
 		}
 	}
 	if !sharedCPUSet.IsEmpty() || !exclusiveCPUSet.IsEmpty() {
@@ -324,21 +325,10 @@ func (cc *CpuSetController) determineCorrectCpuset(pod v1.Pod, container v1.Cont
 }
 
 func (cc *CpuSetController) getListOfAllocatedExclusiveCpus(exclusivePoolName string, pod v1.Pod, container v1.Container) (cpuset.CPUSet, error) {
-	checkpointFileName := "/var/lib/kubelet/device-plugins/kubelet_internal_checkpoint"
-	buf, err := ioutil.ReadFile(checkpointFileName)
+	cp, err := checkpoint.ReadFile(checkpoint.KubeletCheckpointFile)
 	if err != nil {
-		controllerLogger.Error("Error reading checkpointFileName file", logger.Any("checkpointFileName", checkpointFileName), logger.Error(err))
-		return cpuset.CPUSet{}, fmt.Errorf("kubelet checkpoint file could not be accessed because: %s", err)
-	}
-	var cp checkpoint.File
-	if err = json.Unmarshal(buf, &cp); err != nil {
-		//K8s 1.21 changed internal file structure, so let's try that too before returning with error
-		var newCpFile checkpoint.NewFile
-		if err = json.Unmarshal(buf, &newCpFile); err != nil {
-			controllerLogger.Error("error unmarshalling kubelet checkpoint file", logger.Error(err))
-			return cpuset.CPUSet{}, err
-		}
-		cp = checkpoint.TranslateNewCheckpointToOld(newCpFile)
+		controllerLogger.Error("Error reading kubelet checkpoint file", logger.Any("checkpointFileName", checkpoint.KubeletCheckpointFile), logger.Error(err))
+		return cpuset.CPUSet{}, err
 	}
 	podIDStr := string(pod.ObjectMeta.UID)
 	deviceIDs := []string{}
@@ -99,3 +99,31 @@ func listAndParseCores(attribute string) map[int]int {
 	}
 	return coreMap
 }
+
+// GetHTSiblings returns the other threads of the physical core the given logical CPU belongs to
+// coreMap is the physical coreID-list of logical coreIDs association returned by GetHTTopology
+func GetHTSiblings(cpuID int, coreMap map[int]string) cpuset.CPUSet {
+	for physicalCoreID, siblings := range coreMap {
+		siblingSet, err := cpuset.Parse(siblings)
+		if err != nil {
+			continue
+		}
+		core := siblingSet.Union(cpuset.NewCPUSet(physicalCoreID))
+		if core.Contains(cpuID) {
+			return core.Difference(cpuset.NewCPUSet(cpuID))
+		}
+	}
+	return cpuset.NewCPUSet()
+}
+
+// GetThreadsPerCore returns the largest number of threads the physical cores of the given CPUs have
+// coreMap is the physical coreID-list of logical coreIDs association returned by GetHTTopology
+func GetThreadsPerCore(cpus cpuset.CPUSet, coreMap map[int]string) int {
+	threads := 1
+	for _, cpuID := range cpus.ToSlice() {
+		if coreThreads := GetHTSiblings(cpuID, coreMap).Size() + 1; coreThreads > threads {
+			threads = coreThreads
+		}
+	}
+	return threads
+}
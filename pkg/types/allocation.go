@@ -0,0 +1,50 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// AllocationInfo describes the CPUs allocated to a container from one pool
+// The device plugin can mount it into the container as a JSON file, so workloads do not depend on environment inheritance
+type AllocationInfo struct {
+	// Pool is the name of the pool the CPUs were allocated from
+	Pool string `json:"pool"`
+	// PoolType is either shared or exclusive
+	PoolType string `json:"poolType"`
+	// CPUs is the allocated set in cpuset list format, e.g. "2-3,6"
+	CPUs string `json:"cpus"`
+	// CPUList is the allocated set as a sorted list of CPU IDs
+	CPUList []int `json:"cpuList"`
+	// NUMANodes lists the NUMA nodes of the allocated CPUs
+	NUMANodes []int `json:"numaNodes,omitempty"`
+	// HTSiblings maps the allocated CPUs to the sibling threads of their physical core, in cpuset list format
+	HTSiblings map[int]string `json:"htSiblings,omitempty"`
+}
+
+// ReadAllocationInfo reads an allocation file mounted by the device plugin
+func ReadAllocationInfo(fileName string) (AllocationInfo, error) {
+	var info AllocationInfo
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(buf, &info)
+	return info, err
+}
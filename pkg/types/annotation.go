@@ -17,12 +17,48 @@ limitations under the License.
 package types
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
 	"strings"
 
 	"github.com/kubeservice-stack/common/pkg/logger"
 )
 
+// Versions of the cpus annotation
+// v1 is a bare JSON array of containers, v2 is an object with an apiVersion and the containers
+const (
+	CPUAnnotationV1 = "v1"
+	CPUAnnotationV2 = "v2"
+)
+
+// Scheduling policies of the processes
+const (
+	SchedPolicyOther = "other"
+	SchedPolicyBatch = "batch"
+	SchedPolicyIdle  = "idle"
+	SchedPolicyFIFO  = "fifo"
+	SchedPolicyRR    = "rr"
+)
+
+// Restart policies of the processes
+// A process exiting without being restarted stops the container with its exit code, unless it succeeded with the OnFailure policy
+const (
+	RestartPolicyNever     = "Never"
+	RestartPolicyOnFailure = "OnFailure"
+	RestartPolicyAlways    = "Always"
+)
+
+// Limits of the scheduling settings
+const (
+	MinRealtimePriority = 1
+	MaxRealtimePriority = 99
+	MinNice             = -20
+	MaxNice             = 19
+)
+
 // Process defines Process Information in pod annotation
 // The information is used for setting CPU-Affinity
 type Process struct {
@@ -30,6 +66,22 @@ type Process struct {
 	Args     []string `json:"args"`
 	CPUs     int      `json:"cpus"`
 	PoolName string   `json:"pool"`
+
+	// The fields below need the v2 annotation
+	Env           []EnvVar `json:"env,omitempty"`
+	WorkingDir    string   `json:"workingDir,omitempty"`
+	SchedPolicy   string   `json:"schedPolicy,omitempty"`
+	SchedPriority int      `json:"schedPriority,omitempty"`
+	Nice          int      `json:"nice,omitempty"`
+	// CPUIndices picks the CPUs of the process from the CPUs the container got from an exclusive pool, counted from 0 in ascending order
+	CPUIndices    []int  `json:"cpuIndices,omitempty"`
+	RestartPolicy string `json:"restartPolicy,omitempty"`
+}
+
+// EnvVar is an environment variable set for a process, on top of the environment of the container
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
 // Container idenfifies container and defines the processes to be started
@@ -38,6 +90,31 @@ type Container struct {
 	Processes []Process `json:"processes"`
 }
 
+// AnnotationError points at the container of the annotation, and the process of it, which is invalid
+// Process is -1 when the container itself is invalid
+type AnnotationError struct {
+	Container int
+	Process   int
+	Err       error
+}
+
+func (e *AnnotationError) Error() string {
+	if e.Process < 0 {
+		return fmt.Sprintf("containers[%d]: %s", e.Container, e.Err.Error())
+	}
+	return fmt.Sprintf("containers[%d].processes[%d]: %s", e.Container, e.Process, e.Err.Error())
+}
+
+func (e *AnnotationError) Unwrap() error {
+	return e.Err
+}
+
+// annotationV2 is the envelope of the v2 annotation
+type annotationV2 struct {
+	APIVersion string      `json:"apiVersion"`
+	Containers []Container `json:"containers"`
+}
+
 type CPUAnnotation map[string]Container
 
 // NewCPUAnnotation returns a new CPUAnnotation
@@ -126,11 +203,9 @@ func (cpuAnnotation CPUAnnotation) ContainerTotalCPURequest(pool string, cName s
 }
 
 // Decode unmarshals json annotation to CPUAnnotation
+// Both the v1 array and the v2 object are accepted, the fields added in v2 are refused in a v1 annotation
 func (cpuAnnotation CPUAnnotation) Decode(annotation []byte) error {
-	// The annotation in pod spec could be a map but for now
-	// it is kept as an array for backwards compatibility
-	containers := make([]Container, 0)
-	err := json.Unmarshal(annotation, &containers)
+	containers, apiVersion, err := decodeContainers(annotation)
 	for _, container := range containers {
 		cpuAnnotation[container.Name] = container
 	}
@@ -138,24 +213,144 @@ func (cpuAnnotation CPUAnnotation) Decode(annotation []byte) error {
 		typesLogger.Error("CPUAnnotation Decode Error!", logger.Error(err))
 		return err
 	}
-	for _, c := range cpuAnnotation {
+	for i, c := range containers {
 		if len(c.Name) == 0 {
-			return ErrNoContainerName
+			return &AnnotationError{Container: i, Process: -1, Err: ErrNoContainerName}
 		}
 		if len(c.Processes) == 0 {
-			return ErrNoProcesses
-
+			return &AnnotationError{Container: i, Process: -1, Err: ErrNoProcesses}
 		}
-		for _, p := range c.Processes {
-			if len(p.ProcName) == 0 {
-				return ErrNoProcessName
-
+		usedIndices := make(map[string]map[int]int)
+		for j, p := range c.Processes {
+			if err := p.validate(apiVersion); err != nil {
+				return &AnnotationError{Container: i, Process: j, Err: err}
 			}
-			if p.CPUs == 0 {
-				return ErrNoCpus
+			if usedIndices[p.PoolName] == nil {
+				usedIndices[p.PoolName] = make(map[int]int)
+			}
+			for _, index := range p.CPUIndices {
+				if other, used := usedIndices[p.PoolName][index]; used {
+					return &AnnotationError{Container: i, Process: j, Err: fmt.Errorf("%w: CPU %d is already given to process %d", ErrInvalidCPUIndices, index, other)}
+				}
+				usedIndices[p.PoolName][index] = j
+			}
+		}
+	}
+	return nil
+}
 
+// decodeContainers unmarshals the containers of the annotation, and tells its version
+func decodeContainers(annotation []byte) ([]Container, string, error) {
+	// The annotation in pod spec could be a map but for now
+	// it is kept as an array for backwards compatibility
+	trimmed := bytes.TrimSpace(annotation)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		containers := make([]Container, 0)
+		err := json.Unmarshal(annotation, &containers)
+		return containers, CPUAnnotationV1, err
+	}
+	envelope := annotationV2{}
+	if err := json.Unmarshal(annotation, &envelope); err != nil {
+		return nil, "", err
+	}
+	switch envelope.APIVersion {
+	case CPUAnnotationV1, CPUAnnotationV2:
+		return envelope.Containers, envelope.APIVersion, nil
+	case "":
+		return nil, "", ErrNoAPIVersion
+	default:
+		return nil, "", fmt.Errorf("%w: %q", ErrUnsupportedAPIVersion, envelope.APIVersion)
+	}
+}
+
+// validate checks the fields of the process allowed in the version of the annotation
+func (p Process) validate(apiVersion string) error {
+	if len(p.ProcName) == 0 {
+		return ErrNoProcessName
+	}
+	if p.CPUs == 0 {
+		return ErrNoCpus
+	}
+	if apiVersion == CPUAnnotationV1 {
+		if field := p.v2Field(); field != "" {
+			return fmt.Errorf("%w: %s", ErrFieldNeedsV2, field)
+		}
+		return nil
+	}
+	for _, env := range p.Env {
+		if env.Name == "" || strings.Contains(env.Name, "=") {
+			return fmt.Errorf("%w: %q", ErrInvalidEnv, env.Name)
+		}
+	}
+	if p.WorkingDir != "" && !path.IsAbs(p.WorkingDir) {
+		return fmt.Errorf("%w: %q", ErrRelativeWorkingDir, p.WorkingDir)
+	}
+	switch p.SchedPolicy {
+	case "", SchedPolicyOther, SchedPolicyBatch, SchedPolicyIdle:
+		if p.SchedPriority != 0 {
+			return fmt.Errorf("%w: %d is only allowed with the %s and %s policies", ErrInvalidSchedPriority, p.SchedPriority, SchedPolicyFIFO, SchedPolicyRR)
+		}
+	case SchedPolicyFIFO, SchedPolicyRR:
+		if p.SchedPriority < MinRealtimePriority || p.SchedPriority > MaxRealtimePriority {
+			return fmt.Errorf("%w: %d is not between %d and %d", ErrInvalidSchedPriority, p.SchedPriority, MinRealtimePriority, MaxRealtimePriority)
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidSchedPolicy, p.SchedPolicy)
+	}
+	if p.Nice < MinNice || p.Nice > MaxNice {
+		return fmt.Errorf("%w: %d is not between %d and %d", ErrInvalidNice, p.Nice, MinNice, MaxNice)
+	}
+	if len(p.CPUIndices) > 0 {
+		if DeterminePoolType(p.PoolName) != ExclusivePoolID {
+			return fmt.Errorf("%w: CPUs can only be picked from an exclusive pool", ErrInvalidCPUIndices)
+		}
+		if len(p.CPUIndices) != p.CPUs {
+			return fmt.Errorf("%w: %d indices are given for %d CPUs", ErrInvalidCPUIndices, len(p.CPUIndices), p.CPUs)
+		}
+		seen := make(map[int]bool)
+		for _, index := range p.CPUIndices {
+			if index < 0 || seen[index] {
+				return fmt.Errorf("%w: %v", ErrInvalidCPUIndices, p.CPUIndices)
 			}
+			seen[index] = true
 		}
 	}
+	switch p.RestartPolicy {
+	case "", RestartPolicyNever, RestartPolicyOnFailure, RestartPolicyAlways:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidRestartPolicy, p.RestartPolicy)
+	}
 	return nil
 }
+
+// v2Field returns the name of a field set in the process which needs the v2 annotation
+func (p Process) v2Field() string {
+	switch {
+	case len(p.Env) > 0:
+		return "env"
+	case p.WorkingDir != "":
+		return "workingDir"
+	case p.SchedPolicy != "":
+		return "schedPolicy"
+	case p.SchedPriority != 0:
+		return "schedPriority"
+	case p.Nice != 0:
+		return "nice"
+	case len(p.CPUIndices) > 0:
+		return "cpuIndices"
+	case p.RestartPolicy != "":
+		return "restartPolicy"
+	}
+	return ""
+}
+
+// Encode marshals the CPUAnnotation into a v2 annotation, with the containers ordered by name
+func (cpuAnnotation CPUAnnotation) Encode() ([]byte, error) {
+	names := cpuAnnotation.ContainerNames()
+	sort.Strings(names)
+	envelope := annotationV2{APIVersion: CPUAnnotationV2, Containers: make([]Container, 0, len(names))}
+	for _, name := range names {
+		envelope.Containers = append(envelope.Containers, cpuAnnotation[name])
+	}
+	return json.Marshal(envelope)
+}
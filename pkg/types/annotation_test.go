@@ -93,7 +93,8 @@ func (s *AnnotationTestSuit) TestContainerDecodeAnnotationNoContainerName() {
 	ca := CPUAnnotation{}
 	err := ca.Decode([]byte(podannotation))
 	s.NotNil(err)
-	s.Equal(err, ErrNoContainerName)
+	s.ErrorIs(err, ErrNoContainerName)
+	s.EqualError(err, "containers[0]: "+ErrNoContainerName.Error())
 }
 
 func (s *AnnotationTestSuit) TestContainerDecodeAnnotationNoProcessName() {
@@ -101,7 +102,8 @@ func (s *AnnotationTestSuit) TestContainerDecodeAnnotationNoProcessName() {
 	ca := CPUAnnotation{}
 	err := ca.Decode([]byte(podannotation))
 	s.NotNil(err)
-	s.Equal(err, ErrNoProcessName)
+	s.ErrorIs(err, ErrNoProcessName)
+	s.EqualError(err, "containers[0].processes[0]: "+ErrNoProcessName.Error())
 }
 
 func (s *AnnotationTestSuit) TestContainerDecodeAnnotationNoProcesses() {
@@ -109,7 +111,8 @@ func (s *AnnotationTestSuit) TestContainerDecodeAnnotationNoProcesses() {
 	ca := CPUAnnotation{}
 	err := ca.Decode([]byte(podannotation))
 	s.NotNil(err)
-	s.Equal(err, ErrNoProcesses)
+	s.ErrorIs(err, ErrNoProcesses)
+	s.EqualError(err, "containers[0]: "+ErrNoProcesses.Error())
 }
 
 func (s *AnnotationTestSuit) TestContainerDecodeAnnotationNoCpus() {
@@ -117,7 +120,97 @@ func (s *AnnotationTestSuit) TestContainerDecodeAnnotationNoCpus() {
 	ca := CPUAnnotation{}
 	err := ca.Decode([]byte(podannotation))
 	s.NotNil(err)
-	s.Equal(err, ErrNoCpus)
+	s.ErrorIs(err, ErrNoCpus)
+	s.EqualError(err, "containers[0].processes[0]: "+ErrNoCpus.Error())
+}
+
+func (s *AnnotationTestSuit) TestContainerDecodeAnnotationV2() {
+	var podannotation = []byte(`{"apiVersion": "v2", "containers": [{"container": "app", "processes": [
+		{"process": "/usr/bin/testpmd", "args": ["-l", "0-1"], "cpus": 2, "pool": "exclusive-pool1",
+		 "env": [{"name": "RTE_SDK", "value": "/opt/dpdk"}], "workingDir": "/opt/dpdk", "schedPolicy": "fifo", "schedPriority": 50,
+		 "cpuIndices": [3, 1], "restartPolicy": "OnFailure"},
+		{"process": "/bin/agent", "cpus": 100, "pool": "shared-pool1", "schedPolicy": "batch", "nice": 10}]}]}`)
+	ca := CPUAnnotation{}
+	s.Nil(ca.Decode(podannotation))
+	process := ca["app"].Processes[0]
+	s.Equal([]EnvVar{{Name: "RTE_SDK", Value: "/opt/dpdk"}}, process.Env)
+	s.Equal("/opt/dpdk", process.WorkingDir)
+	s.Equal(SchedPolicyFIFO, process.SchedPolicy)
+	s.Equal(50, process.SchedPriority)
+	s.Equal([]int{3, 1}, process.CPUIndices)
+	s.Equal(RestartPolicyOnFailure, process.RestartPolicy)
+	s.Equal(10, ca["app"].Processes[1].Nice)
+}
+
+func (s *AnnotationTestSuit) TestContainerDecodeAnnotationVersions() {
+	tests := []struct {
+		name       string
+		annotation string
+		err        error
+		message    string
+	}{
+		{"v1 object", `{"apiVersion": "v1", "containers": [{"container": "app", "processes": [{"process": "/bin/app", "cpus": 1, "pool": "shared"}]}]}`, nil, ""},
+		{"v2 field in v1", `[{"container": "app", "processes": [{"process": "/bin/app", "cpus": 1, "pool": "shared"}, {"process": "/bin/app", "cpus": 1, "pool": "shared", "nice": 5}]}]`,
+			ErrFieldNeedsV2, "containers[0].processes[1]: field needs apiVersion v2 of the annotation: nice"},
+		{"missing apiVersion", `{"containers": []}`, ErrNoAPIVersion, ErrNoAPIVersion.Error()},
+		{"unknown apiVersion", `{"apiVersion": "v3", "containers": []}`, ErrUnsupportedAPIVersion, `unsupported annotation apiVersion: "v3"`},
+	}
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			err := CPUAnnotation{}.Decode([]byte(tt.annotation))
+			if tt.err == nil {
+				s.Nil(err)
+				return
+			}
+			s.ErrorIs(err, tt.err)
+			s.EqualError(err, tt.message)
+		})
+	}
+}
+
+func (s *AnnotationTestSuit) TestContainerDecodeAnnotationInvalidV2() {
+	tests := []struct {
+		name    string
+		process string
+		err     error
+	}{
+		{"env without name", `"env": [{"value": "x"}]`, ErrInvalidEnv},
+		{"relative workingDir", `"workingDir": "opt"`, ErrRelativeWorkingDir},
+		{"unknown schedPolicy", `"schedPolicy": "deadline"`, ErrInvalidSchedPolicy},
+		{"priority without realtime policy", `"schedPriority": 10`, ErrInvalidSchedPriority},
+		{"realtime policy without priority", `"schedPolicy": "rr"`, ErrInvalidSchedPriority},
+		{"nice out of range", `"nice": 20`, ErrInvalidNice},
+		{"cpuIndices count", `"cpuIndices": [0]`, ErrInvalidCPUIndices},
+		{"negative cpuIndices", `"cpuIndices": [0, -1]`, ErrInvalidCPUIndices},
+		{"duplicate cpuIndices", `"cpuIndices": [1, 1]`, ErrInvalidCPUIndices},
+		{"cpuIndices given to another process", `"cpuIndices": [0, 2]`, ErrInvalidCPUIndices},
+		{"unknown restartPolicy", `"restartPolicy": "Sometimes"`, ErrInvalidRestartPolicy},
+	}
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			annotation := `{"apiVersion": "v2", "containers": [{"container": "app", "processes": [
+				{"process": "/bin/first", "cpus": 1, "pool": "exclusive-pool1", "cpuIndices": [2]},
+				{"process": "/bin/app", "cpus": 2, "pool": "exclusive-pool1", ` + tt.process + `}]}]}`
+			err := CPUAnnotation{}.Decode([]byte(annotation))
+			s.ErrorIs(err, tt.err)
+			annotationErr := &AnnotationError{}
+			s.ErrorAs(err, &annotationErr)
+			s.Equal(0, annotationErr.Container)
+			s.Equal(1, annotationErr.Process)
+		})
+	}
+	err := CPUAnnotation{}.Decode([]byte(`{"apiVersion": "v2", "containers": [{"container": "app", "processes": [{"process": "/bin/app", "cpus": 100, "pool": "shared-pool1", "cpuIndices": [0]}]}]}`))
+	s.EqualError(err, "containers[0].processes[0]: invalid 'cpuIndices': CPUs can only be picked from an exclusive pool")
+}
+
+func (s *AnnotationTestSuit) TestEncodeAnnotation() {
+	s.cpuAnnotation["Container2"].Processes[0].RestartPolicy = RestartPolicyAlways
+	encoded, err := s.cpuAnnotation.Encode()
+	s.Nil(err)
+	s.Contains(string(encoded), `{"apiVersion":"v2","containers":[{"container":"Container1",`)
+	decoded := CPUAnnotation{}
+	s.Nil(decoded.Decode(encoded))
+	s.Equal(s.cpuAnnotation, decoded)
 }
 
 // go test 入口
@@ -30,9 +30,25 @@ var (
 	ErrNoProcessName   = errors.New("'process' (name) is mandatory in annotation")
 	ErrNoCpus          = errors.New("'cpus' field is mandatory in annotation")
 
+	ErrNoAPIVersion          = errors.New("'apiVersion' is mandatory in an annotation object")
+	ErrUnsupportedAPIVersion = errors.New("unsupported annotation apiVersion")
+	ErrFieldNeedsV2          = errors.New("field needs apiVersion v2 of the annotation")
+	ErrInvalidEnv            = errors.New("invalid environment variable name")
+	ErrRelativeWorkingDir    = errors.New("'workingDir' must be an absolute path")
+	ErrInvalidSchedPolicy    = errors.New("invalid 'schedPolicy'")
+	ErrInvalidSchedPriority  = errors.New("invalid 'schedPriority'")
+	ErrInvalidNice           = errors.New("invalid 'nice'")
+	ErrInvalidCPUIndices     = errors.New("invalid 'cpuIndices'")
+	ErrInvalidRestartPolicy  = errors.New("invalid 'restartPolicy'")
+
 	ErrNotReadPoolConfig  = errors.New("could not read poolconfig file")
 	ErrNotParsePoolConfig = errors.New("could not parse poolconfig file")
 	ErrNotMatchPoolConfig = errors.New("no matching pool configuration file found for provided nodeSelector label")
 
 	ErrCallAPIServerNodeInfo = errors.New("following error happend when trying to read K8s API server Node object")
+
+	ErrNoAnnotationSignature      = errors.New("cpus annotation is not signed")
+	ErrInvalidAnnotationSignature = errors.New("cpus annotation signature does not match, the annotation was changed after admission")
+	ErrInvalidSigningKey          = errors.New("annotation signing key must be an ed25519 private key in PKCS #8 PEM form")
+	ErrNoAnnotationPublicKey      = errors.New("cpus annotation has to be verified, but the process starter was built without public key")
 )
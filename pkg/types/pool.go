@@ -17,6 +17,7 @@ limitations under the License.
 package types
 
 import (
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
 	"strings"
@@ -39,6 +40,21 @@ const (
 	SingleThreadHTPolicy = "singleThreaded"
 	// MultiThreadHTPolicy 是 HT 策略池属性的多线程值的常量。设置此值时，所有兄弟一起分配用于独占请求
 	MultiThreadHTPolicy = "multiThreaded"
+	// PhysicalCoreHTPolicy 是 HT 策略池属性的物理核值的常量。设置此值时，每个物理核作为一个设备发布(ID 为主线程)，分配时包含其所有兄弟线程
+	PhysicalCoreHTPolicy = "physicalCore"
+	// DefaultThreadsPerCore 是未配置 threadsPerCore 时假定的每个物理核的线程数
+	DefaultThreadsPerCore = 2
+	// CFSQuotaDisabled 是 CFS 配额模式的禁用值。设置此值时，不为使用该池的容器设置 CPU limit
+	CFSQuotaDisabled = "disabled"
+	// CFSQuotaPadded 是 CFS 配额模式的填充值。设置此值时，CPU limit 为从池分配的 CPU 时间加上 padding 毫核
+	CFSQuotaPadded = "padded"
+	// CFSQuotaExact 是 CFS 配额模式的精确值。设置此值时，CPU limit 等于从池分配的 CPU 时间
+	CFSQuotaExact = "exact"
+	// CFSQuotaPoolSize 是共享池的 CFS 配额模式。同时使用独占池的容器的 CPU limit 为其独占 CPU 加上整个共享池的大小，
+	// 避免共享线程的突发负载限制对延迟敏感的独占线程；只使用共享池的容器等同于 exact 模式
+	CFSQuotaPoolSize = "poolSize"
+	// DefaultCFSQuotaPadding 是未配置 CFS 配额策略的独占池的默认 padding 毫核数
+	DefaultCFSQuotaPadding = 100
 )
 
 var (
@@ -48,9 +64,133 @@ var (
 
 // Pool defines cpupool
 type Pool struct {
-	CPUset   cpuset.CPUSet
-	CPUStr   string `yaml:"cpus"`
-	HTPolicy string `yaml:"hyperThreadingPolicy"`
+	CPUset         cpuset.CPUSet
+	CPUStr         string         `yaml:"cpus"`
+	HTPolicy       string         `yaml:"hyperThreadingPolicy"`
+	ThreadsPerCore int            `yaml:"threadsPerCore"`
+	CFSQuota       CFSQuotaPolicy `yaml:"cfsQuota"`
+}
+
+// CFSQuotaPolicy defines the CFS quota of the containers using a pool
+type CFSQuotaPolicy struct {
+	// Mode is one of disabled, padded, exact, or poolSize
+	Mode string `yaml:"mode" json:"mode"`
+	// Padding is the millicores added to the CPU time of the pool in padded mode
+	Padding int `yaml:"padding" json:"padding,omitempty"`
+	// AllowedOverrides lists the modes pods may choose instead of Mode with the CFS quota annotation
+	AllowedOverrides []string `yaml:"allowedOverrides" json:"-"`
+	// PoolSize is the size of the pool in millicores, the largest one when the pool is configured differently on different nodes
+	// It is resolved from the pool configs for the poolSize mode, and is 0 when they are not available
+	PoolSize int `yaml:"-" json:"-"`
+	// CPUsPerDevice is how many CPUs one device of an exclusive pool gives, the most when the pool is configured differently on different nodes
+	// It is resolved from the pool configs, and is 0 when they are not available, every device counts as one CPU then
+	CPUsPerDevice int `yaml:"-" json:"-"`
+}
+
+// DefaultCFSQuotaPolicy returns the policy of a pool without CFS quota configuration
+// Exclusive pools are padded with a small margin to avoid accidentally throttling latency sensitive workloads,
+// shared pools pad the containers also using exclusive pools with their full size, and the default pool is not limited
+func DefaultCFSQuotaPolicy(poolName string) CFSQuotaPolicy {
+	switch DeterminePoolType(poolName) {
+	case ExclusivePoolID:
+		return CFSQuotaPolicy{Mode: CFSQuotaPadded, Padding: DefaultCFSQuotaPadding}
+	case SharedPoolID:
+		return CFSQuotaPolicy{Mode: CFSQuotaPoolSize}
+	default:
+		return CFSQuotaPolicy{Mode: CFSQuotaDisabled}
+	}
+}
+
+// ValidCFSQuotaMode tells if the mode is one of the CFS quota modes
+func ValidCFSQuotaMode(mode string) bool {
+	return mode == CFSQuotaDisabled || mode == CFSQuotaPadded || mode == CFSQuotaExact || mode == CFSQuotaPoolSize
+}
+
+// Validate checks the modes and the padding of the policy
+func (q CFSQuotaPolicy) Validate() error {
+	if !ValidCFSQuotaMode(q.Mode) {
+		return fmt.Errorf("CFS quota mode %q must be one of %s, %s, %s, or %s", q.Mode, CFSQuotaDisabled, CFSQuotaPadded, CFSQuotaExact, CFSQuotaPoolSize)
+	}
+	if q.Padding < 0 {
+		return fmt.Errorf("CFS quota padding %d must not be negative", q.Padding)
+	}
+	if q.Padding > 0 && q.Mode != CFSQuotaPadded {
+		return fmt.Errorf("CFS quota padding is only allowed in %s mode", CFSQuotaPadded)
+	}
+	for _, mode := range q.AllowedOverrides {
+		if !ValidCFSQuotaMode(mode) {
+			return fmt.Errorf("CFS quota override %q must be one of %s, %s, %s, or %s", mode, CFSQuotaDisabled, CFSQuotaPadded, CFSQuotaExact, CFSQuotaPoolSize)
+		}
+	}
+	return nil
+}
+
+// Quota returns the CFS quota in millicores of a container given cpuTime millicores from the pool
+// mixed tells if the container uses exclusive and shared pools too, in which case the poolSize mode gives it the size of the pool
+// false is returned when the container must not be limited
+func (q CFSQuotaPolicy) Quota(cpuTime int, mixed bool) (int, bool) {
+	switch q.Mode {
+	case CFSQuotaPoolSize:
+		if mixed && q.PoolSize > 0 {
+			return q.PoolSize, true
+		}
+		return cpuTime, true
+	case CFSQuotaExact:
+		return cpuTime, true
+	case CFSQuotaPadded:
+		return cpuTime + q.Padding, true
+	default:
+		return 0, false
+	}
+}
+
+// Allows tells if a pod may use the mode instead of the one of the policy
+func (q CFSQuotaPolicy) Allows(mode string) bool {
+	if mode == q.Mode {
+		return true
+	}
+	for _, allowed := range q.AllowedOverrides {
+		if allowed == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// cfsQuotaPermissiveness orders the modes by how much CPU time they let a container use
+var cfsQuotaPermissiveness = map[string]int{CFSQuotaExact: 0, CFSQuotaPadded: 1, CFSQuotaPoolSize: 2, CFSQuotaDisabled: 3}
+
+// Merge combines the policies of a pool configured differently on different nodes
+// The container gets the most permissive quota, but may only use the overrides allowed by both
+func (q CFSQuotaPolicy) Merge(other CFSQuotaPolicy) CFSQuotaPolicy {
+	merged := q
+	if cfsQuotaPermissiveness[other.Mode] > cfsQuotaPermissiveness[q.Mode] ||
+		(other.Mode == q.Mode && other.Padding > q.Padding) {
+		merged.Mode, merged.Padding = other.Mode, other.Padding
+	}
+	merged.AllowedOverrides = nil
+	for _, mode := range append([]string{q.Mode}, q.AllowedOverrides...) {
+		if mode != merged.Mode && other.Allows(mode) {
+			merged.AllowedOverrides = append(merged.AllowedOverrides, mode)
+		}
+	}
+	return merged
+}
+
+// AllocatesHTSiblings tells if the sibling threads of the allocated CPUs are given to the container too
+func (p Pool) AllocatesHTSiblings() bool {
+	return p.HTPolicy == MultiThreadHTPolicy || p.HTPolicy == PhysicalCoreHTPolicy
+}
+
+// CPUsPerDevice returns the maximum number of logical CPUs a container gets for one device allocated from the pool
+func (p Pool) CPUsPerDevice() int {
+	if !p.AllocatesHTSiblings() {
+		return 1
+	}
+	if p.ThreadsPerCore > 0 {
+		return p.ThreadsPerCore
+	}
+	return DefaultThreadsPerCore
 }
 
 // PoolConfig defines pool configuration for a node
@@ -77,9 +217,13 @@ func parsePoolConfigFile(name string) (PoolConfig, error) {
 		typesLogger.Error(ErrNotReadPoolConfig.Error(), logger.Error(err), logger.Any("file", name))
 		return PoolConfig{}, ErrNotReadPoolConfig
 	}
+	return ParsePoolConfig(file)
+}
 
+// ParsePoolConfig parses the content of a pool configuration file, e.g. one entry of the pool ConfigMap
+func ParsePoolConfig(buf []byte) (PoolConfig, error) {
 	var poolConfig PoolConfig
-	err = yaml.Unmarshal([]byte(file), &poolConfig)
+	err := yaml.Unmarshal(buf, &poolConfig)
 	if err != nil {
 		typesLogger.Error(ErrNotParsePoolConfig.Error(), logger.Error(err))
 		return PoolConfig{}, ErrNotParsePoolConfig
@@ -95,6 +239,17 @@ func parsePoolConfigFile(name string) (PoolConfig, error) {
 		if poolBody.HTPolicy == "" { //Default Set HTPolicy is SingleThreadHTPolicy
 			tempPool.HTPolicy = SingleThreadHTPolicy
 		}
+		if poolBody.CFSQuota.Mode == "" {
+			tempPool.CFSQuota.Mode, tempPool.CFSQuota.Padding = DefaultCFSQuotaPolicy(poolName).Mode, DefaultCFSQuotaPolicy(poolName).Padding
+		}
+		if err = tempPool.CFSQuota.Validate(); err != nil {
+			typesLogger.Error(ErrNotParsePoolConfig.Error(), logger.Error(err), logger.Any("pool", poolName))
+			return PoolConfig{}, ErrNotParsePoolConfig
+		}
+		if DeterminePoolType(poolName) != SharedPoolID && tempPool.CFSQuota.Allows(CFSQuotaPoolSize) {
+			typesLogger.Error(ErrNotParsePoolConfig.Error(), logger.Any("pool", poolName), logger.Any("reason", "poolSize CFS quota is only allowed for shared pools"))
+			return PoolConfig{}, ErrNotParsePoolConfig
+		}
 		poolConfig.Pools[poolName] = tempPool
 	}
 	return poolConfig, err
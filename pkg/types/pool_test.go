@@ -41,3 +41,70 @@ func TestParsePoolConfigs(t *testing.T) {
 	assert.True(ok)
 	assert.Equal(value, "node1")
 }
+
+func TestPoolCPUsPerDevice(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(1, Pool{HTPolicy: SingleThreadHTPolicy}.CPUsPerDevice())
+	assert.Equal(1, Pool{}.CPUsPerDevice())
+	assert.Equal(DefaultThreadsPerCore, Pool{HTPolicy: MultiThreadHTPolicy}.CPUsPerDevice())
+	assert.Equal(4, Pool{HTPolicy: PhysicalCoreHTPolicy, ThreadsPerCore: 4}.CPUsPerDevice())
+	assert.True(Pool{HTPolicy: PhysicalCoreHTPolicy}.AllocatesHTSiblings())
+	assert.False(Pool{HTPolicy: SingleThreadHTPolicy}.AllocatesHTSiblings())
+}
+
+func TestDefaultCFSQuotaPolicy(t *testing.T) {
+	assert := assert.New(t)
+	labels := map[string]string{"nodeType": "node1"}
+	poolConfig, err := parsePoolConfigs(labels, "cpuset-*.yaml")
+	assert.Nil(err)
+	assert.Equal(CFSQuotaPolicy{Mode: CFSQuotaPadded, Padding: DefaultCFSQuotaPadding}, poolConfig.Pools["exclusive-cpupool2"].CFSQuota)
+	assert.Equal(CFSQuotaPolicy{Mode: CFSQuotaPoolSize, AllowedOverrides: []string{CFSQuotaExact, CFSQuotaDisabled}}, poolConfig.Pools["sharedpool"].CFSQuota)
+	assert.Equal(CFSQuotaPolicy{Mode: CFSQuotaDisabled}, poolConfig.Pools["default"].CFSQuota)
+}
+
+func TestCFSQuotaPolicy(t *testing.T) {
+	assert := assert.New(t)
+	quota, ok := CFSQuotaPolicy{Mode: CFSQuotaPadded, Padding: 100}.Quota(2000, false)
+	assert.True(ok)
+	assert.Equal(2100, quota)
+	quota, ok = CFSQuotaPolicy{Mode: CFSQuotaExact}.Quota(300, false)
+	assert.True(ok)
+	assert.Equal(300, quota)
+	_, ok = CFSQuotaPolicy{Mode: CFSQuotaDisabled}.Quota(300, false)
+	assert.False(ok)
+	quota, ok = CFSQuotaPolicy{Mode: CFSQuotaPoolSize, PoolSize: 4000}.Quota(300, true)
+	assert.True(ok)
+	assert.Equal(4000, quota)
+	quota, _ = CFSQuotaPolicy{Mode: CFSQuotaPoolSize, PoolSize: 4000}.Quota(300, false)
+	assert.Equal(300, quota)
+	quota, _ = CFSQuotaPolicy{Mode: CFSQuotaPoolSize}.Quota(300, true)
+	assert.Equal(300, quota)
+
+	assert.Nil(CFSQuotaPolicy{Mode: CFSQuotaExact, AllowedOverrides: []string{CFSQuotaDisabled}}.Validate())
+	assert.NotNil(CFSQuotaPolicy{Mode: "unlimited"}.Validate())
+	assert.NotNil(CFSQuotaPolicy{Mode: CFSQuotaExact, Padding: 100}.Validate())
+	assert.NotNil(CFSQuotaPolicy{Mode: CFSQuotaPadded, Padding: -1}.Validate())
+	assert.NotNil(CFSQuotaPolicy{Mode: CFSQuotaExact, AllowedOverrides: []string{"none"}}.Validate())
+
+	policy := CFSQuotaPolicy{Mode: CFSQuotaExact, AllowedOverrides: []string{CFSQuotaPadded}}
+	assert.True(policy.Allows(CFSQuotaExact))
+	assert.True(policy.Allows(CFSQuotaPadded))
+	assert.False(policy.Allows(CFSQuotaDisabled))
+}
+
+func TestPoolSizeCFSQuotaOnlyForSharedPools(t *testing.T) {
+	_, err := ParsePoolConfig([]byte("pools:\n  shared-pool:\n    cpus: \"1-2\"\n    cfsQuota:\n      mode: poolSize\n"))
+	assert.Nil(t, err)
+	_, err = ParsePoolConfig([]byte("pools:\n  exclusive-pool:\n    cpus: \"1-2\"\n    cfsQuota:\n      mode: exact\n      allowedOverrides: [poolSize]\n"))
+	assert.Equal(t, ErrNotParsePoolConfig, err)
+}
+
+func TestCFSQuotaPolicyMerge(t *testing.T) {
+	assert := assert.New(t)
+	exact := CFSQuotaPolicy{Mode: CFSQuotaExact, AllowedOverrides: []string{CFSQuotaPadded, CFSQuotaDisabled}}
+	padded := CFSQuotaPolicy{Mode: CFSQuotaPadded, Padding: 200, AllowedOverrides: []string{CFSQuotaExact}}
+	assert.Equal(CFSQuotaPolicy{Mode: CFSQuotaPadded, Padding: 200, AllowedOverrides: []string{CFSQuotaExact}}, exact.Merge(padded))
+	assert.Equal(CFSQuotaPolicy{Mode: CFSQuotaPadded, Padding: 200, AllowedOverrides: []string{CFSQuotaExact}}, padded.Merge(exact))
+	assert.Equal(CFSQuotaPolicy{Mode: CFSQuotaPadded, Padding: 300}, padded.Merge(CFSQuotaPolicy{Mode: CFSQuotaPadded, Padding: 300}))
+	assert.Equal(CFSQuotaDisabled, padded.Merge(CFSQuotaPolicy{Mode: CFSQuotaDisabled}).Mode)
+}
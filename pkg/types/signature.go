@@ -0,0 +1,83 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+)
+
+const (
+	// PodNamespaceEnv is the environment variable of the pinned containers holding the namespace the cpus annotation was approved in
+	PodNamespaceEnv = "POD_NAMESPACE"
+	// AnnotationSignatureRequiredEnv is set to "true" in the pinned containers by a webhook signing the cpus annotations
+	// The environment cannot change after admission, unlike the annotations a signature could be removed from
+	AnnotationSignatureRequiredEnv = "CPUS_SIGNATURE_REQUIRED"
+)
+
+// annotationSignatureMessage binds the annotation to the namespace it was approved in,
+// so an annotation approved by the policy of another namespace cannot be copied into a pod after admission
+func annotationSignatureMessage(namespace, annotation string) []byte {
+	return []byte(namespace + "\x00" + annotation)
+}
+
+// ParseSigningKey parses the PKCS #8 PEM encoded ed25519 private key the webhook signs the approved annotations with
+func ParseSigningKey(buf []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, ErrInvalidSigningKey
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidSigningKey
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, ErrInvalidSigningKey
+	}
+	return privateKey, nil
+}
+
+// EncodePublicKey returns the form of the public key the process starter is built with
+// It is never taken from the pod, whose author could replace it along with the annotation
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// SignCPUAnnotation returns the signature of the cpus annotation approved in the namespace
+// ed25519 signatures are deterministic, signing the same annotation again gives the same signature
+func SignCPUAnnotation(key ed25519.PrivateKey, namespace, annotation string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, annotationSignatureMessage(namespace, annotation)))
+}
+
+// VerifyCPUAnnotation checks that the cpus annotation is the one approved in the namespace by the holder of the public key
+func VerifyCPUAnnotation(publicKey, namespace, annotation, signature string) error {
+	if signature == "" {
+		return ErrNoAnnotationSignature
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return ErrInvalidAnnotationSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), annotationSignatureMessage(namespace, annotation), sig) {
+		return ErrInvalidAnnotationSignature
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2022 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignCPUAnnotation(t *testing.T) {
+	assert := assert.New(t)
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(err)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.Nil(err)
+	parsed, err := ParseSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	assert.Nil(err)
+	assert.Equal(privateKey, parsed)
+
+	annotation := `[{"container":"app","processes":[{"process":"/bin/app","cpus":1,"pool":"exclusive"}]}]`
+	signature := SignCPUAnnotation(parsed, "telco", annotation)
+	assert.Equal(signature, SignCPUAnnotation(parsed, "telco", annotation))
+	pub := EncodePublicKey(publicKey)
+	assert.Nil(VerifyCPUAnnotation(pub, "telco", annotation, signature))
+	assert.Equal(ErrInvalidAnnotationSignature, VerifyCPUAnnotation(pub, "other", annotation, signature))
+	assert.Equal(ErrInvalidAnnotationSignature, VerifyCPUAnnotation(pub, "telco", annotation+" ", signature))
+	assert.Equal(ErrInvalidAnnotationSignature, VerifyCPUAnnotation("not base64", "telco", annotation, signature))
+	assert.Equal(ErrNoAnnotationSignature, VerifyCPUAnnotation(pub, "telco", annotation, ""))
+
+	_, err = ParseSigningKey([]byte("not a key"))
+	assert.Equal(ErrInvalidSigningKey, err)
+}